@@ -17,82 +17,360 @@ package mongodbadapter
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
 	"runtime"
+	"sort"
 	"strings"
-
-	"github.com/casbin/casbin/model"
-	"github.com/casbin/casbin/persist"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/x/bsonx"
+	"sync"
+	"time"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
 )
 
 // CasbinRule represents a rule in Casbin.
 type CasbinRule struct {
-	PType string
-	V0    string
-	V1    string
-	V2    string
-	V3    string
-	V4    string
-	V5    string
+	PType  string
+	V0     string
+	V1     string
+	V2     string
+	V3     string
+	V4     string
+	V5     string
+	Tenant string `bson:"tenant,omitempty"`
+	// Section is the model section of the rule, e.g. "g", stored only when
+	// it is not the first letter of PType, from which it is inferred
+	// otherwise.
+	Section string `bson:"sec,omitempty"`
+	// Priority is the priority of a rule of a priority model, copied from
+	// its priority token to order the rules on load.
+	Priority int `bson:"priority,omitempty"`
+	// UpdatedAt is the time the rule was written, see TrackUpdates.
+	UpdatedAt *time.Time `bson:"updatedAt,omitempty"`
 }
 
-// adapter represents the MongoDB adapter for policy storage.
-type adapter struct {
-	client       *mongo.Client
-	collection   *mongo.Collection
-	databaseName string
-	filtered     bool
+// Adapter represents the MongoDB adapter for policy storage. It implements
+// persist.Adapter, persist.FilteredAdapter and persist.UpdatableAdapter, and
+// is returned by the constructors as is so that its other methods, such as
+// Healthy or PolicyStats, can be called without a type assertion.
+type Adapter struct {
+	cfg        Config
+	client     *mongo.Client
+	clientOpts []*options.ClientOptions
+	collection *mongo.Collection
+	database   *mongo.Database
+	// store holds the rules instead of collection, see NewMemoryAdapter.
+	store store
+	// revision is the policy revision last loaded or saved, see
+	// OptimisticConcurrency.
+	revision int64
+	// filtered reports whether the policy last loaded is a subset of the
+	// stored one. cfg.IsFiltered instead reports whether the adapter was
+	// constructed as filtered, see IsFiltered.
+	filtered   bool
+	ownsClient bool
+	connMu     sync.Mutex
+
+	// policyMu is held exclusively by the operations replacing the stored
+	// policy, such as SavePolicy, and shared by loads and rule writes, so
+	// that they never observe or interleave with a partial replacement.
+	policyMu sync.RWMutex
+	// stateMu guards revision and filtered.
+	stateMu sync.Mutex
+
+	cacheMu  sync.Mutex
+	cache    *policySnapshot
+	cacheGen uint64
+
+	bufferMu   sync.Mutex
+	pending    []mongo.WriteModel
+	flushTimer *time.Timer
+	// asyncErr is the error of a failed background flush, see
+	// CoalesceWrites.
+	asyncErr error
+
+	priorityMu sync.Mutex
+	// priorityIndex maps the ptypes with a priority token to its
+	// position, see notePriorityTokens.
+	priorityIndex map[string]int
+
+	// optErr is the first error of the options applied by the constructor,
+	// see WithOption.
+	optErr error
+
+	// stagingDenied reports whether the user was found not to be allowed
+	// to rename collections, see SaveViaStaging.
+	stagingDenied bool
+
+	// indexMu guards indexed, which reports whether the indexes were
+	// created on the first write, see EnsureIndexesOnOpen.
+	indexMu sync.Mutex
+	indexed bool
+
+	reloadMu    sync.Mutex
+	stopReload  context.CancelFunc
+	reloadDone  chan struct{}
+	reloadTimer *time.Timer
 }
 
+var (
+	_ persist.FilteredAdapter  = (*Adapter)(nil)
+	_ persist.UpdatableAdapter = (*Adapter)(nil)
+)
+
 const (
-	defaultDatabase = "casbin"
+	defaultDatabase   = "casbin"
+	defaultCollection = "casbin_rule"
+	defaultBatchSize  = 1000
+
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 // DBName sets the name of the database to be used by casbin
-func DBName(databaseName string) func(*adapter) {
-	return func(a *adapter) {
-		a.databaseName = databaseName
+func DBName(databaseName string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.DatabaseName = databaseName
+	}
+}
+
+// Filtered constructs the adapter as filtered, as NewFilteredAdapter does.
+func Filtered(filtered bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.IsFiltered = filtered
+	}
+}
+
+// AppendFilteredLoads makes LoadFilteredPolicy and LoadFilteredPolicyPipeline
+// add the loaded rules to those already in the model, so that several
+// filtered loads can be composed, as casbin's LoadIncrementalFilteredPolicy
+// does. By default the rules of the model are cleared first, so that only the
+// rules matching the last filter are left.
+func AppendFilteredLoads(keep bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.AppendFilteredLoads = keep
+	}
+}
+
+// Projection restricts the rule fields fetched from the database when loading
+// policy to the given fields (e.g. "v0", "v1"). The ptype field is always
+// fetched and the _id field never is.
+func Projection(fields ...string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.Projection = fields
+	}
+}
+
+// LoadSort sets the order in which LoadPolicy and LoadFilteredPolicy load
+// rules, as a MongoDB sort document, e.g. bson.D{{Key: "priority", Value: -1}}
+// to load the rules with the highest priority field first. It defaults to _id
+// ascending, which is the order in which rules were saved and keeps the
+// precedence of rules stable for models relying on rule order, such as the
+// priority model. Rules of a model with a priority token, such as
+// "p = priority, sub, obj, act, eft", are instead loaded by increasing
+// priority by default. A bson.D sort without _id is completed with _id
+// ascending, so that rules sorting equal keep a stable order across loads.
+func LoadSort(sort interface{}) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.LoadSort = sort
+	}
+}
+
+// StrictDecode makes LoadPolicy and LoadFilteredPolicy fail on the first
+// stored document that cannot be decoded into a CasbinRule. By default such
+// documents are skipped, the other rules are loaded and the load then fails
+// with an error reporting the number of skipped documents.
+func StrictDecode(strict bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.StrictDecode = strict
+	}
+}
+
+// CaseInsensitive makes filtered loads and filtered removals match values
+// regardless of case, using a collation of strength 2. It cannot be combined
+// with DocumentDBCompat, as DocumentDB does not support collations. The
+// indexes created by the adapter only support these queries with
+// IndexCollation.
+func CaseInsensitive(ignoreCase bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.CaseInsensitive = ignoreCase
+	}
+}
+
+// IndexCollation creates the indexes of the adapter with collation, and makes
+// the queries of the adapter use it so that the indexes support them. For
+// instance, &options.Collation{Locale: "en", Strength: 2} makes filtered
+// loads and removals case-insensitive, as CaseInsensitive does, without
+// scanning the collection. The collated indexes are created next to any
+// existing ones, which DropIndexes then EnsureIndexes can clean up. It cannot
+// be combined with DocumentDBCompat or encrypted fields.
+func IndexCollation(collation *options.Collation) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.IndexCollation = collation
+	}
+}
+
+// BatchSize sets the maximum number of documents sent to the database in a
+// single request by SavePolicy and Flush. It defaults to 1000.
+func BatchSize(size int) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.BatchSize = size
+	}
+}
+
+// StrictRemove makes RemovePolicy return ErrPolicyNotFound when no stored
+// rule matches the removed one. It has no effect on buffered writes.
+func StrictRemove(strict bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.StrictRemove = strict
+	}
+}
+
+// AllowEmptySave controls whether SavePolicy, SavePolicyIfVersion and
+// ImportPolicy with ImportReplace may replace the stored rules with an empty
+// policy, which clears the collection. It is allowed by default; disallowing
+// it makes them fail with ErrEmptySave instead, so that a misconfigured model
+// cannot wipe the stored policy.
+func AllowEmptySave(allow bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.RefuseEmptySave = !allow
+	}
+}
+
+// RequireExistingCollection makes the adapter fail with ErrCollectionNotFound
+// when opening it if the policy collection does not exist, instead of having
+// MongoDB create it on the first write. This turns a misspelled database
+// name into an error rather than an empty policy.
+func RequireExistingCollection(require bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.RequireExistingCollection = require
+	}
+}
+
+// LazyConnect defers connecting to the database until the first operation
+// that needs it. The constructor then only validates the URL, and a failed
+// connection attempt is returned by that operation and retried by the next.
+func LazyConnect(lazy bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.LazyConnect = lazy
 	}
 }
 
-// Filtered sets flags for filtered policy
-func Filtered(filtered bool) func(*adapter) {
-	return func(a *adapter) {
-		a.filtered = filtered
+// NoFinalizer stops the constructors from registering a finalizer closing
+// the adapter once it is garbage collected, for callers that always call
+// Close themselves. Adapters created with NewAdapterFromClient never have
+// one, since their client is not theirs to close.
+func NoFinalizer(disable bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.NoFinalizer = disable
 	}
 }
 
 // finalizer is the destructor for adapter.
-func finalizer(a *adapter) {
-	a.close()
+func finalizer(a *Adapter) {
+	a.Close()
 }
 
 // NewAdapter is the constructor for Adapter.
-func NewAdapter(url string, opts ...func(*adapter)) persist.Adapter {
-	cl, err := mongo.NewClient(options.Client().ApplyURI(url))
-
+func NewAdapter(url string, opts ...func(*Adapter)) *Adapter {
+	a, err := NewAdapterWithError(url, opts...)
 	if err != nil {
 		panic(err)
 	}
-	dbName := parseDatabase(url)
-	a := &adapter{client: cl, filtered: false, databaseName: dbName}
+
+	return a
+}
+
+// NewAdapterWithError is like NewAdapter but returns an error rather than
+// panicking if the URL is invalid or the database cannot be reached.
+func NewAdapterWithError(url string, opts ...func(*Adapter)) (*Adapter, error) {
+	if err := validateURL(url); err != nil {
+		return nil, &OpError{Op: "NewAdapter", Collection: defaultCollection, Err: err}
+	}
+
+	return NewAdapterWithClientOptions(options.Client().ApplyURI(url), opts...)
+}
+
+// NewAdapterWithClientOptions creates a new adapter with a client built from
+// the given client options, e.g. to configure TLS, credentials or the
+// connection pool. As with NewAdapter, the adapter connects and disconnects
+// the client itself, and the database name is taken from the options' URI
+// unless set with DBName.
+func NewAdapterWithClientOptions(clientOpts *options.ClientOptions, opts ...func(*Adapter)) (*Adapter, error) {
+	if clientOpts == nil {
+		return nil, &OpError{Op: "NewAdapter", Collection: defaultCollection, Err: errors.New("client options must not be nil")}
+	}
+
+	cfg := defaultConfig()
+	cfg.URL = clientOpts.GetURI()
+	cfg.DatabaseName = parseDatabase(cfg.URL)
+	return newAdapter(clientOpts, cfg, opts...)
+}
+
+// newAdapter creates an adapter owning a client built from clientOpts, with
+// cfg modified by opts.
+func newAdapter(clientOpts *options.ClientOptions, cfg Config, opts ...func(*Adapter)) (*Adapter, error) {
+	a := &Adapter{cfg: cfg, ownsClient: true}
 
 	for _, opt := range opts {
 		opt(a)
 	}
+	a.filtered = a.cfg.IsFiltered
+
+	if a.optErr != nil {
+		return nil, a.wrapErr("NewAdapter", a.optErr)
+	}
+	if err := a.cfg.validate(); err != nil {
+		return nil, a.wrapErr("NewAdapter", err)
+	}
+	if err := clientOpts.Validate(); err != nil {
+		return nil, a.wrapErr("NewAdapter", err)
+	}
+	a.clientOpts = []*options.ClientOptions{clientOpts, a.clientOptions()}
 
 	// Open the DB, create it if not existed.
-	a.open()
+	if !a.cfg.LazyConnect {
+		if err := a.open(); err != nil {
+			a.close()
+			return nil, a.wrapErr("NewAdapter", err)
+		}
+	}
 
 	// Call the destructor when the object is released
-	runtime.SetFinalizer(a, finalizer)
+	if !a.cfg.NoFinalizer {
+		runtime.SetFinalizer(a, finalizer)
+	}
 
-	return a
+	return a, nil
+}
 
+// clientOptions returns the client options implied by the adapter options.
+// They take precedence over the options given to the constructor.
+func (a *Adapter) clientOptions() *options.ClientOptions {
+	opts := options.Client()
+	if a.cfg.RetryWrites != nil {
+		opts.SetRetryWrites(*a.cfg.RetryWrites)
+	}
+	if a.cfg.DocumentDBCompat {
+		opts.SetRetryWrites(false)
+	}
+	if a.cfg.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(a.cfg.ConnectTimeout)
+		opts.SetServerSelectionTimeout(a.cfg.ConnectTimeout)
+	}
+	if a.cfg.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(a.cfg.MaxPoolSize)
+	}
+	if len(a.cfg.Compressors) > 0 {
+		opts.SetCompressors(a.cfg.Compressors)
+	}
+	if a.cfg.AutoEncryption != nil {
+		opts.SetAutoEncryptionOptions(a.cfg.AutoEncryption)
+	}
+	return opts
 }
 
 func parseDatabase(uri string) string {
@@ -113,151 +391,663 @@ func parseDatabase(uri string) string {
 // NewAdapterFromClient creates a new adapter from an existing connected mongodb client.
 // Intended for reusing an already established client connection.
 // Opening and Closing client connection will not be handled by the adapter.
-func NewAdapterFromClient(cl *mongo.Client, opts ...func(*adapter)) persist.Adapter {
+func NewAdapterFromClient(cl *mongo.Client, opts ...func(*Adapter)) *Adapter {
+	return newAdapterFromClient(&Adapter{client: cl, cfg: defaultConfig()}, opts...)
+}
 
-	a := &adapter{client: cl, filtered: false, databaseName: "casbin"}
+// NewAdapterFromDatabase creates a new adapter storing its policy in the given
+// database. As with NewAdapterFromClient, the database's client is neither
+// connected nor disconnected by the adapter. The DBName option is ignored.
+func NewAdapterFromDatabase(db *mongo.Database, opts ...func(*Adapter)) *Adapter {
+	cfg := defaultConfig()
+	cfg.DatabaseName = db.Name()
+	return newAdapterFromClient(&Adapter{client: db.Client(), database: db, cfg: cfg}, opts...)
+}
 
+// newAdapterFromClient applies opts to a, which uses a client it does not
+// own, and prepares it unless LazyConnect is set.
+func newAdapterFromClient(a *Adapter, opts ...func(*Adapter)) *Adapter {
 	for _, opt := range opts {
 		opt(a)
 	}
+	a.filtered = a.cfg.IsFiltered
 
-	a.prep()
+	if a.optErr != nil {
+		panic(a.wrapErr("NewAdapter", a.optErr))
+	}
+	if err := a.cfg.validate(); err != nil {
+		panic(a.wrapErr("NewAdapter", err))
+	}
+	if !a.cfg.LazyConnect {
+		if err := a.prep(); err != nil {
+			panic(err)
+		}
+	}
 
 	return a
 }
 
 // NewFilteredAdapter is the constructor for FilteredAdapter.
 // Casbin will not automatically call LoadPolicy() for a filtered adapter.
-func NewFilteredAdapter(url string, opts ...func(*adapter)) persist.FilteredAdapter {
-	a := NewAdapter(url, opts...).(*adapter)
-	a.filtered = true
-	return a
+func NewFilteredAdapter(url string, opts ...func(*Adapter)) *Adapter {
+	return NewAdapter(url, append(opts, Filtered(true))...)
 }
 
-func (a *adapter) open() {
-	ctx := context.TODO()
-	err := a.client.Connect(ctx)
+func (a *Adapter) open() error {
+	if a.store != nil {
+		return ErrUnsupportedInMemory
+	}
+	if a.client == nil {
+		if a.clientOpts == nil {
+			return ErrNotConnected
+		}
 
-	if err != nil {
-		panic(err)
+		cl, err := mongo.Connect(a.clientOpts...)
+		if err != nil {
+			return err
+		}
+		a.client = cl
 	}
 
-	a.prep()
+	return a.prep()
+}
+
+// ensureOpen opens the adapter if it has not been opened yet, which only
+// happens when LazyConnect is enabled.
+func (a *Adapter) ensureOpen() error {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
 
+	if a.collection != nil {
+		return nil
+	}
+	return a.open()
 }
 
-func (a *adapter) prep() {
-	db := a.client.Database(a.databaseName)
-	collection := db.Collection("casbin_rule")
+func (a *Adapter) prep() error {
+	db := a.database
+	if db == nil {
+		db = a.client.Database(a.cfg.DatabaseName)
+	}
+	collection := a.collectionIn(db, a.cfg.CollectionName)
+
+	ctx := context.TODO()
+	if a.cfg.RequireExistingCollection {
+		names, err := db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: a.cfg.CollectionName}})
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return ErrCollectionNotFound
+		}
+	}
+
+	// The validator is set before any write, which would create the
+	// collection without it. The indexes are created on the first write,
+	// see ensureWriteIndexes.
+	if a.cfg.ValidateDocuments {
+		if err := a.ensureValidator(ctx, collection); err != nil {
+			return err
+		}
+	}
+
 	a.collection = collection
+	return nil
+}
 
-	iview := collection.Indexes()
+// close disconnects the mongodb client.
+func (a *Adapter) close() error {
+	a.connMu.Lock()
+	defer a.connMu.Unlock()
 
-	indexes := []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
-	ctx := context.TODO()
+	if a.client == nil {
+		return nil
+	}
 
-	for _, k := range indexes {
-		iModel := mongo.IndexModel{Keys: bsonx.Doc{{k, bsonx.Int32(1)}}}
-		if _, err := iview.CreateOne(ctx, iModel); err != nil {
-			panic(err)
+	timeout := a.cfg.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return a.client.Disconnect(ctx)
+}
+
+// opContext returns the context of a single operation derived from ctx,
+// bounded by OperationTimeout.
+func (a *Adapter) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if a.cfg.OperationTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, a.cfg.OperationTimeout)
+}
+
+// Close stops AutoReload, flushes any buffered writes and, when the client
+// was created by the adapter, disconnects it. A client passed to
+// NewAdapterFromClient is left connected. Called as a finalizer, unless
+// NoFinalizer is set.
+func (a *Adapter) Close() error {
+	runtime.SetFinalizer(a, nil)
+	a.stopAutoReload()
+
+	err := a.flush(context.TODO())
+	if err == nil {
+		err = a.takeAsyncErr()
+	}
+	if a.ownsClient {
+		if cerr := a.close(); err == nil {
+			err = cerr
 		}
 	}
+	return a.wrapErr("Close", err)
+}
+
+// Ping checks that the MongoDB server backing the adapter is reachable.
+// It honors the deadline of ctx.
+func (a *Adapter) Ping(ctx context.Context) error {
+	return a.wrapErr("Ping", a.ping(ctx))
+}
+
+func (a *Adapter) ping(ctx context.Context) error {
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+
+	return a.client.Ping(ctx, readpref.Primary())
 }
 
-// close disconnects the mongodb client. Called as a finalizer
-func (a *adapter) close() {
-	a.client.Disconnect(context.TODO())
+// Healthy checks that the server is reachable and that the policy
+// collection can be queried.
+func (a *Adapter) Healthy(ctx context.Context) error {
+	if err := a.ping(ctx); err != nil {
+		return a.wrapErr("Healthy", err)
+	}
+
+	_, err := a.collection.CountDocuments(ctx, bson.D{}, options.Count().SetLimit(1))
+	return a.wrapErr("Healthy", err)
 }
 
-func (a *adapter) dropTable() error {
-	err := a.collection.Drop(context.TODO())
+// Collection returns the policy collection, e.g. to run custom queries. With
+// LazyConnect, the adapter connects first, and Collection returns nil if it
+// cannot.
+func (a *Adapter) Collection() *mongo.Collection {
+	if err := a.ensureOpen(); err != nil {
+		return nil
+	}
+	return a.collection
+}
 
-	return err
+// Client returns the client of the adapter, whether it was built by the
+// adapter or passed to NewAdapterFromClient. With LazyConnect, the adapter
+// connects first, and Client returns nil if it cannot.
+func (a *Adapter) Client() *mongo.Client {
+	if err := a.ensureOpen(); err != nil {
+		return nil
+	}
+	return a.client
+}
+
+// ClearPolicies removes all the stored rules, or those of the tenant with
+// Tenant, and discards buffered writes. Unlike SavePolicy, it never drops the
+// collection, so its indexes and options are kept. With SoftDelete, the
+// rules are marked as deleted.
+func (a *Adapter) ClearPolicies(ctx context.Context) error {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if err := a.ensureStorage(); err != nil {
+		return a.wrapErr("ClearPolicies", err)
+	}
+	ctx, done := a.startOp(ctx, "ClearPolicies", nil)
+	defer done()
+
+	a.discardPending()
+	if _, err := a.removeMany(ctx, bson.D{}); err != nil {
+		return a.wrapErr("ClearPolicies", err)
+	}
+	return a.wrapErr("ClearPolicies", a.noteWrite(ctx))
 }
 
-func loadPolicyLine(line CasbinRule, model model.Model) {
-	key := line.PType
-	sec := key[:1]
+func (a *Adapter) dropTable(ctx context.Context) error {
+	defer a.InvalidateCache()
+
+	if a.cfg.SoftDelete || a.cfg.CollectionRouter != nil {
+		_, err := a.removeMany(ctx, bson.D{})
+		return err
+	}
+	if !a.dropsCollection() {
+		return a.retryThrottled(ctx, func(ctx context.Context) error {
+			if a.store != nil {
+				_, err := a.store.deleteMany(ctx, a.tenantFilter(bson.D{}))
+				return err
+			}
+			_, err := a.collection.DeleteMany(ctx, a.tenantFilter(bson.D{}))
+			return err
+		})
+	}
+
+	err := a.retryThrottled(ctx, func(ctx context.Context) error {
+		if a.store != nil {
+			return a.store.drop(ctx)
+		}
+		return a.collection.Drop(ctx)
+	})
+	if err == nil {
+		// The indexes were dropped with the collection.
+		a.resetWriteIndexes()
+	}
+	return err
+}
 
-	tokens := []string{}
-	if line.V0 != "" {
-		tokens = append(tokens, line.V0)
-	} else {
-		goto LineEnd
+// loadPolicyLine adds the rule of line to model. Rules of a ptype that model
+// does not define, e.g. left in storage by a former version of the model,
+// are skipped instead of failing the load.
+func loadPolicyLine(line CasbinRule, model model.Model) error {
+	sec := line.section()
+	if _, ok := model[sec][line.PType]; !ok {
+		return nil
+	}
+	if line.Section == "" {
+		return persist.LoadPolicyArray(append([]string{line.PType}, line.tokens()...), model)
 	}
 
-	if line.V1 != "" {
-		tokens = append(tokens, line.V1)
-	} else {
-		goto LineEnd
+	// LoadPolicyArray infers the section from the ptype.
+	rule := line.tokens()
+	if ok, err := model.HasPolicy(sec, line.PType, rule); err != nil || ok {
+		return err
 	}
+	return model.AddPolicy(sec, line.PType, rule)
+}
 
-	if line.V2 != "" {
-		tokens = append(tokens, line.V2)
-	} else {
-		goto LineEnd
+// section returns the model section of the rule, stored or inferred from
+// its ptype.
+func (line CasbinRule) section() string {
+	if line.Section != "" || line.PType == "" {
+		return line.Section
 	}
+	return line.PType[:1]
+}
 
-	if line.V3 != "" {
-		tokens = append(tokens, line.V3)
-	} else {
-		goto LineEnd
+// sectionField is the field holding the section of a rule, see
+// CasbinRule.Section.
+const sectionField = "sec"
+
+// ruleSection returns the section to store for a rule of the given section
+// and ptype, empty when it can be inferred from the ptype.
+func ruleSection(sec string, ptype string) string {
+	if sec == "" || (ptype != "" && ptype[:1] == sec) {
+		return ""
 	}
+	return sec
+}
 
-	if line.V4 != "" {
-		tokens = append(tokens, line.V4)
-	} else {
-		goto LineEnd
+// checkModel reports a model that rules cannot be loaded into.
+func checkModel(model model.Model) error {
+	if model == nil {
+		return errors.New("cannot load policy into a nil model")
 	}
+	return nil
+}
 
-	if line.V5 != "" {
-		tokens = append(tokens, line.V5)
-	} else {
-		goto LineEnd
+// tokens returns the values of the rule up to the last non-empty one, so
+// that empty leading or interior values are kept.
+func (line CasbinRule) tokens() []string {
+	tokens := []string{line.V0, line.V1, line.V2, line.V3, line.V4, line.V5}
+	for len(tokens) > 0 && tokens[len(tokens)-1] == "" {
+		tokens = tokens[:len(tokens)-1]
 	}
+	return tokens
+}
+
+// LoadPolicy loads policy from database. Rules of a ptype that model does
+// not define are skipped.
+func (a *Adapter) LoadPolicy(model model.Model) error {
+	ctx, done := a.startOp(context.TODO(), "LoadPolicy", nil)
+	defer done()
 
-LineEnd:
-	model[sec][key].Policy = append(model[sec][key].Policy, tokens)
+	return a.wrapErr("LoadPolicy", a.loadPolicyCtx(ctx, model, nil))
 }
 
-// LoadPolicy loads policy from database.
-func (a *adapter) LoadPolicy(model model.Model) error {
-	return a.LoadFilteredPolicy(model, nil)
+// LoadPolicyCtx loads policy from database as LoadPolicy does. The load stops
+// with the error of ctx as soon as ctx is done, leaving model partially
+// loaded.
+func (a *Adapter) LoadPolicyCtx(ctx context.Context, model model.Model) error {
+	ctx, done := a.startOp(ctx, "LoadPolicy", nil)
+	defer done()
+
+	return a.wrapErr("LoadPolicy", a.loadPolicyCtx(ctx, model, nil))
 }
 
 // LoadFilteredPolicy loads matching policy lines from database. If not nil,
-// the filter must be a valid MongoDB selector.
-func (a *adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
-	if filter == nil {
+// the filter must be a valid MongoDB selector, a non-empty []interface{} or
+// bson.A of selectors, which loads the rules matching any of them with a
+// single query, or an aggregation pipeline given as a mongo.Pipeline, which
+// is then run as by LoadFilteredPolicyPipeline. The rules previously loaded
+// into model are cleared first, unless AppendFilteredLoads is set. A selector
+// may only use the fields and operators listed by RawFilters, unless it is
+// set.
+func (a *Adapter) LoadFilteredPolicy(model model.Model, filter interface{}) error {
+	ctx, done := a.startOp(context.TODO(), "LoadFilteredPolicy", filter)
+	defer done()
+
+	return a.wrapErr("LoadFilteredPolicy", a.loadPolicyCtx(ctx, model, filter))
+}
+
+// LoadFilteredPolicyCtx loads matching policy lines from database as
+// LoadFilteredPolicy does. The load stops with the error of ctx as soon as
+// ctx is done, leaving model partially loaded.
+func (a *Adapter) LoadFilteredPolicyCtx(ctx context.Context, model model.Model, filter interface{}) error {
+	ctx, done := a.startOp(ctx, "LoadFilteredPolicy", filter)
+	defer done()
+
+	return a.wrapErr("LoadFilteredPolicy", a.loadPolicyCtx(ctx, model, filter))
+}
+
+func (a *Adapter) loadPolicyCtx(ctx context.Context, model model.Model, filter interface{}) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	switch f := filter.(type) {
+	case mongo.Pipeline:
+		return a.loadPipeline(ctx, model, f)
+	case []bson.D:
+		return a.loadPipeline(ctx, model, f)
+	case []interface{}:
+		or, err := orFilter(f)
+		if err != nil {
+			return err
+		}
+		filter = or
+	case bson.A:
+		or, err := orFilter(f)
+		if err != nil {
+			return err
+		}
+		filter = or
+	}
+	if filter != nil {
+		if err := a.checkFilter(filter); err != nil {
+			return err
+		}
+	}
+	return a.loadFilteredPolicy(ctx, model, filter)
+}
+
+func (a *Adapter) loadFilteredPolicy(ctx context.Context, model model.Model, filter interface{}) error {
+	if err := checkModel(model); err != nil {
+		return err
+	}
+	if filter != nil {
+		a.clearForFilteredLoad(model)
+	}
+	a.setFiltered(filter != nil)
+	return a.loadRules(ctx, model, filter)
+}
+
+// clearForFilteredLoad clears the rules of model before a filtered load,
+// unless AppendFilteredLoads is set.
+func (a *Adapter) clearForFilteredLoad(model model.Model) {
+	if !a.cfg.AppendFilteredLoads {
+		clearPolicy(model)
+	}
+}
+
+// loadRules loads the rules matching filter into model, without changing
+// what IsFiltered reports.
+func (a *Adapter) loadRules(ctx context.Context, model model.Model, filter interface{}) error {
+	a.notePriorityTokens(model)
+
+	full := filter == nil
+	if full {
 		filter = bson.D{}
-		a.filtered = false
-	} else {
-		a.filtered = true
 	}
 
-	ctx := context.TODO()
+	if err := a.ensureStorage(); err != nil {
+		return err
+	}
 
-	cur, err := a.collection.Find(ctx, filter)
+	// Make sure buffered writes are visible to the load.
+	if err := a.flush(ctx); err != nil {
+		return err
+	}
+
+	if full {
+		if lines, ok := a.cachedPolicy(); ok {
+			for _, line := range lines {
+				if err := loadPolicyLine(line, model); err != nil {
+					return err
+				}
+			}
+			countDocs(ctx, int64(len(lines)))
+			return nil
+		}
+	}
+	gen := a.cacheGeneration()
+
+	if err := a.noteLoad(ctx); err != nil {
+		return err
+	}
+
+	hint := a.queryHint(filter)
+	filter = a.liveFilter(filter)
+	findOpts := options.Find().SetProjection(a.loadProjection()).SetSort(a.loadSort())
+	if collation := a.collation(); collation != nil {
+		findOpts.SetCollation(collation)
+	}
+	if hint != nil {
+		findOpts.SetHint(hint)
+	}
+
+	collections, err := a.readCollections(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	cache := full && a.cfg.CacheTTL > 0
+	var lines []CasbinRule
+	load := func(line CasbinRule) error {
+		if cache {
+			lines = append(lines, line)
+		}
+		return loadPolicyLine(line, model)
 	}
 
+	for _, collection := range collections {
+		var cur *mongo.Cursor
+		err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+			if a.store != nil {
+				cur, err = a.store.find(ctx, filter, a.loadSort())
+				return err
+			}
+			cur, err = collection.Find(ctx, filter, findOpts)
+			return err
+		})
+		if err != nil {
+			return hintErr(hint, err)
+		}
+		if err := a.loadCursor(ctx, cur, load); err != nil {
+			return err
+		}
+	}
+
+	if cache {
+		a.cachePolicy(gen, lines)
+	}
+	return nil
+}
+
+// LoadFilteredPolicyPipeline loads the policy lines output by an aggregation
+// pipeline run on the policy collection, for filters a Find selector cannot
+// express. The output documents must have the fields of a CasbinRule. As with
+// LoadFilteredPolicy, the rules previously loaded into model are cleared
+// first, unless AppendFilteredLoads is set.
+func (a *Adapter) LoadFilteredPolicyPipeline(model model.Model, pipeline mongo.Pipeline) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(context.TODO(), "LoadFilteredPolicyPipeline", nil)
+	defer done()
+
+	return a.wrapErr("LoadFilteredPolicyPipeline", a.loadPipeline(ctx, model, pipeline))
+}
+
+func (a *Adapter) loadPipeline(ctx context.Context, model model.Model, pipeline mongo.Pipeline) error {
+	if err := checkModel(model); err != nil {
+		return err
+	}
+	a.notePriorityTokens(model)
+	a.clearForFilteredLoad(model)
+	a.setFiltered(true)
+
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+
+	if err := a.flush(ctx); err != nil {
+		return err
+	}
+
+	aggOpts := options.Aggregate()
+	if collation := a.collation(); collation != nil {
+		aggOpts.SetCollation(collation)
+	}
+	stages := a.livePipeline(append(mongo.Pipeline{}, pipeline...))
+	stages = append(stages, bson.D{{Key: "$project", Value: a.loadProjection()}})
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Aggregate(ctx, stages, aggOpts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return a.loadCursor(ctx, cur, func(line CasbinRule) error {
+		return loadPolicyLine(line, model)
+	})
+}
+
+// loadCursor passes the policy lines read from cur, normalized with
+// NormalizeValues, to load and closes cur. Documents that cannot be decoded
+// are skipped and reported once the others are loaded, or stop the load with
+// StrictDecode. The load stops as soon as ctx is done, even within a batch
+// already fetched.
+func (a *Adapter) loadCursor(ctx context.Context, cur *mongo.Cursor, load func(CasbinRule) error) error {
+	// The cursor is closed even if ctx is done, so that the server does not
+	// keep it open until it times out.
+	defer cur.Close(context.Background())
+
+	var loaded int64
+	defer func() { countDocs(ctx, loaded) }()
+
+	var decodeErr error
+	failed := 0
 	for cur.Next(ctx) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		var line = CasbinRule{}
-		if err := cur.Decode(&line); err == nil {
-			loadPolicyLine(line, model)
+		if err := cur.Decode(&line); err != nil {
+			if a.cfg.StrictDecode {
+				return fmt.Errorf("decoding policy document: %w", err)
+			}
+			if decodeErr == nil {
+				decodeErr = err
+			}
+			failed++
+			continue
+		}
+		if err := load(a.normalizeLine(line)); err != nil {
+			return err
 		}
+		loaded++
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	if decodeErr != nil {
+		return fmt.Errorf("decoding %d policy documents, first error: %w", failed, decodeErr)
+	}
+	return nil
+}
+
+// loadProjection returns the projection used when loading policy lines.
+func (a *Adapter) loadProjection() bson.D {
+	projection := bson.D{{Key: "_id", Value: 0}}
+	if len(a.cfg.Projection) == 0 {
+		return projection
+	}
+
+	projection = append(projection, bson.E{Key: "ptype", Value: 1}, bson.E{Key: sectionField, Value: 1})
+	for _, field := range a.cfg.Projection {
+		if field != "ptype" && field != sectionField {
+			projection = append(projection, bson.E{Key: field, Value: 1})
+		}
+	}
+	return projection
+}
 
+// loadSort returns the order in which policy lines are loaded.
+func (a *Adapter) loadSort() interface{} {
+	if a.cfg.LoadSort == nil {
+		if sort := a.prioritySort(); sort != nil {
+			return sort
+		}
+		return bson.D{{Key: "_id", Value: 1}}
+	}
+	sort, ok := a.cfg.LoadSort.(bson.D)
+	if !ok {
+		return a.cfg.LoadSort
+	}
+	for _, e := range sort {
+		if e.Key == "_id" {
+			return sort
+		}
 	}
+	return append(sort[:len(sort):len(sort)], bson.E{Key: "_id", Value: 1})
+}
 
-	return cur.Close(ctx)
+// collation returns the collation used for matching rules, or nil for the
+// server default.
+func (a *Adapter) collation() *options.Collation {
+	if a.cfg.DocumentDBCompat {
+		return nil
+	}
+	if a.cfg.IndexCollation != nil {
+		return a.cfg.IndexCollation
+	}
+	if !a.cfg.CaseInsensitive {
+		return nil
+	}
+	return &options.Collation{Locale: "en", Strength: 2}
 }
 
 // IsFiltered returns true if the loaded policy has been filtered.
-func (a *adapter) IsFiltered() bool {
+//
+// An adapter constructed as filtered, with NewFilteredAdapter or the Filtered
+// option, starts out filtered so that casbin does not load the whole policy
+// when creating an enforcer. Otherwise it starts out unfiltered. Then:
+//   - LoadFilteredPolicy with a non-nil filter makes it filtered,
+//   - LoadPolicy, or LoadFilteredPolicy with a nil filter, makes it
+//     unfiltered.
+//
+// SavePolicy fails with ErrFilteredSave while the adapter is filtered, and
+// always fails if the adapter was constructed as filtered, even after a full
+// load, since a filtered adapter is meant to hold partial views of the policy.
+func (a *Adapter) IsFiltered() bool {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
 	return a.filtered
 }
 
+func (a *Adapter) setFiltered(filtered bool) {
+	a.stateMu.Lock()
+	a.filtered = filtered
+	a.stateMu.Unlock()
+}
+
 func savePolicyLine(ptype string, rule []string) CasbinRule {
 	line := CasbinRule{
 		PType: ptype,
@@ -285,56 +1075,462 @@ func savePolicyLine(ptype string, rule []string) CasbinRule {
 	return line
 }
 
+// ruleSelector returns the selector matching the stored rule of the given
+// ptype, whether its empty values, trailing ones included, are stored as
+// empty strings, as null or not at all. With ArraySchema, it matches the
+// whole array of values instead.
+func (a *Adapter) ruleSelector(ptype string, rule []string) bson.D {
+	if a.cfg.ArraySchema {
+		return arraySelector(ptype, rule)
+	}
+
+	selector := bson.D{{Key: "ptype", Value: ptype}}
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("v%d", i)
+		if i < len(rule) && rule[i] != "" {
+			selector = append(selector, bson.E{Key: key, Value: rule[i]})
+		} else {
+			selector = append(selector, bson.E{Key: key, Value: bson.D{{Key: "$in", Value: bson.A{"", nil}}}})
+		}
+	}
+	return selector
+}
+
 // SavePolicy saves policy to database.
-func (a *adapter) SavePolicy(model model.Model) error {
-	if a.filtered {
-		return errors.New("cannot save a filtered policy")
+func (a *Adapter) SavePolicy(model model.Model) error {
+	ctx, done := a.startOp(context.TODO(), "SavePolicy", nil)
+	defer done()
+
+	return a.wrapErr("SavePolicy", a.savePolicy(ctx, model))
+}
+
+// SavePolicyCtx saves policy to database as SavePolicy does, with all its
+// requests bound to ctx. A save cancelled before the stored rules are
+// removed leaves them untouched. Once they are removed, the new rules are
+// inserted even if ctx is cancelled, so that a cancelled save cannot leave
+// the policy empty; with SaveInTransaction, a cancelled save is rolled back
+// instead.
+func (a *Adapter) SavePolicyCtx(ctx context.Context, model model.Model) error {
+	ctx, done := a.startOp(ctx, "SavePolicy", nil)
+	defer done()
+
+	return a.wrapErr("SavePolicy", a.savePolicy(ctx, model))
+}
+
+func (a *Adapter) savePolicy(ctx context.Context, model model.Model) error {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if a.IsFiltered() || a.cfg.IsFiltered {
+		return ErrFilteredSave
 	}
-	if err := a.dropTable(); err != nil {
+	if err := a.ensureStorage(); err != nil {
 		return err
 	}
 
+	// Collect the rules before anything is deleted.
+	lines := a.modelLines(model)
+	if len(lines) == 0 && a.cfg.RefuseEmptySave {
+		return ErrEmptySave
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := a.claimRevision(ctx); err != nil {
+		return err
+	}
+	return a.replaceAll(ctx, lines)
+}
+
+// SavePolicyDryRun returns the rules SavePolicy would insert and the number
+// of stored rules it would delete, without writing anything. Buffered writes,
+// which SavePolicy discards, are neither sent nor counted.
+func (a *Adapter) SavePolicyDryRun(ctx context.Context, model model.Model) ([]CasbinRule, int64, error) {
+	if a.IsFiltered() || a.cfg.IsFiltered {
+		return nil, 0, a.wrapErr("SavePolicyDryRun", ErrFilteredSave)
+	}
+	if err := a.ensureOpen(); err != nil {
+		return nil, 0, a.wrapErr("SavePolicyDryRun", err)
+	}
+
+	var n int64
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		n, err = a.collection.CountDocuments(ctx, a.liveFilter(bson.D{}))
+		return err
+	})
+	if err != nil {
+		return nil, 0, a.wrapErr("SavePolicyDryRun", err)
+	}
+
+	lines := a.modelLines(model)
+	rules := make([]CasbinRule, 0, len(lines))
+	for _, line := range lines {
+		rules = append(rules, *line.(*CasbinRule))
+	}
+	return rules, n, nil
+}
+
+// modelLines returns the documents storing the rules of model, p rules
+// first, then g rules and those of other sections.
+func (a *Adapter) modelLines(model model.Model) []interface{} {
+	a.notePriorityTokens(model)
+
 	var lines []interface{}
 
-	for ptype, ast := range model["p"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
+	for _, sec := range policySections(model) {
+		for ptype, ast := range model[sec] {
+			for _, rule := range ast.Policy {
+				line := a.policyLine(sec, ptype, rule)
+				lines = append(lines, &line)
+			}
 		}
 	}
 
-	for ptype, ast := range model["g"] {
-		for _, rule := range ast.Policy {
-			line := savePolicyLine(ptype, rule)
-			lines = append(lines, &line)
+	return lines
+}
+
+// policySections returns the sections of model holding rules: p, g, then the
+// others sorted, leaving out the request, effect and matcher definitions.
+func policySections(model model.Model) []string {
+	sections := []string{"p", "g"}
+	var others []string
+	for sec := range model {
+		switch sec {
+		case "p", "g", "r", "e", "m":
+		default:
+			others = append(others, sec)
 		}
 	}
+	sort.Strings(others)
+	return append(sections, others...)
+}
 
-	ctx := context.TODO()
-	_, err := a.collection.InsertMany(ctx, lines)
-	return err
+// clearPolicy clears the rules of all the policy sections of m, whereas
+// m.ClearPolicy clears those of p and g only.
+func clearPolicy(m model.Model) {
+	m.ClearPolicy()
+	for _, sec := range policySections(m) {
+		for _, ast := range m[sec] {
+			ast.Policy = nil
+			ast.PolicyMap = map[string]int{}
+		}
+	}
+}
+
+// replaceAll replaces the stored rules with lines.
+func (a *Adapter) replaceAll(ctx context.Context, lines []interface{}) error {
+	// The new rules supersede any writes still waiting in the buffer.
+	a.discardPending()
+
+	switch {
+	case a.cfg.SaveMode == SaveViaStaging && !a.stagingDenied:
+		return a.replaceViaStaging(ctx, lines)
+	case a.cfg.SaveMode == SaveInTransaction:
+		// Collections cannot be dropped in a transaction, so the rules are
+		// deleted instead.
+		return a.inTransaction(ctx, func(ctx context.Context) error {
+			if _, err := a.removeMany(ctx, bson.D{}); err != nil {
+				return err
+			}
+			return a.insertMany(ctx, lines)
+		})
+	case a.cfg.SaveMode == SaveDiff:
+		return a.replaceByDiff(ctx, lines)
+	}
+	return a.dropInsert(ctx, lines)
+}
+
+// dropInsert drops the stored rules and inserts lines. The insert is not
+// cancelled along with ctx, so that the policy is not left empty.
+func (a *Adapter) dropInsert(ctx context.Context, lines []interface{}) error {
+	if err := a.dropTable(ctx); err != nil {
+		return err
+	}
+	return a.insertMany(context.WithoutCancel(ctx), lines)
+}
+
+// writeBatchSize returns the maximum number of documents per write request.
+func (a *Adapter) writeBatchSize() int {
+	size := a.cfg.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	if a.cfg.CosmosDBCompat && size > cosmosBatchSize {
+		size = cosmosBatchSize
+	}
+	return size
+}
+
+// insertMany inserts docs into the collection in batches. A failed batch does
+// not stop the following ones from being inserted; the first error is
+// returned. Documents refused by the server, e.g. by a unique index, do not
+// stop the others of their batch from being inserted either, and are
+// reported by a *BatchError if no batch failed.
+func (a *Adapter) insertMany(ctx context.Context, docs []interface{}) error {
+	defer a.InvalidateCache()
+
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return err
+	}
+	if a.cfg.CollectionRouter != nil {
+		return a.insertRouted(ctx, docs)
+	}
+	return a.insertInto(ctx, a.collection, docs)
+}
+
+// insertInto inserts docs into collection as insertMany does.
+func (a *Adapter) insertInto(ctx context.Context, collection *mongo.Collection, docs []interface{}) error {
+	docs = a.documents(docs)
+	size := a.writeBatchSize()
+
+	var firstErr error
+	var refused BatchError
+	for start := 0; start < len(docs); start += size {
+		end := start + size
+		if end > len(docs) {
+			end = len(docs)
+		}
+
+		errs, err := a.insertBatch(ctx, collection, docs[start:end])
+		for _, we := range errs {
+			refused.add(start+we.Index, we)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return refused.err()
 }
 
 // AddPolicy adds a policy rule to the storage.
-func (a *adapter) AddPolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
+func (a *Adapter) AddPolicy(sec string, ptype string, rule []string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
 
-	ctx := context.TODO()
-	_, err := a.collection.InsertOne(ctx, line)
-	return err
+	line := a.policyLine(sec, ptype, rule)
+
+	if a.buffered() {
+		return a.wrapErr("AddPolicy", a.bufferWrite(mongo.NewInsertOneModel().SetDocument(a.document(line))))
+	}
+
+	ctx, done := a.startOp(context.TODO(), "AddPolicy", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	_, err := a.addPolicy(ctx, line)
+	return a.wrapErr("AddPolicy", err)
 }
 
-// RemovePolicy removes a policy rule from the storage.
-func (a *adapter) RemovePolicy(sec string, ptype string, rule []string) error {
-	line := savePolicyLine(ptype, rule)
+// AddPolicyEx adds a policy rule to the storage and returns the _id of the
+// inserted document, e.g. to reference the rule in an audit log. Buffered
+// writes are flushed first, and the rule is inserted immediately.
+func (a *Adapter) AddPolicyEx(sec string, ptype string, rule []string) (interface{}, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
 
-	ctx := context.TODO()
-	_, err := a.collection.DeleteOne(ctx, line)
-	return err
+	ctx, done := a.startOp(context.TODO(), "AddPolicyEx", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return nil, a.wrapErr("AddPolicyEx", err)
+	}
+
+	id, err := a.addPolicy(ctx, a.policyLine(sec, ptype, rule))
+	return id, a.wrapErr("AddPolicyEx", err)
+}
+
+// addPolicy inserts line and returns its _id.
+func (a *Adapter) addPolicy(ctx context.Context, line CasbinRule) (interface{}, error) {
+	return a.addDocument(ctx, line, a.document(line))
+}
+
+// addDocument inserts doc, storing the rule of line, and returns its _id.
+func (a *Adapter) addDocument(ctx context.Context, line CasbinRule, doc interface{}) (interface{}, error) {
+	defer a.InvalidateCache()
+
+	if err := a.ensureStorage(); err != nil {
+		return nil, err
+	}
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return nil, err
+	}
+
+	var id interface{}
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		if a.store != nil {
+			id, err = a.store.insertOne(ctx, doc)
+			return err
+		}
+		res, err := a.routedCollection(line).InsertOne(ctx, doc)
+		if err != nil {
+			return err
+		}
+		id = res.InsertedID
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	countDocs(ctx, 1)
+	return id, a.noteWrite(ctx)
+}
+
+// RemovePolicy removes a policy rule from the storage. Empty values of the
+// rule, trailing ones included, match values stored empty as well as values
+// left out of the document, e.g. by other tools.
+func (a *Adapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	line := a.ruleSelector(ptype, a.normalizeRule(rule))
+
+	if a.buffered() {
+		return a.wrapErr("RemovePolicy", a.bufferWrite(a.removeOneModel(line)))
+	}
+
+	if err := a.ensureStorage(); err != nil {
+		return a.wrapErr("RemovePolicy", err)
+	}
+
+	ctx, done := a.startOp(context.TODO(), "RemovePolicy", line)
+	defer done()
+
+	n, err := a.removeOneIn(ctx, a.routedCollection(a.policyLine(sec, ptype, rule)), line)
+	if err == nil && a.cfg.StrictRemove && n == 0 {
+		err = ErrPolicyNotFound
+	}
+	if err != nil {
+		return a.wrapErr("RemovePolicy", err)
+	}
+	return a.wrapErr("RemovePolicy", a.noteWrite(ctx))
 }
 
 // RemoveFilteredPolicy removes policy rules that match the filter from the storage.
-func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+func (a *Adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	if a.buffered() {
+		selector := a.fieldSelector(ptype, fieldIndex, fieldValues...)
+		return a.wrapErr("RemoveFilteredPolicy", a.bufferWrite(a.removeManyModel(selector)))
+	}
+
+	ctx, done := a.startOp(context.TODO(), "RemoveFilteredPolicy", a.fieldSelector(ptype, fieldIndex, fieldValues...))
+	defer done()
+
+	_, err := a.removeFilteredPolicy(ctx, ptype, fieldIndex, fieldValues...)
+	return a.wrapErr("RemoveFilteredPolicy", err)
+}
+
+// RemoveFilteredPolicyCount removes policy rules that match the filter from
+// the storage and returns the number of rules removed. Buffered writes are
+// flushed first so that the count is accurate.
+func (a *Adapter) RemoveFilteredPolicyCount(sec string, ptype string, fieldIndex int, fieldValues ...string) (int64, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(context.TODO(), "RemoveFilteredPolicyCount", a.fieldSelector(ptype, fieldIndex, fieldValues...))
+	defer done()
+
+	n, err := a.removeFilteredPolicy(ctx, ptype, fieldIndex, fieldValues...)
+	return n, a.wrapErr("RemoveFilteredPolicyCount", err)
+}
+
+func (a *Adapter) removeFilteredPolicy(ctx context.Context, ptype string, fieldIndex int, fieldValues ...string) (int64, error) {
+	if err := a.ensureStorage(); err != nil {
+		return 0, err
+	}
+
+	if err := a.flush(ctx); err != nil {
+		return 0, err
+	}
+
+	n, err := a.removeMany(ctx, a.fieldSelector(ptype, fieldIndex, fieldValues...))
+	if err != nil {
+		return 0, err
+	}
+	return n, a.noteWrite(ctx)
+}
+
+// RemoveFilteredPolicyAllTypes removes the rules of any ptype whose fields,
+// starting at fieldIndex, equal fieldValues, in a single request. At least one
+// value must be non-empty, so that it cannot remove all the rules.
+func (a *Adapter) RemoveFilteredPolicyAllTypes(fieldIndex int, fieldValues ...string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	selector := a.fieldSelector("", fieldIndex, fieldValues...)
+	delete(selector, "ptype")
+	if len(selector) == 0 {
+		return a.wrapErr("RemoveFilteredPolicyAllTypes", errors.New("no field value to match"))
+	}
+
+	if a.buffered() {
+		return a.wrapErr("RemoveFilteredPolicyAllTypes", a.bufferWrite(a.removeManyModel(selector)))
+	}
+
+	if err := a.ensureStorage(); err != nil {
+		return a.wrapErr("RemoveFilteredPolicyAllTypes", err)
+	}
+	ctx, done := a.startOp(context.TODO(), "RemoveFilteredPolicyAllTypes", selector)
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return a.wrapErr("RemoveFilteredPolicyAllTypes", err)
+	}
+	if _, err := a.removeMany(ctx, selector); err != nil {
+		return a.wrapErr("RemoveFilteredPolicyAllTypes", err)
+	}
+	return a.wrapErr("RemoveFilteredPolicyAllTypes", a.noteWrite(ctx))
+}
+
+// FieldFilter selects the rules whose fields, starting at FieldIndex, equal
+// FieldValues, as the arguments of RemoveFilteredPolicy do.
+type FieldFilter struct {
+	FieldIndex  int
+	FieldValues []string
+}
+
+// RemoveFilteredPolicies removes the rules of the given ptype matching any of
+// filters in a single request, and returns the number of rules removed. A
+// rule matching several filters is removed once. No rule is removed when
+// filters is empty.
+func (a *Adapter) RemoveFilteredPolicies(ctx context.Context, ptype string, filters []FieldFilter) (int64, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	if len(filters) == 0 {
+		return 0, nil
+	}
+	selectors := make(bson.A, 0, len(filters))
+	for _, f := range filters {
+		selectors = append(selectors, a.fieldSelector(ptype, f.FieldIndex, f.FieldValues...))
+	}
+
+	if err := a.ensureStorage(); err != nil {
+		return 0, a.wrapErr("RemoveFilteredPolicies", err)
+	}
+	ctx, done := a.startOp(ctx, "RemoveFilteredPolicies", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return 0, a.wrapErr("RemoveFilteredPolicies", err)
+	}
+
+	n, err := a.removeMany(ctx, bson.D{{Key: "$or", Value: selectors}})
+	if err != nil {
+		return n, a.wrapErr("RemoveFilteredPolicies", err)
+	}
+	return n, a.wrapErr("RemoveFilteredPolicies", a.noteWrite(ctx))
+}
+
+// filteredSelector builds the selector matching the rules of the given ptype
+// whose fields, starting at fieldIndex, equal fieldValues. Empty values match
+// any value.
+func filteredSelector(ptype string, fieldIndex int, fieldValues ...string) map[string]interface{} {
 	selector := make(map[string]interface{})
 	selector["ptype"] = ptype
 
@@ -369,7 +1565,5 @@ func (a *adapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int,
 		}
 	}
 
-	ctx := context.TODO()
-	_, err := a.collection.DeleteMany(ctx, selector)
-	return err
+	return selector
 }
@@ -16,15 +16,22 @@ package mongodbadapter
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
-	"github.com/casbin/casbin"
-	"github.com/casbin/casbin/persist"
-	"github.com/casbin/casbin/util"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
+	"github.com/casbin/casbin/v2"
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/util"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 var testDbURL = os.Getenv("TEST_MONGODB_URL")
@@ -45,22 +52,44 @@ func getDbName() string {
 	return testDbName
 }
 
-func newTestAdapter() persist.Adapter {
+// requireMongoDB skips t unless TEST_MONGODB_URL is set, as it needs a
+// MongoDB server. The other tests run against NewMemoryAdapter or no storage
+// at all.
+func requireMongoDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("TEST_MONGODB_URL") == "" {
+		t.Skip("TEST_MONGODB_URL is not set")
+	}
+}
+
+func newTestAdapter() *Adapter {
 	return NewAdapter(getDbURL(), DBName(getDbName()))
 }
 
-func newTestFilteredAdapter() persist.Adapter {
+func newTestFilteredAdapter() *Adapter {
 	return NewFilteredAdapter(getDbURL(), DBName(getDbName()))
 }
 
-func newTestAdapterFromClient() persist.Adapter {
-	testClient, _ = mongo.Connect(context.Background(), options.Client().ApplyURI(getDbURL()))
+func newTestAdapterFromClient() *Adapter {
+	testClient, _ = mongo.Connect(options.Client().ApplyURI(getDbURL()))
 	return NewAdapterFromClient(testClient, DBName(getDbName()))
 }
 
+func newTestEnforcer(t *testing.T, params ...interface{}) *casbin.Enforcer {
+	t.Helper()
+	e, err := casbin.NewEnforcer(params...)
+	if err != nil {
+		t.Fatalf("Expected NewEnforcer() to be successful; got %v", err)
+	}
+	return e
+}
+
 func testGetPolicy(t *testing.T, e *casbin.Enforcer, res [][]string) {
 	t.Helper()
-	myRes := e.GetPolicy()
+	myRes, err := e.GetPolicy()
+	if err != nil {
+		t.Errorf("Expected GetPolicy() to be successful; got %v", err)
+	}
 	t.Log("Policy: ", myRes)
 
 	if !util.Array2DEquals(res, myRes) {
@@ -71,7 +100,7 @@ func testGetPolicy(t *testing.T, e *casbin.Enforcer, res [][]string) {
 func initPolicy(t *testing.T) {
 	// Because the DB is empty at first,
 	// so we need to load the policy from the file adapter (.CSV) first.
-	e := casbin.NewEnforcer("examples/rbac_model.conf", "examples/rbac_policy.csv")
+	e := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
 
 	a := newTestAdapter()
 	// This is a trick to save the current policy to the DB.
@@ -96,6 +125,7 @@ func initPolicy(t *testing.T) {
 }
 
 func TestAdapter(t *testing.T) {
+	requireMongoDB(t)
 	initPolicy(t)
 
 	// Note: you don't need to look at the above code
@@ -107,7 +137,7 @@ func TestAdapter(t *testing.T) {
 	a := newTestAdapterFromClient()
 	defer testClient.Disconnect(context.Background())
 
-	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
 	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
 	// AutoSave is enabled by default.
 	// Now we disable it.
@@ -167,8 +197,9 @@ func TestAdapter(t *testing.T) {
 	testGetPolicy(t, e, [][]string{})
 }
 func TestDeleteFilteredAdapter(t *testing.T) {
+	requireMongoDB(t)
 	a := newTestFilteredAdapter()
-	e := casbin.NewEnforcer("examples/rbac_tenant_service.conf", a)
+	e := newTestEnforcer(t, "examples/rbac_tenant_service.conf", a)
 
 	e.AddPolicy("domain1", "alice", "data3", "read", "accept", "service1")
 	e.AddPolicy("domain1", "alice", "data3", "write", "accept", "service2")
@@ -195,11 +226,12 @@ func TestDeleteFilteredAdapter(t *testing.T) {
 }
 
 func TestFilteredAdapter(t *testing.T) {
+	requireMongoDB(t)
 	// Now the DB has policy, so we can provide a normal use case.
 	// Create an adapter and an enforcer.
 	// NewEnforcer() will load the policy automatically.
 	a := newTestAdapter()
-	e := casbin.NewEnforcer("examples/rbac_model.conf", a)
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
 
 	// Load filtered policies from the database.
 	e.AddPolicy("alice", "data1", "write")
@@ -257,3 +289,2104 @@ func TestNewAdapterWithUnknownURL(t *testing.T) {
 
 	_ = NewAdapter("fakeserver:27017")
 }
+
+func TestPing(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := a.Ping(ctx); err != nil {
+		t.Errorf("Expected Ping() to be successful; got %v", err)
+	}
+	if err := a.Healthy(ctx); err != nil {
+		t.Errorf("Expected Healthy() to be successful; got %v", err)
+	}
+
+	if err := (&Adapter{}).Ping(ctx); err == nil {
+		t.Error("Expected Ping() to fail without a client")
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapterFromClient()
+	defer testClient.Disconnect(context.Background())
+
+	if a.Client() != testClient {
+		t.Error("Expected Client() to return the client passed to NewAdapterFromClient")
+	}
+	if c := a.Collection(); c == nil || c.Name() != "casbin_rule" || c.Database().Name() != getDbName() {
+		t.Errorf("Collection: %v, supposed to be %s.casbin_rule", c, getDbName())
+	}
+
+	if (&Adapter{}).Collection() != nil || (&Adapter{}).Client() != nil {
+		t.Error("Expected the accessors to return nil without a client")
+	}
+}
+
+func TestLoadProjection(t *testing.T) {
+	a := &Adapter{}
+	if p := a.loadProjection(); len(p) != 1 || p[0].Key != "_id" {
+		t.Errorf("Expected default projection to only exclude _id; got %v", p)
+	}
+
+	Projection("v0", "v1")(a)
+	p := a.loadProjection()
+	keys := []string{}
+	for _, e := range p {
+		keys = append(keys, e.Key)
+	}
+	if !util.ArrayEquals(keys, []string{"_id", "ptype", "sec", "v0", "v1"}) {
+		t.Errorf("Projection: %v, supposed to be [_id ptype sec v0 v1]", keys)
+	}
+}
+
+func TestBufferWrites(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), BufferWrites(3))
+	defer a.Close()
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", newTestAdapter())
+
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	// Nothing has been written yet.
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	if err := a.Flush(context.Background()); err != nil {
+		t.Errorf("Expected Flush() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	// A full buffer is flushed automatically.
+	a.AddPolicy("p", "p", []string{"dave", "data4", "read"})
+	a.AddPolicy("p", "p", []string{"dave", "data4", "write"})
+	a.RemoveFilteredPolicy("p", "p", 0, "carol")
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"dave", "data4", "read"}, {"dave", "data4", "write"}})
+}
+
+func TestUnsentWrites(t *testing.T) {
+	pending := make([]mongo.WriteModel, 5)
+	for i := range pending {
+		pending[i] = mongo.NewDeleteOneModel().SetFilter(bson.D{{Key: "v0", Value: i}})
+	}
+
+	refused := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 0, Code: duplicateKey}}}}
+	tests := []struct {
+		start, end int
+		err        error
+		want       int
+	}{
+		// The bulk write of writes 2 and 3 failed as a whole.
+		{2, 4, errors.New("connection reset"), 1},
+		// Write 2 was refused, so write 3 was not sent.
+		{2, 4, refused, 2},
+		{4, 5, errors.New("connection reset"), 0},
+	}
+	for _, tt := range tests {
+		got := unsent(pending, tt.start, tt.end, tt.err)
+		if len(got) != tt.want || (tt.want > 0 && got[len(got)-1] != pending[4]) {
+			t.Errorf("unsent(%d, %d, %v) kept %d writes, supposed to keep the last %d", tt.start, tt.end, tt.err, len(got), tt.want)
+		}
+	}
+}
+
+func TestCoalesceWrites(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	flushErrs := make(chan error, 1)
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CoalesceWrites(100, 50*time.Millisecond), FlushErrorHandler(func(err error) {
+		flushErrs <- err
+	}))
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", newTestAdapter())
+
+	// Adding then removing a rule leaves it removed.
+	a.AddPolicy("p", "p", []string{"carol", "data3", "read"})
+	a.AddPolicy("p", "p", []string{"dave", "data4", "read"})
+	a.RemovePolicy("p", "p", []string{"carol", "data3", "read"})
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	// The queued writes are sent once the delay has elapsed.
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case err := <-flushErrs:
+		t.Errorf("Expected the background flush to be successful; got %v", err)
+	default:
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"dave", "data4", "read"}})
+
+	// Writes still queued are sent by Close.
+	a.AddPolicy("p", "p", []string{"erin", "data5", "read"})
+	if err := a.Close(); err != nil {
+		t.Errorf("Expected Close() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"dave", "data4", "read"}, {"erin", "data5", "read"}})
+}
+
+func TestLazyConnect(t *testing.T) {
+	a := NewAdapter("mongodb://fakeserver:27017/?serverSelectionTimeoutMS=500", LazyConnect(true))
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err == nil {
+		t.Error("Expected AddPolicy() to fail against an unknown server")
+	}
+	// The failed connection is retried rather than remembered.
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err == nil {
+		t.Error("Expected AddPolicy() to fail against an unknown server")
+	}
+
+	requireMongoDB(t)
+	a = NewAdapter(getDbURL(), DBName(getDbName()), LazyConnect(true))
+	defer a.Close()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+}
+
+func TestNewAdapterWithClientOptions(t *testing.T) {
+	requireMongoDB(t)
+	opts := options.Client().ApplyURI(getDbURL()).SetAppName("casbin-mongodb-adapter-test")
+	a, err := NewAdapterWithClientOptions(opts, DBName(getDbName()))
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithClientOptions() to be successful; got %v", err)
+	}
+	defer a.Close()
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+
+	if _, err := NewAdapterWithClientOptions(nil); err == nil {
+		t.Error("Expected NewAdapterWithClientOptions() to fail without client options")
+	}
+}
+
+func TestNoFinalizer(t *testing.T) {
+	a := NewAdapter(getDbURL(), DBName(getDbName()), LazyConnect(true), NoFinalizer(true))
+	// Setting a finalizer on an object that already has one crashes the
+	// program, so this only succeeds if the adapter has none.
+	runtime.SetFinalizer(a, func(*Adapter) {})
+	runtime.SetFinalizer(a, nil)
+	if err := a.Close(); err != nil {
+		t.Errorf("Expected Close() to be successful; got %v", err)
+	}
+}
+
+func TestRemoveFilteredPolicyCount(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	n, err := a.RemoveFilteredPolicyCount("p", "p", 0, "data2_admin")
+	if err != nil {
+		t.Errorf("Expected RemoveFilteredPolicyCount() to be successful; got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Removed %d rules, supposed to be 2", n)
+	}
+
+	n, err = a.RemoveFilteredPolicyCount("p", "p", 0, "nobody")
+	if err != nil {
+		t.Errorf("Expected RemoveFilteredPolicyCount() to be successful; got %v", err)
+	}
+	if n != 0 {
+		t.Errorf("Removed %d rules, supposed to be 0", n)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CaseInsensitive(true))
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+
+	if err := e.LoadFilteredPolicy(&bson.M{"v0": "ALICE"}); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "Data2_Admin"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+}
+
+func TestIndexCollation(t *testing.T) {
+	requireMongoDB(t)
+	collation := &options.Collation{Locale: "en", Strength: 2}
+	a := NewAdapter(getDbURL(), DBName(getDbName()), IndexCollation(collation))
+	defer a.Close()
+	ctx := context.Background()
+
+	// The indexes are created by the first write.
+	csv := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(csv.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	defer func() {
+		// Leave the default indexes only for the other tests.
+		if err := a.DropIndexes(ctx); err != nil {
+			t.Errorf("Expected DropIndexes() to be successful; got %v", err)
+		}
+		if _, err := newTestAdapter().EnsureIndexes(ctx); err != nil {
+			t.Errorf("Expected EnsureIndexes() to be successful; got %v", err)
+		}
+	}()
+	specs, err := a.collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatalf("Expected listing indexes to be successful; got %v", err)
+	}
+	found := false
+	for _, spec := range specs {
+		found = found || spec.Name == "v0_1_en_2"
+	}
+	if !found {
+		t.Fatal("Expected the collated index v0_1_en_2 to be created")
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := e.LoadFilteredPolicy(bson.M{"v0": "ALICE"}); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+
+	// The case-insensitive query is supported by the collated index.
+	var plan bson.M
+	err = a.collection.Database().RunCommand(ctx, bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: a.collection.Name()},
+			{Key: "filter", Value: bson.D{{Key: "v0", Value: "ALICE"}}},
+			{Key: "collation", Value: collation},
+		}},
+	}).Decode(&plan)
+	if err != nil {
+		t.Fatalf("Expected explain to be successful; got %v", err)
+	}
+	if winning := fmt.Sprint(plan["queryPlanner"]); !strings.Contains(winning, "v0_1_en_2") {
+		t.Errorf("Expected the query to use the collated index; got %s", winning)
+	}
+
+	if _, err := NewAdapterWithError(getDbURL(), DBName(getDbName()), IndexCollation(collation), DocumentDBCompat(true)); err == nil {
+		t.Error("Expected IndexCollation to be refused with DocumentDBCompat")
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+	ctx := context.Background()
+
+	countIndexes := func() int {
+		t.Helper()
+		cur, err := a.collection.Indexes().List(ctx)
+		if err != nil {
+			t.Fatalf("Expected listing indexes to be successful; got %v", err)
+		}
+		var indexes []bson.M
+		if err := cur.All(ctx, &indexes); err != nil {
+			t.Fatalf("Expected listing indexes to be successful; got %v", err)
+		}
+		return len(indexes)
+	}
+
+	if err := a.DropIndexes(ctx); err != nil {
+		t.Errorf("Expected DropIndexes() to be successful; got %v", err)
+	}
+	if n := countIndexes(); n != 1 {
+		t.Errorf("Found %d indexes after DropIndexes(), supposed to be 1", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		names, err := a.EnsureIndexes(ctx)
+		if err != nil {
+			t.Errorf("Expected EnsureIndexes() to be successful; got %v", err)
+		}
+		if len(names) != len(indexedFields) {
+			t.Errorf("EnsureIndexes() returned %v, supposed to name %d indexes", names, len(indexedFields))
+		}
+	}
+	if n := countIndexes(); n != len(indexedFields)+1 {
+		t.Errorf("Found %d indexes after EnsureIndexes(), supposed to be %d", n, len(indexedFields)+1)
+	}
+}
+
+func TestLazyIndexes(t *testing.T) {
+	requireMongoDB(t)
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_lazy"))
+	defer a.Close()
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer a.collection.Drop(ctx)
+
+	exists := func() bool {
+		t.Helper()
+		names, err := a.collection.Database().ListCollectionNames(ctx, bson.D{{Key: "name", Value: a.collection.Name()}})
+		if err != nil {
+			t.Fatalf("Expected listing collections to be successful; got %v", err)
+		}
+		return len(names) > 0
+	}
+
+	// A reader never creates the indexes, nor the collection with them.
+	reader := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_lazy"))
+	defer reader.Close()
+	newTestEnforcer(t, "examples/rbac_model.conf", reader)
+	if exists() {
+		t.Error("Expected loading the policy to leave the collection uncreated")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := a.AddPolicy("p", "p", []string{fmt.Sprintf("user%d", i), "data1", "read"}); err != nil {
+				t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	indexed := func(a *Adapter, write string) {
+		t.Helper()
+		specs, err := a.collection.Indexes().ListSpecifications(ctx)
+		if err != nil || len(specs) != len(indexedFields)+1 {
+			t.Errorf("Expected %s to create %d indexes; got %d (%v)", write, len(indexedFields)+1, len(specs), err)
+		}
+	}
+	indexed(a, "the first write")
+
+	// SavePolicy drops the collection along with its indexes, which the
+	// following insert creates again.
+	if err := a.SavePolicy(newTestEnforcer(t, "examples/rbac_model.conf", a).GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	indexed(a, "SavePolicy")
+
+	for write, run := range map[string]func(a *Adapter) error{
+		"ImportMerge": func(a *Adapter) error {
+			return a.ImportPolicy(ctx, strings.NewReader("p, alice, data1, read\n"), ImportMerge)
+		},
+		"UpdatePolicy": func(a *Adapter) error {
+			if _, err := a.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "alice"}, {Key: "v1", Value: "data1"}, {Key: "v2", Value: "read"}}); err != nil {
+				return err
+			}
+			return a.UpdatePolicy("p", "p", []string{"alice", "data1", "read"}, []string{"alice", "data1", "write"})
+		},
+	} {
+		w := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_lazy_"+strings.ToLower(write)))
+		if err := w.collection.Drop(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := run(w); err != nil {
+			t.Errorf("Expected %s to be successful; got %v", write, err)
+		}
+		indexed(w, write)
+		w.collection.Drop(ctx)
+		w.Close()
+	}
+}
+
+func TestEnsureCollection(t *testing.T) {
+	requireMongoDB(t)
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_created"), EnsureIndexesOnOpen(false))
+	defer a.Close()
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer a.collection.Drop(ctx)
+
+	validator := bson.D{{Key: "$jsonSchema", Value: bson.D{
+		{Key: "bsonType", Value: "object"},
+		{Key: "properties", Value: bson.D{{Key: "v0", Value: bson.D{{Key: "bsonType", Value: "string"}}}}},
+	}}}
+	for i := 0; i < 2; i++ {
+		if err := a.EnsureCollection(ctx, options.CreateCollection().SetValidator(validator)); err != nil {
+			t.Fatalf("Expected EnsureCollection() to be successful; got %v", err)
+		}
+	}
+	if _, err := a.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: 1}}); err == nil {
+		t.Error("Expected the validator of the created collection to refuse a non-string value")
+	}
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	if err := newTestAdapter().EnsureCollection(ctx, nil); err != nil {
+		t.Errorf("Expected EnsureCollection() to accept an existing collection; got %v", err)
+	}
+}
+
+func TestValidateDocuments(t *testing.T) {
+	requireMongoDB(t)
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_validated"))
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer a.collection.Drop(ctx)
+
+	for _, existing := range []bool{false, true} {
+		if existing {
+			// Applied with collMod to an existing collection.
+			if err := a.collection.Drop(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: 1}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_validated"), ValidateDocuments(true))
+		for _, doc := range []bson.D{
+			{{Key: "v0", Value: "alice"}},
+			{{Key: "ptype", Value: ""}},
+			{{Key: "ptype", Value: "p"}, {Key: "v0", Value: 1}},
+			{{Key: "ptype", Value: "p"}, {Key: "vals", Value: bson.A{"alice", 1}}},
+		} {
+			if _, err := a.collection.InsertOne(ctx, doc); err == nil {
+				t.Errorf("Expected %v to be refused by the validator", doc)
+			}
+		}
+		if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+			t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+		}
+		if err := a.RemoveFilteredPolicy("p", "p", 0); err != nil {
+			t.Errorf("Expected RemoveFilteredPolicy() to remove invalid documents too; got %v", err)
+		}
+
+		e := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+		if err := a.SavePolicy(e.GetModel()); err != nil {
+			t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+		}
+		if _, err := a.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: 1}}); err == nil {
+			t.Error("Expected SavePolicy() to keep the validator")
+		}
+		a.Close()
+	}
+}
+
+func TestValidateEncryptedDocuments(t *testing.T) {
+	requireMongoDB(t)
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_validated"))
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	defer a.collection.Drop(ctx)
+
+	// The values encrypted by the driver reach the server as binary data of
+	// subtype 6, as inserted here directly.
+	b := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_validated"), ValidateDocuments(true), AutoEncryption(nil, "v0"))
+	defer b.Close()
+	if err := b.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	encrypted := bson.Binary{Subtype: 6, Data: []byte{1, 2, 3}}
+	if _, err := b.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: encrypted}}); err != nil {
+		t.Errorf("Expected an encrypted v0 to be accepted by the validator; got %v", err)
+	}
+	if _, err := b.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: "p"}, {Key: "v1", Value: encrypted}}); err == nil {
+		t.Error("Expected binary data in v1, which is not encrypted, to be refused by the validator")
+	}
+}
+
+func TestSavePolicyInBatches(t *testing.T) {
+	requireMongoDB(t)
+	e := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), BatchSize(2))
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	e.ClearPolicy()
+	if err := a.LoadPolicy(e.GetModel()); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestWriteBatchSize(t *testing.T) {
+	for _, tc := range []struct {
+		a    *Adapter
+		size int
+	}{
+		{&Adapter{}, defaultBatchSize},
+		{&Adapter{cfg: Config{BatchSize: 10}}, 10},
+		{&Adapter{cfg: Config{CosmosDBCompat: true}}, cosmosBatchSize},
+		{&Adapter{cfg: Config{CosmosDBCompat: true, BatchSize: 10}}, 10},
+	} {
+		if size := tc.a.writeBatchSize(); size != tc.size {
+			t.Errorf("writeBatchSize() = %d, supposed to be %d", size, tc.size)
+		}
+	}
+}
+
+func TestLoadSort(t *testing.T) {
+	byID := bson.D{{Key: "_id", Value: 1}}
+	for _, tc := range []struct {
+		sort interface{}
+		want interface{}
+	}{
+		{nil, byID},
+		{bson.D{}, byID},
+		{bson.D{{Key: "priority", Value: -1}}, bson.D{{Key: "priority", Value: -1}, {Key: "_id", Value: 1}}},
+		{bson.D{{Key: "_id", Value: -1}, {Key: "v0", Value: 1}}, bson.D{{Key: "_id", Value: -1}, {Key: "v0", Value: 1}}},
+		{bson.M{"v0": 1}, bson.M{"v0": 1}},
+	} {
+		a := &Adapter{cfg: Config{LoadSort: tc.sort}}
+		if sort := a.loadSort(); !reflect.DeepEqual(sort, tc.want) {
+			t.Errorf("loadSort() = %v, supposed to be %v", sort, tc.want)
+		}
+	}
+}
+
+func TestRuleTokens(t *testing.T) {
+	for _, tc := range []struct {
+		line   CasbinRule
+		tokens []string
+	}{
+		{CasbinRule{PType: "p"}, []string{}},
+		{CasbinRule{PType: "p", V0: "alice", V1: "data1", V2: "read"}, []string{"alice", "data1", "read"}},
+		{CasbinRule{PType: "p", V1: "read"}, []string{"", "read"}},
+		{CasbinRule{PType: "p", V0: "alice", V2: "read", V5: "x"}, []string{"alice", "", "read", "", "", "x"}},
+	} {
+		if tokens := tc.line.tokens(); !util.ArrayEquals(tokens, tc.tokens) {
+			t.Errorf("Tokens: %q, supposed to be %q", tokens, tc.tokens)
+		}
+	}
+}
+
+func TestLoadPolicyLine(t *testing.T) {
+	m, err := model.NewModelFromFile("examples/rbac_model.conf")
+	if err != nil {
+		t.Fatalf("Expected loading the model to be successful; got %v", err)
+	}
+
+	for _, line := range []CasbinRule{
+		{PType: "p", V0: "alice", V1: "data1", V2: "read"},
+		{PType: "p2", V0: "bob", V1: "data2", V2: "write"},
+		{PType: "r", V0: "alice"},
+		{},
+	} {
+		if err := loadPolicyLine(line, m); err != nil {
+			t.Errorf("Expected loading %+v to be successful; got %v", line, err)
+		}
+	}
+	if rules := m["p"]["p"].Policy; len(rules) != 1 || !util.ArrayEquals(rules[0], []string{"alice", "data1", "read"}) {
+		t.Errorf("Policy: %q, supposed to be [[alice data1 read]]", rules)
+	}
+
+	// A ptype that does not start with the letter of its section is loaded
+	// into the section stored along with it.
+	m.AddDef("p", "q", "sub, obj, act")
+	a := &Adapter{cfg: defaultConfig()}
+	if line := a.policyLine("p", "p", []string{"alice"}); line.Section != "" {
+		t.Errorf("Section: %q, supposed to be inferred from the ptype", line.Section)
+	}
+	line := a.policyLine("p", "q", []string{"carol", "data3", "read"})
+	if line.Section != "p" {
+		t.Errorf("Section: %q, supposed to be p", line.Section)
+	}
+	if err := loadPolicyLine(line, m); err != nil {
+		t.Errorf("Expected loading %+v to be successful; got %v", line, err)
+	}
+	if rules := m["p"]["q"].Policy; len(rules) != 1 || !util.ArrayEquals(rules[0], []string{"carol", "data3", "read"}) {
+		t.Errorf("Policy: %q, supposed to be [[carol data3 read]]", rules)
+	}
+	sections := make(map[string]string)
+	for _, line := range a.modelLines(m) {
+		sections[line.(*CasbinRule).PType] = line.(*CasbinRule).Section
+	}
+	if !reflect.DeepEqual(sections, map[string]string{"p": "", "q": "p"}) {
+		t.Errorf("Sections: %v, supposed to be map[p: q:p]", sections)
+	}
+
+	if err := a.LoadPolicy(nil); err == nil || !strings.Contains(err.Error(), "nil model") {
+		t.Errorf("Expected LoadPolicy() to refuse a nil model; got %v", err)
+	}
+	if err := a.LoadFilteredPolicyPipeline(nil, mongo.Pipeline{}); err == nil || !strings.Contains(err.Error(), "nil model") {
+		t.Errorf("Expected LoadFilteredPolicyPipeline() to refuse a nil model; got %v", err)
+	}
+}
+
+func TestLoadRuleWithEmptyLeadingField(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	if err := a.AddPolicy("p", "p", []string{"", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"", "data3", "read"}})
+}
+
+func TestNewAdapterFromDatabase(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	client, err := mongo.Connect(options.Client().ApplyURI(getDbURL()))
+	if err != nil {
+		t.Fatalf("Expected mongo.Connect() to be successful; got %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	a := NewAdapterFromDatabase(client.Database(getDbName()), DBName("ignored"))
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestPolicyStats(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	stats, err := a.PolicyStats(context.Background())
+	if err != nil {
+		t.Errorf("Expected PolicyStats() to be successful; got %v", err)
+	}
+	if len(stats) != 2 || stats["p"] != 4 || stats["g"] != 1 {
+		t.Errorf("Stats: %v, supposed to be map[g:1 p:4]", stats)
+	}
+	if fallback, err := a.countByPType(context.Background()); err != nil || fallback["p"] != stats["p"] || fallback["g"] != stats["g"] {
+		t.Errorf("Fallback stats: %v (%v), supposed to be %v", fallback, err, stats)
+	}
+
+	n, err := a.CountPolicies(context.Background(), "p", "data2_admin")
+	if err != nil {
+		t.Errorf("Expected CountPolicies() to be successful; got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("Counted %d rules, supposed to be 2", n)
+	}
+
+	if err := a.dropTable(context.Background()); err != nil {
+		t.Fatalf("Expected dropTable() to be successful; got %v", err)
+	}
+	if stats, err := a.PolicyStats(context.Background()); err != nil || stats == nil || len(stats) != 0 {
+		t.Errorf("Expected empty stats for an empty collection; got %v (%v)", stats, err)
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	values, err := a.DistinctValues(ctx, "p", 0)
+	if err != nil {
+		t.Errorf("Expected DistinctValues() to be successful; got %v", err)
+	}
+	if !util.ArrayEquals(values, []string{"alice", "bob", "data2_admin"}) {
+		t.Errorf("Values: %v, supposed to be [alice bob data2_admin]", values)
+	}
+	if values, err := a.DistinctValues(ctx, "g", 2); err != nil || len(values) != 0 {
+		t.Errorf("Expected no values for an unused field; got %v (%v)", values, err)
+	}
+	if _, err := a.DistinctValues(ctx, "p", 6); err == nil {
+		t.Error("Expected DistinctValues() to fail with an invalid field index")
+	}
+
+	for name, get := range map[string]func(context.Context) ([]string, error){
+		"alice bob data2_admin": a.GetAllSubjects,
+		"data1 data2":           a.GetAllObjects,
+		"read write":            a.GetAllActions,
+	} {
+		if values, err := get(ctx); err != nil || strings.Join(values, " ") != name {
+			t.Errorf("Values: %v, supposed to be [%s] (%v)", values, name, err)
+		}
+	}
+
+	// The $group fallback for results over the distinct limit yields the
+	// same values.
+	values, err = a.groupValues(ctx, "v1", a.liveFilter(bson.D{{Key: "ptype", Value: "p"}}))
+	if err != nil || !util.ArrayEquals(values, []string{"data1", "data2"}) {
+		t.Errorf("Values: %v, supposed to be [data1 data2] (%v)", values, err)
+	}
+}
+
+func TestLoadFilteredPolicyPipeline(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "ptype", Value: "p"},
+			{Key: "v0", Value: bson.D{{Key: "$regex", Value: "^data2_"}}},
+		}}},
+	}
+	e.ClearPolicy()
+	if err := a.LoadFilteredPolicyPipeline(e.GetModel(), pipeline); err != nil {
+		t.Errorf("Expected LoadFilteredPolicyPipeline() to be successful; got %v", err)
+	}
+	if !a.IsFiltered() {
+		t.Error("Expected the adapter to be filtered")
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	// LoadFilteredPolicy runs pipelines too, e.g. to load the g rules of
+	// the subjects of some p rule.
+	pipeline = mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "ptype", Value: "g"}}}},
+		{{Key: "$lookup", Value: bson.D{
+			{Key: "from", Value: "casbin_rule"},
+			{Key: "localField", Value: "v0"},
+			{Key: "foreignField", Value: "v0"},
+			{Key: "as", Value: "rules"},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "rules.ptype", Value: "p"}}}},
+	}
+	if err := e.LoadFilteredPolicy(pipeline); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	if roles, _ := e.GetRolesForUser("alice"); !util.ArrayEquals(roles, []string{"data2_admin"}) {
+		t.Errorf("Roles: %v, supposed to be [data2_admin]", roles)
+	}
+
+	invalid := mongo.Pipeline{{{Key: "$nosuchstage", Value: 1}}}
+	if err := e.LoadFilteredPolicy(invalid); err == nil {
+		t.Error("Expected LoadFilteredPolicy() to fail with an invalid pipeline")
+	}
+}
+
+func TestListPolicies(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	all, total, err := a.ListPolicies(context.Background(), nil, 0, 0)
+	if err != nil {
+		t.Fatalf("Expected ListPolicies() to be successful; got %v", err)
+	}
+	if total != 5 || len(all) != 5 {
+		t.Fatalf("Listed %d of %d rules, supposed to be 5 of 5", len(all), total)
+	}
+
+	var paged [][]string
+	for offset := int64(0); offset < total; offset += 2 {
+		page, n, err := a.ListPolicies(context.Background(), nil, offset, 2)
+		if err != nil {
+			t.Fatalf("Expected ListPolicies() to be successful; got %v", err)
+		}
+		if n != total {
+			t.Errorf("Total: %d, supposed to be %d", n, total)
+		}
+		paged = append(paged, page...)
+	}
+	if !util.Array2DEquals(all, paged) {
+		t.Error("Pages: ", paged, ", supposed to be ", all)
+	}
+
+	page, n, err := a.ListPolicies(context.Background(), bson.M{"ptype": "p", "v0": "data2_admin"}, 1, 10)
+	if err != nil {
+		t.Fatalf("Expected ListPolicies() to be successful; got %v", err)
+	}
+	if n != 2 || !util.Array2DEquals(page, [][]string{{"p", "data2_admin", "data2", "write"}}) {
+		t.Errorf("Listed %v of %d rules, supposed to be [[p data2_admin data2 write]] of 2", page, n)
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), SoftDelete(true))
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "data2_admin"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}})
+
+	ctx := context.Background()
+	if n, err := a.collection.CountDocuments(ctx, bson.M{"deletedAt": bson.M{"$exists": true}}); err != nil || n != 3 {
+		t.Errorf("Expected 3 soft-deleted rules to be kept; got %d (%v)", n, err)
+	}
+
+	if n, err := a.PurgeDeleted(ctx, time.Hour); err != nil || n != 0 {
+		t.Errorf("Expected PurgeDeleted() to keep recent rules; purged %d (%v)", n, err)
+	}
+	if n, err := a.PurgeDeleted(ctx, 0); err != nil || n != 3 {
+		t.Errorf("Expected PurgeDeleted() to purge 3 rules; purged %d (%v)", n, err)
+	}
+}
+
+func TestExpireRules(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	if err := newTestAdapter().AddPolicyWithTTL(ctx, "p", "p", []string{"carol", "data3", "read"}, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Expected AddPolicyWithTTL() to require ExpireRules")
+	}
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), ExpireRules(true))
+	if err := a.AddPolicyWithTTL(ctx, "p", "p", []string{"carol", "data3", "read"}, time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("Expected AddPolicyWithTTL() to be successful; got %v", err)
+	}
+	// An expired rule not deleted by the server yet is not loaded.
+	if err := a.AddPolicyWithTTL(ctx, "p", "p", []string{"dave", "data3", "read"}, time.Now().Add(-time.Minute)); err != nil {
+		t.Errorf("Expected AddPolicyWithTTL() to be successful; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	specs, err := a.collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatalf("Expected listing indexes to be successful; got %v", err)
+	}
+	ttl := false
+	for _, spec := range specs {
+		ttl = ttl || (spec.Name == "expiresAt_1" && spec.ExpireAfterSeconds != nil && *spec.ExpireAfterSeconds == 0)
+	}
+	if !ttl {
+		t.Error("Expected a TTL index on expiresAt")
+	}
+
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "data3"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, "alice"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestAddPolicyWithMeta(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), MetadataField("audit"))
+	if err := a.AddPolicyWithMeta("p", "p", []string{"carol", "data3", "read"}, map[string]interface{}{"createdBy": "admin"}); err != nil {
+		t.Fatalf("Expected AddPolicyWithMeta() to be successful; got %v", err)
+	}
+
+	var doc struct {
+		Audit struct {
+			CreatedBy string    `bson:"createdBy"`
+			CreatedAt time.Time `bson:"createdAt"`
+		} `bson:"audit"`
+	}
+	if err := a.collection.FindOne(ctx, bson.M{"v0": "carol"}).Decode(&doc); err != nil {
+		t.Fatalf("Expected finding the rule to be successful; got %v", err)
+	}
+	if doc.Audit.CreatedBy != "admin" || doc.Audit.CreatedAt.IsZero() {
+		t.Errorf("Expected the metadata to be stored; got %+v", doc.Audit)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+}
+
+func TestLoadIncrementalPolicy(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	if _, err := newTestAdapter().LoadIncrementalPolicy(ctx, nil, time.Now()); err == nil {
+		t.Error("Expected LoadIncrementalPolicy() to require TrackUpdates")
+	}
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), SoftDelete(true), TrackUpdates(true))
+	since := time.Now()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"bob", "data2", "write"}, []string{"bob", "data3", "write"}); err != nil {
+		t.Errorf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+
+	latest, err := a.LoadIncrementalPolicy(ctx, e.GetModel(), since)
+	if err != nil {
+		t.Fatalf("Expected LoadIncrementalPolicy() to be successful; got %v", err)
+	}
+	if !latest.After(since) {
+		t.Errorf("Expected the returned time %v to be after %v", latest, since)
+	}
+	want := [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}, {"bob", "data3", "write"}}
+	testGetPolicy(t, e, want)
+
+	if again, err := a.LoadIncrementalPolicy(ctx, e.GetModel(), latest); err != nil || !again.Equal(latest) {
+		t.Errorf("Expected no change after %v; got %v (%v)", latest, again, err)
+	}
+	testGetPolicy(t, e, want)
+
+	// A full load agrees with the incremental ones.
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}, {"bob", "data3", "write"}})
+}
+
+func TestArrayFilter(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+	ArraySchema(true)(a)
+
+	selector := a.schemaFilter(filteredSelector("p", 1, "data1", "", "x"))
+	if want := map[string]interface{}{"ptype": "p", "vals.1": "data1", "vals.3": "x"}; !reflect.DeepEqual(selector, want) {
+		t.Errorf("Selector: %v, supposed to be %v", selector, want)
+	}
+
+	filter := a.schemaFilter(bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "v0", Value: "alice"}}, bson.M{"vals": "bob"}}}})
+	want := bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "vals.0", Value: "alice"}}, bson.M{"vals": "bob"}}}}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Filter: %v, supposed to be %v", filter, want)
+	}
+}
+
+func TestUnmarshalArrayRule(t *testing.T) {
+	data, err := bson.Marshal(arrayRule{PType: "p", Vals: []string{"alice", "", "read"}, Tenant: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line CasbinRule
+	if err := bson.Unmarshal(data, &line); err != nil {
+		t.Fatalf("Expected an array rule to be decoded; got %v", err)
+	}
+	if want := (CasbinRule{PType: "p", V0: "alice", V2: "read", Tenant: "acme"}); line != want {
+		t.Errorf("Decoded %+v, supposed to be %+v", line, want)
+	}
+
+	data, _ = bson.Marshal(CasbinRule{PType: "g", V0: "alice", V1: "admin"})
+	if err := bson.Unmarshal(data, &line); err != nil || line.V1 != "admin" {
+		t.Errorf("Expected a column rule to be decoded; got %+v (%v)", line, err)
+	}
+
+	data, _ = bson.Marshal(arrayRule{PType: "p", Vals: []string{"a", "b", "c", "d", "e", "f", "g"}})
+	if err := bson.Unmarshal(data, &line); err == nil {
+		t.Error("Expected a rule with 7 values to fail to decode")
+	}
+}
+
+func TestArraySchema(t *testing.T) {
+	requireMongoDB(t)
+	a := NewAdapter(getDbURL(), DBName(getDbName()), ArraySchema(true))
+	e := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	ctx := context.Background()
+	if n, err := a.collection.CountDocuments(ctx, bson.M{"v0": bson.M{"$exists": true}}); err != nil || n != 0 {
+		t.Errorf("Expected no rule to be stored in v0 to v5; got %d (%v)", n, err)
+	}
+	var doc bson.M
+	if err := a.collection.FindOne(ctx, bson.M{"ptype": "g"}).Decode(&doc); err != nil {
+		t.Fatalf("Expected FindOne() to be successful; got %v", err)
+	}
+	if vals, _ := doc["vals"].(bson.A); !reflect.DeepEqual(vals, bson.A{"alice", "data2_admin"}) {
+		t.Errorf("Stored %v, supposed to be [alice data2_admin]", doc["vals"])
+	}
+
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data2"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "data2", "write"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}, {"", "data3", "read"}})
+
+	if ok, err := a.HasPolicy(ctx, "p", []string{"", "data3", "read"}); err != nil || !ok {
+		t.Errorf("Expected HasPolicy() to find the added rule; got %t (%v)", ok, err)
+	}
+	if values, err := a.DistinctValues(ctx, "p", 1); err != nil || !reflect.DeepEqual(values, []string{"data2", "data3"}) {
+		t.Errorf("Distinct values: %v (%v), supposed to be [data2 data3]", values, err)
+	}
+
+	filter, _ := PTypeFilter([]string{"p"}, map[int][]string{2: {"read"}, 1: {"data3"}})
+	if err := e.LoadFilteredPolicy(filter); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"", "data3", "read"}})
+	if err := e.LoadFilteredPolicy(bson.M{"vals": "data2_admin"}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}})
+}
+
+func TestMigrateSchema(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), ArraySchema(true))
+	if n, err := a.MigrateSchema(ctx); err != nil || n != 5 {
+		t.Errorf("Expected MigrateSchema() to convert 5 rules; got %d (%v)", n, err)
+	}
+	if n, err := a.collection.CountDocuments(ctx, bson.M{"vals": bson.M{"$exists": false}}); err != nil || n != 0 {
+		t.Errorf("Expected all the rules to be converted; got %d left (%v)", n, err)
+	}
+	if n, err := a.MigrateSchema(ctx); err != nil || n != 0 {
+		t.Errorf("Expected MigrateSchema() to have nothing left to convert; got %d (%v)", n, err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	b := newTestAdapter()
+	if n, err := b.MigrateSchema(ctx); err != nil || n != 5 {
+		t.Errorf("Expected MigrateSchema() to convert 5 rules back; got %d (%v)", n, err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", b)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected the converted grouping rule to be loaded")
+	}
+}
+
+func TestTenant(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	acme := NewAdapter(getDbURL(), DBName(getDbName()), Tenant("acme"))
+	globex := NewAdapter(getDbURL(), DBName(getDbName()), Tenant("globex"))
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", acme)
+	testGetPolicy(t, e, [][]string{})
+
+	e = newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := acme.SavePolicy(e.GetModel()); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := globex.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := globex.RemoveFilteredPolicy("p", "p", 0, "data2_admin"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := globex.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+
+	e = newTestEnforcer(t, "examples/rbac_model.conf", acme)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	e = newTestEnforcer(t, "examples/rbac_model.conf", globex)
+	testGetPolicy(t, e, [][]string{{"carol", "data3", "read"}})
+
+	// Saving a tenant's policy leaves the other tenants' rules alone.
+	if err := globex.SavePolicy(e.GetModel()); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", acme)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestFilteredState(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestFilteredAdapter()
+	if !a.IsFiltered() {
+		t.Error("Expected a new filtered adapter to be filtered")
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{})
+
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if a.IsFiltered() {
+		t.Error("Expected the adapter not to be filtered after a full load")
+	}
+	if err := a.SavePolicy(e.GetModel()); !errors.Is(err, ErrFilteredSave) {
+		t.Errorf("Expected SavePolicy() to fail with ErrFilteredSave on a filtered adapter; got %v", err)
+	}
+
+	if err := e.LoadFilteredPolicy(&bson.M{"v0": "bob"}); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	if !a.IsFiltered() {
+		t.Error("Expected the adapter to be filtered after a filtered load")
+	}
+}
+
+func TestRemoveDuplicates(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	for i := 0; i < 3; i++ {
+		if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+			t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+		}
+	}
+	if err := a.AddPolicy("g", "g", []string{"alice", "data2_admin"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	ctx := context.Background()
+	rules, err := a.FindDuplicates(ctx)
+	if err != nil {
+		t.Errorf("Expected FindDuplicates() to be successful; got %v", err)
+	}
+	if len(rules) != 2 {
+		t.Errorf("Found duplicates %v, supposed to find 2 rules", rules)
+	}
+
+	n, err := a.RemoveDuplicates(ctx)
+	if err != nil {
+		t.Errorf("Expected RemoveDuplicates() to be successful; got %v", err)
+	}
+	if n != 4 {
+		t.Errorf("Removed %d duplicates, supposed to be 4", n)
+	}
+	if rules, err := a.FindDuplicates(ctx); err != nil || len(rules) != 0 {
+		t.Errorf("Expected no duplicates left; got %v (%v)", rules, err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestRemoveFilteredPolicyAllTypes(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	if err := a.RemoveFilteredPolicyAllTypes(0); err == nil {
+		t.Error("Expected RemoveFilteredPolicyAllTypes() to refuse removing all rules")
+	}
+	if err := a.RemoveFilteredPolicyAllTypes(0, "alice"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicyAllTypes() to be successful; got %v", err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if roles, _ := e.GetRolesForUser("alice"); len(roles) != 0 {
+		t.Errorf("Roles of alice: %v, supposed to be none", roles)
+	}
+}
+
+func TestClearPolicies(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	if err := a.ClearPolicies(ctx); err != nil {
+		t.Errorf("Expected ClearPolicies() to be successful; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{})
+
+	specs, err := a.collection.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		t.Fatalf("Expected listing indexes to be successful; got %v", err)
+	}
+	if len(specs) != len(indexedFields)+1 {
+		t.Errorf("Found %d indexes after ClearPolicies(), supposed to be %d", len(specs), len(indexedFields)+1)
+	}
+
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatalf("Expected Drop() to be successful; got %v", err)
+	}
+	if err := a.ClearPolicies(ctx); err != nil {
+		t.Errorf("Expected ClearPolicies() to be successful on a missing collection; got %v", err)
+	}
+}
+
+func TestPriorityModel(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/priority_model.conf", "examples/priority_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	tests := []struct {
+		sub, obj, act string
+		want          bool
+	}{
+		{"alice", "data1", "read", true},
+		{"alice", "data1", "write", false},
+		{"bob", "data2", "read", true},
+		{"bob", "data2", "write", false},
+	}
+	for i := 0; i < 3; i++ {
+		e = newTestEnforcer(t, "examples/priority_model.conf", a)
+		for _, tt := range tests {
+			if ok, err := e.Enforce(tt.sub, tt.obj, tt.act); err != nil || ok != tt.want {
+				t.Errorf("Enforce(%s, %s, %s) = %v (%v), supposed to be %v", tt.sub, tt.obj, tt.act, ok, err, tt.want)
+			}
+		}
+	}
+}
+
+func TestPriorityField(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/priority_model_explicit.conf", "examples/priority_policy_explicit.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	ctx := context.Background()
+	priority := func(rule ...string) int {
+		var line CasbinRule
+		if err := a.collection.FindOne(ctx, a.ruleSelector("p", rule)).Decode(&line); err != nil {
+			t.Errorf("Expected FindOne() to be successful; got %v", err)
+		}
+		return line.Priority
+	}
+	if p := priority("1", "bob", "data2", "read", "deny"); p != 1 {
+		t.Errorf("Priority: %d, supposed to be 1", p)
+	}
+
+	e = newTestEnforcer(t, "examples/priority_model_explicit.conf", a)
+	if ok, _ := e.Enforce("bob", "data2", "read"); ok {
+		t.Error("Expected bob's deny rule to take precedence")
+	}
+
+	if _, err := e.UpdatePolicy([]string{"1", "bob", "data2", "read", "deny"}, []string{"20", "bob", "data2", "read", "deny"}); err != nil {
+		t.Errorf("Expected UpdatePolicy() to be successful; got %v", err)
+	}
+	if p := priority("20", "bob", "data2", "read", "deny"); p != 20 {
+		t.Errorf("Priority: %d, supposed to be 20", p)
+	}
+	e = newTestEnforcer(t, "examples/priority_model_explicit.conf", a)
+	if ok, _ := e.Enforce("bob", "data2", "read"); !ok {
+		t.Error("Expected the group's allow rule to take precedence after the update")
+	}
+
+	old, err := a.UpdateFilteredPolicies("p", "p", [][]string{{"5", "carol", "data3", "read", "allow"}}, 1, "alice")
+	if err != nil {
+		t.Errorf("Expected UpdateFilteredPolicies() to be successful; got %v", err)
+	}
+	if len(old) != 2 {
+		t.Errorf("Replaced %v, supposed to be alice's 2 rules", old)
+	}
+	if err := a.UpdatePolicies("p", "p", [][]string{{"1"}}, nil); err == nil {
+		t.Error("Expected UpdatePolicies() to fail with mismatched rules")
+	}
+}
+
+func TestReadCollections(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), ReadCollections("casbin_rule", "casbin_rule_20*"))
+	db := a.collection.Database()
+	for year, rule := range map[string]CasbinRule{
+		"2023": {PType: "p", V0: "carol", V1: "data3", V2: "read"},
+		"2024": {PType: "p", V0: "dave", V1: "data4", V2: "read"},
+	} {
+		coll := db.Collection("casbin_rule_" + year)
+		if err := coll.Drop(ctx); err != nil {
+			t.Fatalf("Expected Drop() to be successful; got %v", err)
+		}
+		if _, err := coll.InsertOne(ctx, rule); err != nil {
+			t.Fatalf("Expected InsertOne() to be successful; got %v", err)
+		}
+		defer coll.Drop(ctx)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}, {"dave", "data4", "read"}})
+
+	if err := e.LoadFilteredPolicy(&bson.M{"v1": "data3"}); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"carol", "data3", "read"}})
+}
+
+func TestCollectionRouter(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	route := func(rule CasbinRule) string {
+		if rule.PType == "g" {
+			return ""
+		}
+		return "casbin_rule_" + rule.V0[:1]
+	}
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionRouter(route), ReadCollections("casbin_rule", "casbin_rule_?"))
+	db := a.collection.Database()
+	for _, name := range []string{"casbin_rule_a", "casbin_rule_b", "casbin_rule_d"} {
+		defer db.Collection(name).Drop(ctx)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := a.AddPolicy("p", "p", []string{"bob", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data2", "write"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	for name, want := range map[string]int64{"casbin_rule": 1, "casbin_rule_a": 1, "casbin_rule_b": 1, "casbin_rule_d": 2} {
+		if n, err := db.Collection(name).CountDocuments(ctx, bson.D{}); err != nil || n != want {
+			t.Errorf("Expected %d rules in %s; got %d (%v)", want, name, n, err)
+		}
+	}
+
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data3", "read"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "data2"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := a.UpdatePolicy("p", "p", []string{"bob", "data3", "read"}, []string{"bob", "data3", "write"}); err == nil {
+		t.Error("Expected UpdatePolicy() to fail with CollectionRouter")
+	}
+	if err := a.ImportPolicy(ctx, strings.NewReader("p, bob, data3, write\n"), ImportMerge); err == nil {
+		t.Error("Expected ImportPolicy() with ImportMerge to fail with CollectionRouter")
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data3", "read"}})
+
+	if _, err := NewAdapterWithError(getDbURL(), DBName(getDbName()), CollectionRouter(route)); err == nil {
+		t.Error("Expected CollectionRouter without ReadCollections to be refused")
+	}
+}
+
+func TestSavePolicyDryRun(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if _, err := e.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if _, err := e.RemovePolicy("alice", "data1", "read"); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	// Put the removed rule back in storage only, so that the dry run differs
+	// from the stored policy.
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	rules, n, err := a.SavePolicyDryRun(context.Background(), e.GetModel())
+	if err != nil {
+		t.Fatalf("Expected SavePolicyDryRun() to be successful; got %v", err)
+	}
+	if n != 6 {
+		t.Errorf("Would delete %d rules, supposed to be 6", n)
+	}
+	if len(rules) != 5 {
+		t.Errorf("Would insert %v, supposed to be 5 rules", rules)
+	}
+
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}, {"alice", "data1", "read"}})
+}
+
+func TestLoadDecodeErrors(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	if _, err := a.collection.InsertOne(ctx, bson.M{"ptype": "p", "v0": 42, "v1": "data3", "v2": "read"}); err != nil {
+		t.Fatalf("Expected InsertOne() to be successful; got %v", err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf")
+	if err := a.LoadPolicy(e.GetModel()); err == nil {
+		t.Error("Expected LoadPolicy() to report the undecodable document")
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	strict := NewAdapter(getDbURL(), DBName(getDbName()), StrictDecode(true))
+	e.ClearPolicy()
+	if err := strict.LoadPolicy(e.GetModel()); err == nil {
+		t.Error("Expected LoadPolicy() to fail on the undecodable document")
+	}
+}
+
+func TestAddPolicyEx(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	id, err := a.AddPolicyEx("p", "p", []string{"carol", "data3", "read"})
+	if err != nil {
+		t.Fatalf("Expected AddPolicyEx() to be successful; got %v", err)
+	}
+
+	var line CasbinRule
+	if err := a.collection.FindOne(context.Background(), bson.M{"_id": id}).Decode(&line); err != nil {
+		t.Fatalf("Expected the added rule to be found by _id; got %v", err)
+	}
+	if line.V0 != "carol" || line.V1 != "data3" || line.V2 != "read" {
+		t.Errorf("Found %v, supposed to be the added rule", line)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CacheTTL(time.Minute))
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	initial := [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}}
+	testGetPolicy(t, e, initial)
+
+	// A write made behind the adapter's back is not seen until the cache is
+	// invalidated.
+	ctx := context.Background()
+	if _, err := a.collection.InsertOne(ctx, CasbinRule{PType: "p", V0: "carol", V1: "data3", V2: "read"}); err != nil {
+		t.Fatalf("Expected InsertOne() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, initial)
+
+	a.InvalidateCache()
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, append(initial, []string{"carol", "data3", "read"}))
+
+	// Writes made through the adapter invalidate the cache.
+	if err := a.RemovePolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, initial)
+}
+
+func TestRegistry(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	testClient, _ = mongo.Connect(options.Client().ApplyURI(getDbURL()))
+	a := NewAdapterFromClient(testClient, DBName(getDbName()), Registry(bson.NewRegistry()))
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := a.AddPolicy("p", "p", []string{"carol", "data, 3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	// A rule written with the registry reads back unchanged.
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data, 3", "read"}})
+}
+
+func TestHasPolicy(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	if ok, err := a.HasPolicy(ctx, "p", []string{"alice", "data1", "read"}); err != nil || !ok {
+		t.Errorf("Expected the rule to be stored; got %t (%v)", ok, err)
+	}
+	if ok, err := a.HasPolicy(ctx, "p", []string{"alice", "data1"}); err != nil || ok {
+		t.Errorf("Expected a partial rule not to match; got %t (%v)", ok, err)
+	}
+	if ok, err := a.HasPolicy(ctx, "g", []string{"alice", "data1", "read"}); err != nil || ok {
+		t.Errorf("Expected a rule of another ptype not to match; got %t (%v)", ok, err)
+	}
+
+	found, err := a.HasPolicies(ctx, "p", [][]string{{"bob", "data2", "write"}, {"bob", "data2", "read"}, {"data2_admin", "data2", "read"}})
+	if err != nil {
+		t.Fatalf("Expected HasPolicies() to be successful; got %v", err)
+	}
+	if len(found) != 3 || !found[0] || found[1] || !found[2] {
+		t.Errorf("HasPolicies: %v, supposed to be [true false true]", found)
+	}
+}
+
+func TestAutoReload(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e, err := casbin.NewSyncedEnforcer("examples/rbac_model.conf", a)
+	if err != nil {
+		t.Fatalf("Expected NewSyncedEnforcer() to be successful; got %v", err)
+	}
+	err = a.AutoReload(e, 100*time.Millisecond)
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(40573) {
+		t.Skip("change streams require a replica set")
+	}
+	if err != nil {
+		t.Fatalf("Expected AutoReload() to be successful; got %v", err)
+	}
+	defer a.Close()
+
+	other := newTestAdapter()
+	if err := other.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	// Dropping the collection invalidates the change stream, which must be
+	// reopened.
+	f := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+	if err := other.SavePolicy(f.GetModel()); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := other.AddPolicy("p", "p", []string{"dave", "data4", "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	reloaded := func() bool {
+		ok, _ := e.HasPolicy("dave", "data4", "read")
+		return ok
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !reloaded() && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !reloaded() {
+		t.Error("Expected the enforcer to be reloaded")
+	}
+}
+
+func TestSaveViaStaging(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), SaveStrategy(SaveViaStaging))
+	defer a.Close()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if _, err := e.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	ctx := context.Background()
+	names, err := a.collection.Database().ListCollectionNames(ctx, bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "_staging_"}}}})
+	if err != nil || len(names) != 0 {
+		t.Errorf("Expected no staging collection to be left; got %v (%v)", names, err)
+	}
+	specs, err := a.collection.Indexes().ListSpecifications(ctx)
+	if err != nil || len(specs) != len(a.indexFields())+1 {
+		t.Errorf("Expected the indexes to be kept; got %d (%v)", len(specs), err)
+	}
+
+	if _, err := NewAdapterWithError(getDbURL(), DBName(getDbName()), SaveStrategy(SaveViaStaging), SoftDelete(true)); err == nil {
+		t.Error("Expected SaveViaStaging to be refused with SoftDelete")
+	}
+}
+
+func TestSaveDiff(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), SaveStrategy(SaveDiff))
+	defer a.Close()
+	ctx := context.Background()
+	idOf := func(rule bson.D) interface{} {
+		var doc bson.M
+		if err := a.collection.FindOne(ctx, rule).Decode(&doc); err != nil {
+			t.Fatalf("Expected %v to be stored; got %v", rule, err)
+		}
+		return doc["_id"]
+	}
+	bob := bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "bob"}}
+	bobID := idOf(bob)
+
+	// A duplicate of a rule is removed along with the rules removed from
+	// the model.
+	if _, err := a.collection.InsertOne(ctx, CasbinRule{PType: "p", V0: "bob", V1: "data2", V2: "write"}); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	e.EnableAutoSave(false)
+	if _, err := e.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if _, err := e.RemovePolicy("alice", "data1", "read"); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := e.SavePolicy(); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	stored := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, stored, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+	if n, err := a.collection.CountDocuments(ctx, bson.D{}); err != nil || n != 5 {
+		t.Errorf("Stored %d rules (%v), supposed to be 5", n, err)
+	}
+	if id := idOf(bob); id != bobID {
+		t.Errorf("Expected the unchanged rule to be kept; its _id changed from %v to %v", bobID, id)
+	}
+
+	if _, err := NewAdapterWithError(getDbURL(), DBName(getDbName()), SaveStrategy(SaveDiff),
+		ReadCollections("casbin_rule"), CollectionRouter(func(CasbinRule) string { return "" })); err == nil {
+		t.Error("Expected SaveDiff to be refused with CollectionRouter")
+	}
+}
+
+func TestSaveEmptyPolicy(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	// A model without role definition has no g section.
+	m, err := model.NewModelFromString(`
+[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`)
+	if err != nil {
+		t.Fatalf("Expected NewModelFromString() to be successful; got %v", err)
+	}
+	guarded := NewAdapter(getDbURL(), DBName(getDbName()), AllowEmptySave(false))
+	if err := guarded.SavePolicy(m); !errors.Is(err, ErrEmptySave) {
+		t.Errorf("Expected SavePolicy() to fail with ErrEmptySave; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", newTestAdapter())
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	a := newTestAdapter()
+	if err := a.SavePolicy(m); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{})
+
+	m.AddPolicy("p", "p", []string{"alice", "data1", "read"})
+	if err := a.SavePolicy(m); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful without a g section; got %v", err)
+	}
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+}
+
+func TestRemovePolicyMissingFields(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	docs := []interface{}{
+		bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "carol"}, {Key: "v1", Value: "data3"}, {Key: "v2", Value: "read"}},
+		bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "dave"}, {Key: "v1", Value: "data4"}, {Key: "v2", Value: "read"}, {Key: "v3", Value: nil}},
+	}
+	if _, err := a.collection.InsertMany(ctx, docs); err != nil {
+		t.Fatalf("Expected InsertMany() to be successful; got %v", err)
+	}
+
+	if ok, err := a.HasPolicy(ctx, "p", []string{"carol", "data3", "read"}); err != nil || !ok {
+		t.Errorf("Expected a rule without trailing fields to be found; got %t (%v)", ok, err)
+	}
+	for _, rule := range [][]string{{"carol", "data3", "read"}, {"dave", "data4", "read", ""}, {"alice", "data1", "read"}} {
+		if err := a.RemovePolicy("p", "p", rule); err != nil {
+			t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+		}
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestRemovePolicyRoundTrip(t *testing.T) {
+	requireMongoDB(t)
+	values := []string{"alice", "data1", "read", "allow", "domain1", "x"}
+	for _, array := range []bool{false, true} {
+		initPolicy(t)
+
+		a := NewAdapter(getDbURL(), DBName(getDbName()), StrictRemove(true), ArraySchema(array))
+		for n := 1; n <= 6; n++ {
+			rule := values[:n]
+			padded := append(append([]string{}, rule...), make([]string, 6-n)...)
+			for _, pair := range [][2][]string{{rule, rule}, {rule, padded}, {padded, rule}} {
+				if err := a.AddPolicy("p", "p", pair[0]); err != nil {
+					t.Fatalf("Expected AddPolicy(%q) to be successful; got %v", pair[0], err)
+				}
+				if err := a.RemovePolicy("p", "p", pair[1]); err != nil {
+					t.Errorf("Expected RemovePolicy(%q) to remove the rule added as %q with ArraySchema(%t); got %v", pair[1], pair[0], array, err)
+				}
+			}
+		}
+
+		// Other tools may store trailing empty values.
+		doc := bson.D{{Key: "ptype", Value: "p"}, {Key: "vals", Value: bson.A{"carol", "data3", "read", ""}}}
+		if !array {
+			doc = bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "carol"}, {Key: "v1", Value: "data3"}, {Key: "v2", Value: "read"}, {Key: "v3", Value: ""}}
+		}
+		if _, err := a.collection.InsertOne(context.Background(), doc); err != nil {
+			t.Fatalf("Expected InsertOne() to be successful; got %v", err)
+		}
+		if err := a.RemovePolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+			t.Errorf("Expected RemovePolicy() to remove a rule stored with a trailing empty value with ArraySchema(%t); got %v", array, err)
+		}
+
+		e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+		testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	base := newTestEnforcer(t, "examples/rbac_model.conf", a).GetModel()
+
+	const workers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*4)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rule := []string{fmt.Sprintf("user%d", i), "data3", "read"}
+			if err := a.AddPolicy("p", "p", rule); err != nil {
+				errs <- err
+			}
+			m := base.Copy()
+			m.ClearPolicy()
+			if err := a.LoadPolicy(m); err != nil {
+				errs <- err
+			}
+			if err := a.LoadFilteredPolicy(m.Copy(), bson.M{"v0": rule[0]}); err != nil {
+				errs <- err
+			}
+			_ = a.IsFiltered()
+			if err := a.RemovePolicy("p", "p", rule); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// The adapter may have been left filtered by a worker.
+		if err := a.SavePolicy(base); err != nil && !errors.Is(err, ErrFilteredSave) {
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Expected concurrent operations to be successful; got %v", err)
+	}
+
+	// A full load leaves the adapter unfiltered, so that the enforcer loads
+	// the policy.
+	if err := a.LoadPolicy(base.Copy()); err != nil {
+		t.Fatalf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestLoadPolicyCtx(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	m := e.GetModel().Copy()
+	m.ClearPolicy()
+	if err := a.LoadPolicyCtx(context.Background(), m); err != nil {
+		t.Errorf("Expected LoadPolicyCtx() to be successful; got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.LoadFilteredPolicyCtx(ctx, m, bson.M{"v0": "alice"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected LoadFilteredPolicyCtx() to fail with context.Canceled; got %v", err)
+	}
+
+	// Cancelling stops the load within a batch already fetched.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	cur, err := a.collection.Find(ctx, bson.D{})
+	if err != nil {
+		t.Fatalf("Expected Find() to be successful; got %v", err)
+	}
+	loaded := 0
+	err = a.loadCursor(ctx, cur, func(CasbinRule) error {
+		loaded++
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || loaded != 1 {
+		t.Errorf("Expected the load to stop after 1 rule with context.Canceled; got %d rules (%v)", loaded, err)
+	}
+}
+
+func TestReplacePoliciesByPtype(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	if err := a.ReplacePoliciesByPtype(ctx, "g", [][]string{{"bob", "data2_admin"}, {"carol", "data2_admin"}}); err != nil {
+		t.Fatalf("Expected ReplacePoliciesByPtype() to be successful; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if groups, _ := e.GetGroupingPolicy(); !util.Array2DEquals(groups, [][]string{{"bob", "data2_admin"}, {"carol", "data2_admin"}}) {
+		t.Errorf("Grouping policy: %v, supposed to be [[bob data2_admin] [carol data2_admin]]", groups)
+	}
+
+	if n, err := a.RemovePoliciesByPtype(ctx, "g"); err != nil || n != 2 {
+		t.Errorf("Expected RemovePoliciesByPtype() to remove 2 rules; got %d (%v)", n, err)
+	}
+	if n, err := a.RemovePoliciesByPtype(ctx, "g2"); err != nil || n != 0 {
+		t.Errorf("Expected RemovePoliciesByPtype() to remove no rule; got %d (%v)", n, err)
+	}
+	if stats, err := a.PolicyStats(ctx); err != nil || stats["g"] != 0 || stats["p"] != 4 {
+		t.Errorf("Stats: %v, supposed to be map[p:4] (%v)", stats, err)
+	}
+}
+
+func TestRemoveFilteredPolicies(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	if n, err := a.RemoveFilteredPolicies(ctx, "p", nil); err != nil || n != 0 {
+		t.Errorf("Expected no rule to be removed without filters; got %d (%v)", n, err)
+	}
+
+	n, err := a.RemoveFilteredPolicies(ctx, "p", []FieldFilter{
+		{FieldIndex: 0, FieldValues: []string{"alice"}},
+		{FieldIndex: 1, FieldValues: []string{"data2", "write"}},
+		{FieldIndex: 0, FieldValues: []string{"bob", "data2"}},
+	})
+	if err != nil || n != 3 {
+		t.Errorf("Expected RemoveFilteredPolicies() to remove 3 rules; got %d (%v)", n, err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"data2_admin", "data2", "read"}})
+	if groups, _ := e.GetGroupingPolicy(); len(groups) != 1 {
+		t.Errorf("Grouping policy: %v, supposed to be kept", groups)
+	}
+}
+
+func TestSavePolicyCtx(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if _, err := e.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	e.EnableAutoSave(false)
+	if _, err := e.RemovePolicy("alice", "data1", "read"); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := a.SavePolicyCtx(ctx, e.GetModel()); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected SavePolicyCtx() to fail with context.Canceled; got %v", err)
+	}
+	stored := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, stored, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	a = NewAdapter(getDbURL(), DBName(getDbName()), SaveStrategy(SaveInTransaction))
+	if err := a.SavePolicyCtx(context.Background(), e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicyCtx() to be successful; got %v", err)
+	}
+	stored = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, stored, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+}
+
+func TestReplaceValue(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := newTestAdapter()
+	if _, err := a.ReplaceValue(ctx, "data2_admin", "data2_owner", 6); err == nil {
+		t.Error("Expected ReplaceValue() to refuse an invalid field index")
+	}
+	if n, err := a.ReplaceValue(ctx, "data2_admin", "data2_owner", 0); err != nil || n != 2 {
+		t.Errorf("Expected ReplaceValue() to replace 2 values; got %d (%v)", n, err)
+	}
+	if n, err := a.ReplaceValue(ctx, "data2_admin", "data2_owner"); err != nil || n != 1 {
+		t.Errorf("Expected ReplaceValue() to replace 1 value; got %d (%v)", n, err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_owner", "data2", "read"}, {"data2_owner", "data2", "write"}})
+	if ok, err := e.Enforce("alice", "data2", "write"); err != nil || !ok {
+		t.Errorf("Expected alice to keep the role renamed to data2_owner; got %v (%v)", ok, err)
+	}
+}
+
+func TestAddPolicies(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := newTestAdapter()
+	unique := mongo.IndexModel{
+		Keys:    bson.D{{Key: "ptype", Value: 1}, {Key: "v0", Value: 1}, {Key: "v1", Value: 1}, {Key: "v2", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	name, err := a.collection.Indexes().CreateOne(ctx, unique)
+	if err != nil {
+		t.Fatalf("Expected creating a unique index to be successful; got %v", err)
+	}
+	defer a.collection.Indexes().DropOne(ctx, name)
+
+	rules := [][]string{{"carol", "data3", "read"}, {"alice", "data1", "read"}, {"dave", "data3", "write"}}
+	err = a.AddPolicies("p", "p", rules)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 1 || batchErr.Failed[0] != 1 || !errors.Is(err, ErrDuplicateRule) {
+		t.Errorf("Expected AddPolicies() to report the duplicate rule 1; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}, {"dave", "data3", "write"}})
+
+	a = NewAdapter(getDbURL(), DBName(getDbName()), SkipDuplicates(true))
+	if err := a.AddPolicies("p", "p", rules); err != nil {
+		t.Errorf("Expected AddPolicies() to skip the duplicate rules; got %v", err)
+	}
+	if err := a.RemovePolicies("p", "p", rules); err != nil {
+		t.Errorf("Expected RemovePolicies() to be successful; got %v", err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestModelIndexKeys(t *testing.T) {
+	m, err := model.NewModelFromString(`
+[request_definition]
+r = sub, dom, obj, act
+
+[policy_definition]
+p = sub, dom, obj, act
+p2 = priority, sub, obj
+
+[role_definition]
+g = _, _, _
+g2 = _, _
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = g(r.sub, p.sub, r.dom) && r.dom == p.dom && r.obj == p.obj && r.act == p.act
+`)
+	if err != nil {
+		t.Fatalf("Expected loading the model to be successful; got %v", err)
+	}
+
+	a := &Adapter{cfg: defaultConfig()}
+	if keys := a.modelIndexKeys(m); !reflect.DeepEqual(keys, [][]string{{"ptype", "v0", "v1"}, {"ptype", "v1", "v2"}}) {
+		t.Errorf("Keys: %q, supposed to be [[ptype v0 v1] [ptype v1 v2]]", keys)
+	}
+	a.cfg.ArraySchema = true
+	if keys := a.modelIndexKeys(m); !reflect.DeepEqual(keys, [][]string{{"ptype", "vals.0", "vals.1"}, {"ptype", "vals.1", "vals.2"}}) {
+		t.Errorf("Keys: %q, supposed to be [[ptype vals.0 vals.1] [ptype vals.1 vals.2]]", keys)
+	}
+	a.cfg = defaultConfig()
+	a.cfg.EncryptedFields = []string{"v1"}
+	if keys := a.modelIndexKeys(m); !reflect.DeepEqual(keys, [][]string{{"ptype", "v0"}}) {
+		t.Errorf("Keys: %q, supposed to be [[ptype v0]]", keys)
+	}
+	if !leadsAny([]string{"ptype", "v0"}, [][]string{{"_id"}, {"ptype", "v0", "v1"}}) || leadsAny([]string{"ptype", "v1"}, [][]string{{"ptype", "v0", "v1"}}) {
+		t.Error("Expected leadsAny() to match the leading fields of an index only")
+	}
+}
+
+func TestEnsureModelIndexes(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	names, err := a.EnsureModelIndexes(ctx, e.GetModel())
+	if err != nil || !reflect.DeepEqual(names, []string{"ptype_1_v0_1_v1_1"}) {
+		t.Errorf("Expected EnsureModelIndexes() to create ptype_1_v0_1_v1_1; got %q (%v)", names, err)
+	}
+	if names, err := a.EnsureModelIndexes(ctx, e.GetModel()); err != nil || len(names) != 0 {
+		t.Errorf("Expected EnsureModelIndexes() to skip the existing index; got %q (%v)", names, err)
+	}
+}
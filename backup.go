@@ -0,0 +1,244 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// maxDocumentSize is the largest BSON document the server stores.
+const maxDocumentSize = 16 * 1024 * 1024
+
+// RestoreMode selects how Restore writes the rules of a backup.
+type RestoreMode int
+
+const (
+	// RestoreReplace deletes the stored rules, soft-deleted ones included,
+	// then inserts those of the backup.
+	RestoreReplace RestoreMode = iota
+	// RestoreMerge inserts the rules of the backup whose _id is not stored
+	// yet, leaving the stored rules in place.
+	RestoreMerge
+)
+
+// Backup writes the documents of the policy collection, those of the tenant
+// with Tenant, to w in _id order, e.g. to keep a backup in object storage.
+// The documents are written as stored, soft-deleted and expired rules, _id,
+// timestamps and metadata included, one after another in BSON, each starting
+// with its length as BSON documents do, which is also the format of the
+// files of mongodump. Only the policy collection is backed up, not the
+// collections of ReadCollections or CollectionRouter. See Restore.
+func (a *Adapter) Backup(ctx context.Context, w io.Writer) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(ctx, "Backup", nil)
+	defer done()
+
+	return a.wrapErr("Backup", a.backup(ctx, w))
+}
+
+func (a *Adapter) backup(ctx context.Context, w io.Writer) error {
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+	if err := a.flush(ctx); err != nil {
+		return err
+	}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, a.tenantFilter(bson.D{}), options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.Background())
+
+	var n int64
+	for cur.Next(ctx) {
+		if _, err := w.Write(cur.Current); err != nil {
+			return fmt.Errorf("writing backup: %w", err)
+		}
+		n++
+	}
+	countDocs(ctx, n)
+	return cur.Err()
+}
+
+// Restore writes the rules of a backup written by Backup, read from r, to
+// the policy collection as set by mode, and returns the number of rules
+// inserted. The whole backup is read and checked before anything is
+// written, so that a truncated or corrupted backup fails without changing
+// the stored policy: each document must hold a non-empty ptype and at most
+// six values, and with Tenant, belong to the tenant. The documents are then
+// inserted as they were backed up, in batches as with SavePolicy, the
+// insertions following RestoreReplace not being cancelled along with ctx so
+// that the policy is not left empty. Readers see the policy change while the
+// rules are written.
+func (a *Adapter) Restore(ctx context.Context, r io.Reader, mode RestoreMode) (int64, error) {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	ctx, done := a.startOp(ctx, "Restore", nil)
+	defer done()
+
+	n, err := a.restore(ctx, r, mode)
+	return n, a.wrapErr("Restore", err)
+}
+
+func (a *Adapter) restore(ctx context.Context, r io.Reader, mode RestoreMode) (int64, error) {
+	if mode != RestoreReplace && mode != RestoreMerge {
+		return 0, fmt.Errorf("unknown restore mode %d", mode)
+	}
+
+	docs, err := a.readBackup(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := a.ensureOpen(); err != nil {
+		return 0, err
+	}
+	if err := a.flush(ctx); err != nil {
+		return 0, err
+	}
+
+	defer a.InvalidateCache()
+	if mode == RestoreReplace {
+		err := a.retryThrottled(ctx, func(ctx context.Context) error {
+			_, err := a.collection.DeleteMany(ctx, a.tenantFilter(bson.D{}))
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		ctx = context.WithoutCancel(ctx)
+	}
+
+	n, err := a.insertBackup(ctx, docs, mode == RestoreMerge)
+	if err != nil {
+		return n, err
+	}
+	return n, a.noteWrite(ctx)
+}
+
+// readBackup reads the documents of a backup from r and checks that they
+// hold rules the adapter can load.
+func (a *Adapter) readBackup(r io.Reader) ([]interface{}, error) {
+	br := bufio.NewReader(r)
+	var docs []interface{}
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(br, header[:]); err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("reading backup document %d: %w", len(docs), err)
+		}
+
+		size := int32(binary.LittleEndian.Uint32(header[:]))
+		if size < 5 || size > maxDocumentSize {
+			return nil, fmt.Errorf("backup document %d: invalid length %d", len(docs), size)
+		}
+		doc := make(bson.Raw, size)
+		copy(doc, header[:])
+		if _, err := io.ReadFull(br, doc[4:]); err != nil {
+			return nil, fmt.Errorf("reading backup document %d: %w", len(docs), err)
+		}
+		if err := a.checkBackupDocument(doc); err != nil {
+			return nil, fmt.Errorf("backup document %d: %w", len(docs), err)
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// checkBackupDocument reports a document that does not hold a rule of the
+// adapter's tenant.
+func (a *Adapter) checkBackupDocument(doc bson.Raw) error {
+	if err := doc.Validate(); err != nil {
+		return err
+	}
+	var line CasbinRule
+	if err := bson.Unmarshal(doc, &line); err != nil {
+		return err
+	}
+	if line.PType == "" {
+		return errors.New("missing ptype")
+	}
+	if line.Tenant != a.cfg.Tenant {
+		return fmt.Errorf("rule of tenant %q", line.Tenant)
+	}
+	return nil
+}
+
+// insertBackup inserts docs in batches and returns the number inserted. With
+// skipStored, the documents whose _id is already stored are skipped.
+func (a *Adapter) insertBackup(ctx context.Context, docs []interface{}, skipStored bool) (int64, error) {
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return 0, err
+	}
+
+	size := a.writeBatchSize()
+	opts := options.InsertMany().SetOrdered(!skipStored)
+
+	var inserted int64
+	for start := 0; start < len(docs); start += size {
+		end := start + size
+		if end > len(docs) {
+			end = len(docs)
+		}
+		batch := docs[start:end]
+
+		n := int64(len(batch))
+		_, err := a.retryThrottledBulk(ctx, len(batch), !skipStored, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			_, err := a.collection.InsertMany(ctx, atPositions(batch, pos), opts)
+			return nil, err
+		})
+		if skipStored {
+			var bwe mongo.BulkWriteException
+			if errors.As(err, &bwe) && bwe.WriteConcernError == nil && onlyDuplicateKeys(bwe.WriteErrors) {
+				n -= int64(len(bwe.WriteErrors))
+				err = nil
+			}
+		}
+		if err != nil {
+			return inserted, err
+		}
+		inserted += n
+		countDocs(ctx, n)
+	}
+	return inserted, nil
+}
+
+// onlyDuplicateKeys reports whether all errs refuse a document whose key is
+// already stored.
+func onlyDuplicateKeys(errs []mongo.BulkWriteError) bool {
+	for _, err := range errs {
+		if err.Code != duplicateKey {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
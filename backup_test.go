@@ -0,0 +1,96 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestReadBackup(t *testing.T) {
+	var backup []byte
+	for _, doc := range []bson.D{
+		{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "alice"}, {Key: "createdBy", Value: "admin"}},
+		{{Key: "ptype", Value: "g"}, {Key: "vals", Value: bson.A{"alice", "admin"}}},
+	} {
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backup = append(backup, data...)
+	}
+
+	a := &Adapter{cfg: defaultConfig()}
+	if docs, err := a.readBackup(bytes.NewReader(backup)); err != nil || len(docs) != 2 {
+		t.Errorf("Expected reading 2 documents; got %d (%v)", len(docs), err)
+	}
+	if docs, err := a.readBackup(bytes.NewReader(nil)); err != nil || len(docs) != 0 {
+		t.Errorf("Expected reading an empty backup; got %d (%v)", len(docs), err)
+	}
+
+	noPType, _ := bson.Marshal(bson.D{{Key: "v0", Value: "alice"}})
+	otherTenant, _ := bson.Marshal(bson.D{{Key: "ptype", Value: "p"}, {Key: "tenant", Value: "acme"}})
+	for name, data := range map[string][]byte{
+		"truncated":    backup[:len(backup)-3],
+		"bad length":   append([]byte{0xff, 0xff, 0xff, 0x7f}, backup...),
+		"no ptype":     noPType,
+		"other tenant": otherTenant,
+	} {
+		if _, err := a.readBackup(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected reading a backup with %s to fail", name)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := newTestAdapter()
+	var backup bytes.Buffer
+	if err := a.Backup(ctx, &backup); err != nil {
+		t.Fatalf("Expected Backup() to be successful; got %v", err)
+	}
+
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+
+	// A corrupted backup leaves the stored rules in place.
+	if _, err := a.Restore(ctx, bytes.NewReader(backup.Bytes()[:backup.Len()-1]), RestoreReplace); err == nil {
+		t.Error("Expected Restore() to refuse a truncated backup")
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	if n, err := a.Restore(ctx, bytes.NewReader(backup.Bytes()), RestoreMerge); err != nil || n != 1 {
+		t.Errorf("Expected Restore() to merge 1 rule; got %d (%v)", n, err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"carol", "data3", "read"}})
+
+	if n, err := a.Restore(ctx, bytes.NewReader(backup.Bytes()), RestoreReplace); err != nil || n != 5 {
+		t.Errorf("Expected Restore() to restore 5 rules; got %d (%v)", n, err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
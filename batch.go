@@ -0,0 +1,232 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// SkipDuplicates makes the writes inserting several rules, those of
+// AddPolicies and SavePolicy, treat the rules refused by a unique index of
+// the policy collection as already stored, instead of reporting them in a
+// *BatchError. It only matters for collections given a unique index outside
+// of the adapter, which creates none.
+func SkipDuplicates(skip bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.SkipDuplicates = skip
+	}
+}
+
+// BatchError is returned by writes inserting several rules, such as
+// AddPolicies and SavePolicy, when the server refused some of them, e.g.
+// because of a unique index or of ValidateDocuments, the others being
+// stored. It can be retrieved with errors.As, and matches ErrDuplicateRule
+// or ErrInvalidDocument with errors.Is if one of the rules was refused for
+// that reason.
+type BatchError struct {
+	// Failed holds the positions of the refused rules among those written,
+	// in increasing order.
+	Failed []int
+	// Errs holds the error refusing each rule of Failed.
+	Errs []error
+}
+
+// Error returns the number of refused rules and why the first one was.
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d rules refused, rule %d: %v", len(e.Failed), e.Failed[0], e.Errs[0])
+}
+
+// Unwrap returns the errors refusing the rules.
+func (e *BatchError) Unwrap() []error {
+	return e.Errs
+}
+
+// Is reports whether one of the rules was refused for the reason of target,
+// ErrDuplicateRule or ErrInvalidDocument.
+func (e *BatchError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if reason := classify(err); reason != nil && reason == target {
+			return true
+		}
+	}
+	return false
+}
+
+// add records that the rule at position pos was refused with err.
+func (e *BatchError) add(pos int, err error) {
+	e.Failed = append(e.Failed, pos)
+	e.Errs = append(e.Errs, err)
+}
+
+// err returns e if it holds refused rules, and nil otherwise.
+func (e *BatchError) err() error {
+	if len(e.Failed) == 0 {
+		return nil
+	}
+	return e
+}
+
+// insertBatch inserts batch into collection in an unordered write, so that
+// the documents refused by the server do not stop the others from being
+// inserted, and returns the errors refusing them, but the duplicates skipped
+// with SkipDuplicates. It returns an error if the whole write failed.
+func (a *Adapter) insertBatch(ctx context.Context, collection *mongo.Collection, batch []interface{}) ([]mongo.BulkWriteError, error) {
+	_, err := a.retryThrottledBulk(ctx, len(batch), false, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+		docs := atPositions(batch, pos)
+		if a.store != nil {
+			return nil, a.store.insertMany(ctx, docs)
+		}
+		_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+		return nil, err
+	})
+	if err == nil {
+		countDocs(ctx, int64(len(batch)))
+		return nil, nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+		return nil, err
+	}
+	countDocs(ctx, int64(len(batch)-len(bwe.WriteErrors)))
+
+	var refused []mongo.BulkWriteError
+	for _, we := range bwe.WriteErrors {
+		if a.cfg.SkipDuplicates && we.Code == duplicateKey {
+			continue
+		}
+		refused = append(refused, we)
+	}
+	return refused, nil
+}
+
+// AddPolicies adds policy rules to the storage, in unordered batches of
+// BatchSize rules. The rules refused by the server, e.g. by a unique index
+// or by ValidateDocuments, do not stop the others from being stored, and are
+// reported by a *BatchError giving their positions in rules, so that the
+// caller can remove them from its model. A batch failing as a whole, e.g.
+// when the server is unreachable, returns its error instead.
+func (a *Adapter) AddPolicies(sec string, ptype string, rules [][]string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	lines := make([]interface{}, len(rules))
+	for i, rule := range rules {
+		line := a.policyLine(sec, ptype, rule)
+		lines[i] = &line
+	}
+
+	if a.buffered() {
+		for _, line := range lines {
+			if err := a.bufferWrite(mongo.NewInsertOneModel().SetDocument(a.document(*line.(*CasbinRule)))); err != nil {
+				return a.wrapErr("AddPolicies", err)
+			}
+		}
+		return nil
+	}
+
+	ctx, done := a.startOp(context.TODO(), "AddPolicies", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	return a.wrapErr("AddPolicies", a.addPolicies(ctx, lines))
+}
+
+func (a *Adapter) addPolicies(ctx context.Context, lines []interface{}) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if err := a.ensureStorage(); err != nil {
+		return err
+	}
+
+	if err := a.insertMany(ctx, lines); err != nil {
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) && len(batchErr.Failed) < len(lines) {
+			// Some rules were stored.
+			if werr := a.noteWrite(ctx); werr != nil {
+				return werr
+			}
+		}
+		return err
+	}
+	return a.noteWrite(ctx)
+}
+
+// RemovePolicies removes policy rules from the storage, each as RemovePolicy
+// does, in a single unordered bulk write. With StrictRemove, it returns
+// ErrPolicyNotFound when fewer rules than given were removed.
+func (a *Adapter) RemovePolicies(sec string, ptype string, rules [][]string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	if a.cfg.CollectionRouter != nil {
+		return a.wrapErr("RemovePolicies", errRouted)
+	}
+
+	models := make([]mongo.WriteModel, len(rules))
+	for i, rule := range rules {
+		models[i] = a.removeOneModel(a.ruleSelector(ptype, a.normalizeRule(rule)))
+	}
+
+	if a.buffered() {
+		for _, m := range models {
+			if err := a.bufferWrite(m); err != nil {
+				return a.wrapErr("RemovePolicies", err)
+			}
+		}
+		return nil
+	}
+
+	ctx, done := a.startOp(context.TODO(), "RemovePolicies", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	return a.wrapErr("RemovePolicies", a.removePolicies(ctx, models))
+}
+
+func (a *Adapter) removePolicies(ctx context.Context, models []mongo.WriteModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	if err := a.ensureStorage(); err != nil {
+		return err
+	}
+	if err := a.flush(ctx); err != nil {
+		return err
+	}
+
+	defer a.InvalidateCache()
+	res, err := a.retryThrottledBulk(ctx, len(models), false, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+		if a.store != nil {
+			return removeEach(ctx, a.store, atPositions(models, pos))
+		}
+		return a.collection.BulkWrite(ctx, atPositions(models, pos), options.BulkWrite().SetOrdered(false))
+	})
+	if err != nil {
+		return err
+	}
+
+	n := res.DeletedCount + res.ModifiedCount
+	countDocs(ctx, n)
+	if a.cfg.StrictRemove && n < int64(len(models)) {
+		return ErrPolicyNotFound
+	}
+	return a.noteWrite(ctx)
+}
@@ -0,0 +1,198 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// BufferWrites makes AddPolicy, RemovePolicy and RemoveFilteredPolicy queue
+// their writes instead of sending them one by one. The queued writes are sent
+// in order, in ordered bulk writes of at most BatchSize writes, once size
+// operations are pending, or when Flush or Close is called.
+func BufferWrites(size int) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.BufferSize = size
+	}
+}
+
+// CoalesceWrites makes AddPolicy, RemovePolicy and RemoveFilteredPolicy
+// queue their writes as BufferWrites(maxBatch) does, and also sends the
+// queued writes in the background once the oldest of them has waited for
+// maxDelay. Queued writes are sent in order, so adding then removing a rule
+// leaves it removed. Errors of background flushes are passed to the handler
+// set with FlushErrorHandler, or else returned by the next call to Flush or
+// Close.
+func CoalesceWrites(maxBatch int, maxDelay time.Duration) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.BufferSize = maxBatch
+		a.cfg.FlushInterval = maxDelay
+	}
+}
+
+// FlushErrorHandler sets the function called with the error of a failed
+// background flush, see CoalesceWrites. It is called from the flushing
+// goroutine.
+func FlushErrorHandler(handler func(error)) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.FlushErrorHandler = handler
+	}
+}
+
+// buffered reports whether writes are queued rather than sent immediately.
+func (a *Adapter) buffered() bool {
+	return a.cfg.BufferSize > 0
+}
+
+// bufferWrite queues a write and flushes the buffer once it is full.
+func (a *Adapter) bufferWrite(m mongo.WriteModel) error {
+	a.bufferMu.Lock()
+	a.pending = append(a.pending, m)
+	full := len(a.pending) >= a.cfg.BufferSize
+	if !full && a.flushTimer == nil && a.cfg.FlushInterval > 0 {
+		a.flushTimer = time.AfterFunc(a.cfg.FlushInterval, a.flushAsync)
+	}
+	a.bufferMu.Unlock()
+
+	if full {
+		return a.flush(context.TODO())
+	}
+	return nil
+}
+
+// discardPending drops all queued writes without sending them.
+func (a *Adapter) discardPending() {
+	a.bufferMu.Lock()
+	a.pending = nil
+	a.stopFlushTimer()
+	a.bufferMu.Unlock()
+}
+
+// stopFlushTimer cancels the pending background flush, if any. bufferMu must
+// be held.
+func (a *Adapter) stopFlushTimer() {
+	if a.flushTimer != nil {
+		a.flushTimer.Stop()
+		a.flushTimer = nil
+	}
+}
+
+// flushAsync sends the queued writes in the background, reporting a failure
+// to the FlushErrorHandler or keeping it for the next Flush or Close.
+func (a *Adapter) flushAsync() {
+	err := a.flush(context.TODO())
+	if err == nil {
+		return
+	}
+	err = a.wrapErr("Flush", err)
+	if a.cfg.FlushErrorHandler != nil {
+		a.cfg.FlushErrorHandler(err)
+		return
+	}
+
+	a.bufferMu.Lock()
+	if a.asyncErr == nil {
+		a.asyncErr = err
+	}
+	a.bufferMu.Unlock()
+}
+
+// takeAsyncErr returns and clears the error kept from a failed background
+// flush.
+func (a *Adapter) takeAsyncErr() error {
+	a.bufferMu.Lock()
+	defer a.bufferMu.Unlock()
+
+	err := a.asyncErr
+	a.asyncErr = nil
+	return err
+}
+
+// Flush sends all queued writes to the database in ordered bulk writes of at
+// most BatchSize writes. If one fails, Flush stops and returns its error: the
+// writes it may have applied are dropped from the buffer, while those not
+// sent, following the failed write, stay queued for the next flush. If they
+// are sent successfully, Flush returns the error of an earlier background
+// flush not passed to a FlushErrorHandler, if any.
+func (a *Adapter) Flush(ctx context.Context) error {
+	if err := a.flush(ctx); err != nil {
+		return a.wrapErr("Flush", err)
+	}
+	return a.takeAsyncErr()
+}
+
+func (a *Adapter) flush(ctx context.Context) error {
+	a.bufferMu.Lock()
+	defer a.bufferMu.Unlock()
+
+	a.stopFlushTimer()
+	if len(a.pending) == 0 {
+		return nil
+	}
+
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return err
+	}
+
+	pending := a.pending
+	a.pending = nil
+	defer a.InvalidateCache()
+
+	size := a.writeBatchSize()
+
+	for start := 0; start < len(pending); start += size {
+		end := start + size
+		if end > len(pending) {
+			end = len(pending)
+		}
+		batch := pending[start:end]
+
+		res, err := a.retryThrottledBulk(ctx, len(batch), true, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			return a.collection.BulkWrite(ctx, atPositions(batch, pos))
+		})
+		countDocs(ctx, res.InsertedCount+res.ModifiedCount+res.DeletedCount)
+		if err != nil {
+			a.pending = unsent(pending, start, end, err)
+			return err
+		}
+	}
+	return a.noteWrite(ctx)
+}
+
+// unsent returns the writes of pending not sent when the ordered bulk write
+// of pending[start:end] failed with err: the following bulk writes and, if
+// the server refused one of its writes, the writes after it.
+func unsent(pending []mongo.WriteModel, start, end int, err error) []mongo.WriteModel {
+	next := end
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+		for _, we := range bwe.WriteErrors {
+			if start+we.Index+1 < next {
+				next = start + we.Index + 1
+			}
+		}
+	}
+	if next == len(pending) {
+		return nil
+	}
+	return append([]mongo.WriteModel(nil), pending[next:]...)
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"time"
+)
+
+// policySnapshot is a cached copy of the whole policy.
+type policySnapshot struct {
+	lines    []CasbinRule
+	revision int64
+	loadedAt time.Time
+}
+
+// CacheTTL makes LoadPolicy serve the policy from an in-memory copy of the
+// last full load made less than ttl ago, instead of querying the database.
+// Any write made through the adapter drops the copy; writes made by other
+// processes are only seen once it expires, or after InvalidateCache.
+// Filtered loads are never cached.
+func CacheTTL(ttl time.Duration) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.CacheTTL = ttl
+	}
+}
+
+// InvalidateCache drops the cached policy, so that the next LoadPolicy
+// queries the database, e.g. after a watcher reported a change made by
+// another process.
+func (a *Adapter) InvalidateCache() {
+	a.cacheMu.Lock()
+	a.cache = nil
+	a.cacheGen++
+	a.cacheMu.Unlock()
+}
+
+// cacheGeneration returns the number of invalidations so far, to be passed
+// to cachePolicy.
+func (a *Adapter) cacheGeneration() uint64 {
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+	return a.cacheGen
+}
+
+// cachePolicy caches lines, loaded after generation gen was read, unless
+// the cache was invalidated since, as lines may then be stale.
+func (a *Adapter) cachePolicy(gen uint64, lines []CasbinRule) {
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	if gen != a.cacheGen {
+		return
+	}
+	a.cache = &policySnapshot{lines: lines, revision: a.currentRevision(), loadedAt: time.Now()}
+}
+
+// cachedPolicy returns the cached policy if it has not expired, and restores
+// the revision it was loaded at.
+func (a *Adapter) cachedPolicy() ([]CasbinRule, bool) {
+	if a.cfg.CacheTTL <= 0 {
+		return nil, false
+	}
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	if a.cache == nil || time.Since(a.cache.loadedAt) >= a.cfg.CacheTTL {
+		return nil, false
+	}
+	a.setRevision(a.cache.revision)
+	return a.cache.lines, true
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// namespaceExists is the error code of a create command for a collection
+// that already exists.
+const namespaceExists = 48
+
+// ReadCollections makes LoadPolicy and LoadFilteredPolicy load the union of
+// the rules stored in the given collections of the database, instead of the
+// policy collection only. A name may be a glob pattern as understood by
+// path.Match, e.g. "casbin_rule_*", matched against the collections existing
+// at load time. Writes still go to the policy collection, which is only read
+// if listed, unless CollectionRouter is set.
+func ReadCollections(names ...string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ReadCollections = names
+	}
+}
+
+// readCollections returns the collections policy is loaded from, without
+// duplicates, in the order of ReadCollections and of their names for a
+// pattern.
+func (a *Adapter) readCollections(ctx context.Context) ([]*mongo.Collection, error) {
+	if len(a.cfg.ReadCollections) == 0 {
+		return []*mongo.Collection{a.collection}, nil
+	}
+
+	db := a.collection.Database()
+	var existing []string
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, pattern := range a.cfg.ReadCollections {
+		if !strings.ContainsAny(pattern, "*?[\\") {
+			if !seen[pattern] {
+				seen[pattern] = true
+				names = append(names, pattern)
+			}
+			continue
+		}
+
+		if existing == nil {
+			var err error
+			if existing, err = db.ListCollectionNames(ctx, bson.D{}); err != nil {
+				return nil, err
+			}
+			sort.Strings(existing)
+		}
+		for _, name := range existing {
+			if ok, err := path.Match(pattern, name); err != nil {
+				return nil, err
+			} else if ok && !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+
+	collections := make([]*mongo.Collection, 0, len(names))
+	for _, name := range names {
+		collections = append(collections, a.collectionIn(db, name))
+	}
+	return collections, nil
+}
+
+// EnsureCollection creates the policy collection with opts, e.g. with a
+// validator, if it does not exist yet, and does nothing otherwise: the
+// options of an existing collection are left unchanged. Since the first
+// write of the adapter creates the collection with the default options,
+// along with its indexes, call EnsureCollection before writing any rule.
+func (a *Adapter) EnsureCollection(ctx context.Context, opts *options.CreateCollectionOptionsBuilder) error {
+	if err := a.ensureOpen(); err != nil {
+		return a.wrapErr("EnsureCollection", err)
+	}
+	_, err := a.ensureCollection(ctx, a.collection, opts)
+	return a.wrapErr("EnsureCollection", err)
+}
+
+// ensureCollection creates collection with opts if it does not exist yet,
+// and reports whether it did.
+func (a *Adapter) ensureCollection(ctx context.Context, collection *mongo.Collection, opts *options.CreateCollectionOptionsBuilder) (bool, error) {
+	db := collection.Database()
+	name := collection.Name()
+
+	var names []string
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		names, err = db.ListCollectionNames(ctx, bson.D{{Key: "name", Value: name}})
+		return err
+	})
+	if err != nil || len(names) > 0 {
+		return false, err
+	}
+
+	if opts == nil {
+		opts = options.CreateCollection()
+	}
+	err = a.retryThrottled(ctx, func(ctx context.Context) error {
+		return db.CreateCollection(ctx, name, opts)
+	})
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(namespaceExists) {
+		// Another client created it meanwhile.
+		return false, nil
+	}
+	return err == nil, err
+}
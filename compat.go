@@ -0,0 +1,242 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// DocumentDBCompat restricts the adapter to the subset of the MongoDB API
+// supported by Amazon DocumentDB:
+//   - retryable writes are disabled on the client built by the adapter,
+//   - SavePolicy empties the collection with a delete instead of dropping it,
+//   - no collation or other unsupported index options are used,
+//   - features relying on change streams are refused.
+func DocumentDBCompat(compat bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.DocumentDBCompat = compat
+	}
+}
+
+// dropsCollection reports whether SavePolicy may drop the collection rather
+// than deleting its documents, which would lose its validator with
+// ValidateDocuments.
+func (a *Adapter) dropsCollection() bool {
+	return !a.cfg.DocumentDBCompat && a.cfg.Tenant == "" && len(a.cfg.ShardKey) == 0 && !a.cfg.ValidateDocuments
+}
+
+// checkChangeStreams returns an error if change streams cannot be used with
+// the configured server.
+func (a *Adapter) checkChangeStreams() error {
+	if a.cfg.DocumentDBCompat {
+		return errors.New("change streams are not supported on DocumentDB")
+	}
+	return nil
+}
+
+const (
+	// cosmosBatchSize is the number of documents written per request in
+	// CosmosDBCompat mode.
+	cosmosBatchSize = 100
+	// cosmosMaxRetries is the number of times a throttled request is retried.
+	cosmosMaxRetries = 10
+	// cosmosThrottledCode is the error code returned by Cosmos DB when the
+	// request rate is too large.
+	cosmosThrottledCode = 16500
+)
+
+// retryAfterPattern extracts the retry hint from a Cosmos DB throttling
+// error message.
+var retryAfterPattern = regexp.MustCompile(`RetryAfterMs=(\d+)`)
+
+// CosmosDBCompat adapts the adapter to the Azure Cosmos DB API for MongoDB:
+//   - requests rejected because the request rate is too large (error 16500)
+//     are retried, after the delay hinted by the server or with exponential
+//     backoff; of a bulk write, only the writes throttled are sent again,
+//   - bulk writes are split into batches of at most 100 documents,
+//   - SavePolicy always uses the plain drop and insert path, as Cosmos DB
+//     lacks multi-document transactions.
+func CosmosDBCompat(compat bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.CosmosDBCompat = compat
+	}
+}
+
+// throttleDelay reports whether err means that Cosmos DB throttled the
+// whole request, and how long to wait before the given retry attempt. The
+// write errors of a bulk write are not, as the other writes of the request
+// may have been applied, see retryThrottledBulk.
+func throttleDelay(err error, attempt int) (time.Duration, bool) {
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) {
+		return 0, false
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) || !(se.HasErrorCode(cosmosThrottledCode) || se.HasErrorCode(http.StatusTooManyRequests)) {
+		return 0, false
+	}
+	return retryDelay(err.Error(), attempt), true
+}
+
+// throttledCode reports whether code is that of a request throttled by
+// Cosmos DB.
+func throttledCode(code int) bool {
+	return code == cosmosThrottledCode || code == http.StatusTooManyRequests
+}
+
+// retryDelay returns the delay hinted by the throttling error message, or
+// the backoff of the given retry attempt.
+func retryDelay(message string, attempt int) time.Duration {
+	if m := retryAfterPattern.FindStringSubmatch(message); m != nil {
+		if ms, err := strconv.Atoi(m[1]); err == nil {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	delay := 100 * time.Millisecond << uint(attempt)
+	if delay > 5*time.Second {
+		delay = 5 * time.Second
+	}
+	return delay
+}
+
+// retryThrottled runs op and, in CosmosDBCompat mode, retries it as long as
+// Cosmos DB throttles it, up to cosmosMaxRetries times. Each attempt is given
+// a context derived from ctx and bounded by OperationTimeout.
+func (a *Adapter) retryThrottled(ctx context.Context, op func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		opCtx, cancel := a.opContext(ctx)
+		err := op(opCtx)
+		cancel()
+		if !a.cfg.CosmosDBCompat || attempt >= cosmosMaxRetries {
+			return err
+		}
+
+		delay, throttled := throttleDelay(err, attempt)
+		if !throttled {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryThrottledBulk runs write, a bulk write of n documents or models,
+// ordered or not, with retryThrottled. write is given the positions of the
+// documents or models to send, all of them at first, and its results are
+// summed. In CosmosDBCompat mode, only the writes Cosmos DB throttled are
+// sent again, up to cosmosMaxRetries times, as the others were applied:
+// those of the throttled write errors of an unordered write, or the
+// throttled write and the following ones of an ordered write, which stops at
+// its first error. The other write errors are returned in a
+// mongo.BulkWriteException, with their positions among the n.
+func (a *Adapter) retryThrottledBulk(ctx context.Context, n int, ordered bool, write func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error)) (*mongo.BulkWriteResult, error) {
+	total := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]interface{})}
+	pos := make([]int, n)
+	for i := range pos {
+		pos[i] = i
+	}
+
+	var refused []mongo.BulkWriteError
+	for attempt := 0; ; attempt++ {
+		var res *mongo.BulkWriteResult
+		err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+			res, err = write(ctx, pos)
+			return err
+		})
+		if res != nil {
+			total.InsertedCount += res.InsertedCount
+			total.MatchedCount += res.MatchedCount
+			total.ModifiedCount += res.ModifiedCount
+			total.DeletedCount += res.DeletedCount
+			total.UpsertedCount += res.UpsertedCount
+			for i, id := range res.UpsertedIDs {
+				if i >= 0 && int(i) < len(pos) {
+					i = int64(pos[i])
+				}
+				total.UpsertedIDs[i] = id
+			}
+		}
+
+		if err == nil {
+			if len(refused) > 0 {
+				return total, mongo.BulkWriteException{WriteErrors: refused}
+			}
+			return total, nil
+		}
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) {
+			return total, err
+		}
+
+		retryable := a.cfg.CosmosDBCompat && attempt < cosmosMaxRetries && bwe.WriteConcernError == nil
+		var retry []int
+		var delay time.Duration
+		for _, we := range bwe.WriteErrors {
+			i := we.Index
+			if i >= 0 && i < len(pos) {
+				we.Index = pos[i]
+				if retryable && throttledCode(we.Code) {
+					if ordered {
+						retry = pos[i:]
+					} else {
+						retry = append(retry, pos[i])
+					}
+					delay = retryDelay(we.Message, attempt)
+					continue
+				}
+			}
+			refused = append(refused, we)
+		}
+		if len(retry) == 0 {
+			bwe.WriteErrors = refused
+			return total, bwe
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return total, ctx.Err()
+		case <-timer.C:
+		}
+		pos = retry
+	}
+}
+
+// atPositions returns the items of items at the positions pos.
+func atPositions[T any](items []T, pos []int) []T {
+	if len(pos) == len(items) {
+		return items
+	}
+	out := make([]T, len(pos))
+	for i, p := range pos {
+		out[i] = items[p]
+	}
+	return out
+}
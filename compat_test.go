@@ -0,0 +1,143 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestDocumentDBCompat(t *testing.T) {
+	a := &Adapter{}
+	if opts := a.clientOptions(); opts.RetryWrites != nil {
+		t.Errorf("Expected retryable writes to be left to the driver; got %v", *opts.RetryWrites)
+	}
+	if !a.dropsCollection() {
+		t.Error("Expected SavePolicy to drop the collection by default")
+	}
+	if err := a.checkChangeStreams(); err != nil {
+		t.Errorf("Expected change streams to be allowed by default; got %v", err)
+	}
+
+	DocumentDBCompat(true)(a)
+	if opts := a.clientOptions(); opts.RetryWrites == nil || *opts.RetryWrites {
+		t.Error("Expected retryable writes to be disabled on DocumentDB")
+	}
+	if a.dropsCollection() {
+		t.Error("Expected SavePolicy not to drop the collection on DocumentDB")
+	}
+	if err := a.checkChangeStreams(); err == nil {
+		t.Error("Expected change streams to be refused on DocumentDB")
+	}
+}
+
+func TestCosmosDBThrottling(t *testing.T) {
+	throttled := mongo.CommandError{Code: 16500, Message: "Error=16500, RetryAfterMs=1, Details='Response status code does not indicate success: TooManyRequests (429)'"}
+
+	if delay, ok := throttleDelay(throttled, 0); !ok || delay != time.Millisecond {
+		t.Errorf("throttleDelay() = %v, %v, supposed to be 1ms, true", delay, ok)
+	}
+	if delay, ok := throttleDelay(mongo.CommandError{Code: 16500}, 2); !ok || delay != 400*time.Millisecond {
+		t.Errorf("throttleDelay() = %v, %v, supposed to be 400ms, true", delay, ok)
+	}
+	if _, ok := throttleDelay(mongo.CommandError{Code: 11000}, 0); ok {
+		t.Error("Expected a duplicate key error not to be treated as throttling")
+	}
+
+	run := func(a *Adapter, failures int, failure error) (int, error) {
+		calls := 0
+		err := a.retryThrottled(context.Background(), func(context.Context) error {
+			calls++
+			if calls <= failures {
+				return failure
+			}
+			return nil
+		})
+		return calls, err
+	}
+
+	if calls, err := run(&Adapter{cfg: Config{CosmosDBCompat: true}}, 2, throttled); err != nil || calls != 3 {
+		t.Errorf("Made %d calls with result %v, supposed to be 3 calls and success", calls, err)
+	}
+	if calls, err := run(&Adapter{}, 2, throttled); err == nil || calls != 1 {
+		t.Errorf("Made %d calls with result %v, supposed to be 1 failed call", calls, err)
+	}
+	if calls, err := run(&Adapter{cfg: Config{CosmosDBCompat: true}}, 2, errors.New("boom")); err == nil || calls != 1 {
+		t.Errorf("Made %d calls with result %v, supposed to be 1 failed call", calls, err)
+	}
+	if calls, err := run(&Adapter{cfg: Config{CosmosDBCompat: true}}, cosmosMaxRetries+5, throttled); err == nil || calls != cosmosMaxRetries+1 {
+		t.Errorf("Made %d calls with result %v, supposed to be %d failed calls", calls, err, cosmosMaxRetries+1)
+	}
+}
+
+func TestCosmosDBBulkThrottling(t *testing.T) {
+	writeErr := func(index int, code int) mongo.BulkWriteError {
+		return mongo.BulkWriteError{WriteError: mongo.WriteError{Index: index, Code: code, Message: "RetryAfterMs=1"}}
+	}
+	partial := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(1, 16500)}}
+	if _, ok := throttleDelay(partial, 0); ok {
+		t.Error("Expected a partly applied bulk write not to be retried as a whole")
+	}
+
+	a := &Adapter{cfg: Config{CosmosDBCompat: true}}
+	tests := []struct {
+		ordered bool
+		// results returns the error of each call, the write errors being
+		// relative to the positions sent.
+		results []error
+		sent    [][]int
+		refused []int
+	}{
+		// The throttled write only is sent again, the duplicate is reported
+		// at its position.
+		{false, []error{
+			mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(1, 16500), writeErr(3, 11000)}},
+			nil,
+		}, [][]int{{0, 1, 2, 3, 4}, {1}}, []int{3}},
+		// An ordered write stops at the throttled write, which is sent again
+		// along with the following ones.
+		{true, []error{
+			mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(2, 16500)}},
+			mongo.CommandError{Code: 16500, Message: "RetryAfterMs=1"},
+			mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{writeErr(1, 11000)}},
+		}, [][]int{{0, 1, 2, 3, 4}, {2, 3, 4}, {2, 3, 4}}, []int{3}},
+	}
+	for _, tt := range tests {
+		var sent [][]int
+		_, err := a.retryThrottledBulk(context.Background(), 5, tt.ordered, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			sent = append(sent, append([]int(nil), pos...))
+			return &mongo.BulkWriteResult{}, tt.results[len(sent)-1]
+		})
+		if !reflect.DeepEqual(sent, tt.sent) {
+			t.Errorf("Sent %v, supposed to be %v", sent, tt.sent)
+		}
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) {
+			t.Fatalf("Expected a BulkWriteException; got %v", err)
+		}
+		var refused []int
+		for _, we := range bwe.WriteErrors {
+			refused = append(refused, we.Index)
+		}
+		if !reflect.DeepEqual(refused, tt.refused) {
+			t.Errorf("Refused %v, supposed to be %v", refused, tt.refused)
+		}
+	}
+}
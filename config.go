@@ -0,0 +1,381 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Config holds the settings of an adapter. It is the plain-struct counterpart
+// of the functional options, each of which sets one of its fields, and can be
+// filled from a configuration file and passed to NewAdapterFromConfig.
+type Config struct {
+	// URL is the MongoDB connection string.
+	URL string
+	// DatabaseName is the database holding the policy. It defaults to the
+	// database of URL, or "casbin" if URL has none.
+	DatabaseName string
+	// CollectionName is the collection holding the policy. It defaults to
+	// "casbin_rule".
+	CollectionName string
+	// ConnectTimeout bounds connecting to and selecting a server for clients
+	// built by the adapter. Zero keeps the driver's defaults.
+	ConnectTimeout time.Duration
+	// ShutdownTimeout, see ShutdownTimeout. Zero uses a default of 10
+	// seconds.
+	ShutdownTimeout time.Duration
+	// OperationTimeout, see OperationTimeout. Zero leaves operations bounded
+	// by the caller's context only.
+	OperationTimeout time.Duration
+	// MaxPoolSize, see MaxPoolSize. Zero keeps the driver's default.
+	MaxPoolSize uint64
+	// RetryWrites, see RetryWrites. Nil keeps the driver's default.
+	RetryWrites *bool
+	// Compressors, see Compressors. Empty keeps the driver's default.
+	Compressors []string
+	// AutoEncryption, see AutoEncryption.
+	AutoEncryption *options.AutoEncryptionOptions
+	// EncryptedFields, see AutoEncryption.
+	EncryptedFields []string
+	// IsFiltered marks the adapter as filtered, see Filtered.
+	IsFiltered bool
+	// AllowRawFilters, see RawFilters.
+	AllowRawFilters bool
+	// AppendFilteredLoads, see AppendFilteredLoads.
+	AppendFilteredLoads bool
+	// EnsureIndexes creates the indexes of the policy collection on the
+	// first write of the adapter, see EnsureIndexesOnOpen. Constructors
+	// taking functional options enable it.
+	EnsureIndexes bool
+	// Projection, see Projection.
+	Projection []string
+	// ReadCollections, see ReadCollections.
+	ReadCollections []string
+	// CollectionRouter, see CollectionRouter. Nil stores all the rules in
+	// the policy collection.
+	CollectionRouter func(rule CasbinRule) string
+	// LoadSort, see LoadSort. Nil sorts by _id.
+	LoadSort interface{}
+	// QueryHint, see QueryHintFunc.
+	QueryHint func(fields []string) interface{}
+	// StrictDecode, see StrictDecode.
+	StrictDecode bool
+	// Registry, see Registry. Nil uses the client's registry.
+	Registry *bson.Registry
+	// CacheTTL, see CacheTTL. Zero disables the cache.
+	CacheTTL time.Duration
+	// LazyConnect, see LazyConnect.
+	LazyConnect bool
+	// NoFinalizer, see NoFinalizer.
+	NoFinalizer bool
+	// DocumentDBCompat, see DocumentDBCompat.
+	DocumentDBCompat bool
+	// CosmosDBCompat, see CosmosDBCompat.
+	CosmosDBCompat bool
+	// CaseInsensitive, see CaseInsensitive.
+	CaseInsensitive bool
+	// IndexCollation, see IndexCollation. Nil creates the indexes with the
+	// collation of the collection.
+	IndexCollation *options.Collation
+	// NormalizeValues, see NormalizeValues.
+	NormalizeValues bool
+	// StrictRemove, see StrictRemove.
+	StrictRemove bool
+	// RefuseEmptySave disallows saving an empty policy, see
+	// AllowEmptySave.
+	RefuseEmptySave bool
+	// Tenant, see Tenant.
+	Tenant string
+	// OptimisticConcurrency, see OptimisticConcurrency.
+	OptimisticConcurrency bool
+	// ShardKey, see ShardKey.
+	ShardKey []string
+	// SoftDelete, see SoftDelete.
+	SoftDelete bool
+	// ExpireRules, see ExpireRules.
+	ExpireRules bool
+	// TrackUpdates, see TrackUpdates.
+	TrackUpdates bool
+	// ArraySchema, see ArraySchema.
+	ArraySchema bool
+	// ValidateDocuments, see ValidateDocuments.
+	ValidateDocuments bool
+	// MetadataField, see MetadataField. Empty uses "meta".
+	MetadataField string
+	// SkipDuplicates, see SkipDuplicates.
+	SkipDuplicates bool
+	// SaveMode, see SaveStrategy.
+	SaveMode SaveMode
+	// RequireExistingCollection, see RequireExistingCollection.
+	RequireExistingCollection bool
+	// BatchSize, see BatchSize. Zero uses the default.
+	BatchSize int
+	// BufferSize, see BufferWrites. Zero disables buffering.
+	BufferSize int
+	// FlushInterval, see CoalesceWrites. Zero disables background flushes.
+	FlushInterval time.Duration
+	// FlushErrorHandler, see FlushErrorHandler.
+	FlushErrorHandler func(error)
+	// Logger, see Logger. Nil uses slog.Default().
+	Logger *slog.Logger
+	// SlowOpThreshold, see SlowOpThreshold. Zero disables slow operation
+	// logging.
+	SlowOpThreshold time.Duration
+}
+
+// defaultConfig returns the configuration the constructors taking functional
+// options start from.
+func defaultConfig() Config {
+	return Config{
+		DatabaseName:   defaultDatabase,
+		CollectionName: defaultCollection,
+		EnsureIndexes:  true,
+	}
+}
+
+// Option is an adapter option that can fail, e.g. because it parses a file.
+// Pass it to the constructors with WithOption.
+type Option func(*Adapter) error
+
+// WithOption turns opt into an option accepted by the constructors. The
+// constructors returning an error return the first error of such options,
+// before connecting; the others panic with it.
+func WithOption(opt Option) func(*Adapter) {
+	return func(a *Adapter) {
+		if err := opt(a); err != nil && a.optErr == nil {
+			a.optErr = err
+		}
+	}
+}
+
+// CollectionName sets the name of the collection holding the policy. It
+// defaults to "casbin_rule".
+func CollectionName(name string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.CollectionName = name
+	}
+}
+
+// ConnectTimeout bounds connecting to and selecting a server for clients
+// built by the adapter. It has no effect on a client passed to
+// NewAdapterFromClient.
+func ConnectTimeout(timeout time.Duration) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ConnectTimeout = timeout
+	}
+}
+
+// ShutdownTimeout bounds disconnecting the client built by the adapter on
+// Close, so that an unresponsive server cannot block shutdown. It defaults to
+// 10 seconds.
+func ShutdownTimeout(timeout time.Duration) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ShutdownTimeout = timeout
+	}
+}
+
+// OperationTimeout bounds each query or write the adapter sends to the
+// server, e.g. a Find or a DeleteMany, so that a single slow operation fails
+// with context.DeadlineExceeded even when the caller's context has no
+// deadline. The timeout applies to every call separately, not to the methods
+// of the adapter as a whole, and a shorter deadline of the caller's context
+// still prevails. Iterating over the results of a query, e.g. while loading
+// the policy, is bounded by the caller's context only. It is disabled by
+// default.
+func OperationTimeout(timeout time.Duration) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.OperationTimeout = timeout
+	}
+}
+
+// MaxPoolSize sets the maximum number of connections in the pool of the
+// client built by the adapter, e.g. to allow more concurrent policy loads.
+// It has no effect on a client passed to NewAdapterFromClient.
+func MaxPoolSize(n uint64) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.MaxPoolSize = n
+	}
+}
+
+// RetryWrites enables or disables the retryable writes of the client built by
+// the adapter, so that a write interrupted by a failover is retried once by
+// the driver. It is left to the driver's default when not set, and has no
+// effect on a client passed to NewAdapterFromClient.
+func RetryWrites(retry bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.RetryWrites = &retry
+	}
+}
+
+// Compressors enables the compression of the messages exchanged with the
+// server by the client built by the adapter, e.g. "zstd", "snappy" or
+// "zlib", in order of preference. The first of them the server also supports
+// is used, e.g. to cut the traffic of policy loads across regions. It has no
+// effect on a client passed to NewAdapterFromClient, whose compressors are
+// set with options.Client().SetCompressors.
+func Compressors(names ...string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.Compressors = names
+	}
+}
+
+// EnsureIndexesOnOpen controls whether the indexes of the policy collection
+// are created. It is enabled by default. They are created on the first write
+// of the adapter, e.g. AddPolicy or SavePolicy, rather than when it is
+// opened, so that an adapter only loading the policy, e.g. from a read-only
+// replica, never creates them. The first write after SavePolicy drops the
+// collection creates them again. If the adapter's user is not allowed to
+// create indexes, a warning is logged and the write proceeds without them;
+// disable it to skip the attempt.
+//
+// Servers before MongoDB 4.2 refuse to store a rule with an indexed value
+// longer than about 1000 bytes, and the write fails with ErrValueTooLong. To
+// store such values there, e.g. long subjects, disable it and drop the
+// indexes with DropIndexes.
+func EnsureIndexesOnOpen(ensure bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.EnsureIndexes = ensure
+	}
+}
+
+// NewAdapterFromConfig creates a new adapter from cfg. Unlike NewAdapter, it
+// returns an error rather than panicking when cfg is invalid or the database
+// cannot be reached.
+func NewAdapterFromConfig(cfg Config) (*Adapter, error) {
+	if err := validateURL(cfg.URL); err != nil {
+		return nil, &OpError{Op: "NewAdapter", Collection: defaultCollection, Err: err}
+	}
+	if cfg.DatabaseName == "" {
+		cfg.DatabaseName = parseDatabase(cfg.URL)
+	}
+	if cfg.CollectionName == "" {
+		cfg.CollectionName = defaultCollection
+	}
+
+	return newAdapter(options.Client().ApplyURI(cfg.URL), cfg)
+}
+
+// validateURL checks that url is a MongoDB connection string, so that a
+// misconfigured URL is reported before the driver tries to use it.
+func validateURL(url string) error {
+	if url == "" {
+		return ErrEmptyURL
+	}
+	if !strings.HasPrefix(url, "mongodb://") && !strings.HasPrefix(url, "mongodb+srv://") {
+		return errors.New("invalid connection URL: scheme must be mongodb:// or mongodb+srv://")
+	}
+	return nil
+}
+
+// validate reports the first invalid or conflicting setting of c.
+func (c *Config) validate() error {
+	if c.DatabaseName == "" || len(c.DatabaseName) > 63 || strings.ContainsAny(c.DatabaseName, "/\\. \"$*<>:|?\x00") {
+		return fmt.Errorf("invalid database name %q", c.DatabaseName)
+	}
+	if c.CollectionName == "" || strings.ContainsAny(c.CollectionName, "$\x00") || strings.HasPrefix(c.CollectionName, "system.") {
+		return fmt.Errorf("invalid collection name %q", c.CollectionName)
+	}
+	if c.ConnectTimeout < 0 {
+		return fmt.Errorf("invalid connect timeout %v", c.ConnectTimeout)
+	}
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid shutdown timeout %v", c.ShutdownTimeout)
+	}
+	if c.OperationTimeout < 0 {
+		return fmt.Errorf("invalid operation timeout %v", c.OperationTimeout)
+	}
+	if c.SlowOpThreshold < 0 {
+		return fmt.Errorf("invalid slow operation threshold %v", c.SlowOpThreshold)
+	}
+	if c.CacheTTL < 0 {
+		return fmt.Errorf("invalid cache TTL %v", c.CacheTTL)
+	}
+	if c.BatchSize < 0 {
+		return fmt.Errorf("invalid batch size %d", c.BatchSize)
+	}
+	if c.BufferSize < 0 {
+		return fmt.Errorf("invalid buffer size %d", c.BufferSize)
+	}
+	if c.FlushInterval < 0 {
+		return fmt.Errorf("invalid flush interval %v", c.FlushInterval)
+	}
+	if c.FlushInterval > 0 && c.BufferSize == 0 {
+		return errors.New("a flush interval requires a buffer size")
+	}
+	if err := validateEncryptedFields(c.EncryptedFields); err != nil {
+		return err
+	}
+	if len(c.EncryptedFields) > 0 && (c.CaseInsensitive || c.IndexCollation != nil) {
+		return errors.New("CaseInsensitive and IndexCollation are not supported with encrypted fields")
+	}
+	if err := validateShardKey(c.ShardKey); err != nil {
+		return err
+	}
+	if err := validateMetadataField(c.MetadataField); err != nil {
+		return err
+	}
+	if c.ArraySchema {
+		if len(c.EncryptedFields) > 0 || len(c.Projection) > 0 {
+			return errors.New("ArraySchema is not supported with encrypted fields or Projection")
+		}
+		for _, field := range c.ShardKey {
+			if arrayField(field) != field {
+				return fmt.Errorf("shard key field %q is not stored with ArraySchema", field)
+			}
+		}
+	}
+	if c.DocumentDBCompat && c.CosmosDBCompat {
+		return errors.New("DocumentDBCompat and CosmosDBCompat are mutually exclusive")
+	}
+	if c.CosmosDBCompat && c.ExpireRules {
+		return errors.New("ExpireRules is not supported with CosmosDBCompat")
+	}
+	if c.TrackUpdates && (!c.SoftDelete || c.BufferSize > 0) {
+		return errors.New("TrackUpdates requires SoftDelete and is not supported with BufferWrites")
+	}
+	for _, name := range c.Compressors {
+		if name != "snappy" && name != "zlib" && name != "zstd" {
+			return fmt.Errorf("unknown compressor %q", name)
+		}
+	}
+	if c.DocumentDBCompat && c.RetryWrites != nil && *c.RetryWrites {
+		return errors.New("RetryWrites is not supported with DocumentDBCompat")
+	}
+	if c.DocumentDBCompat && (c.CaseInsensitive || c.IndexCollation != nil) {
+		return errors.New("CaseInsensitive and IndexCollation are not supported with DocumentDBCompat")
+	}
+	if c.IndexCollation != nil && c.IndexCollation.Locale == "" {
+		return errors.New("an index collation requires a locale")
+	}
+	if err := c.validateSaveMode(); err != nil {
+		return err
+	}
+	if c.CollectionRouter != nil {
+		if len(c.ReadCollections) == 0 {
+			return errors.New("CollectionRouter requires ReadCollections")
+		}
+		if c.BufferSize > 0 || c.SaveMode == SaveViaStaging || c.SaveMode == SaveDiff {
+			return errors.New("CollectionRouter is not supported with BufferWrites, SaveViaStaging or SaveDiff")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestConfigValidate(t *testing.T) {
+	invalid := []func(*Config){
+		func(c *Config) { c.DatabaseName = "" },
+		func(c *Config) { c.DatabaseName = "cas.bin" },
+		func(c *Config) { c.DatabaseName = "cas bin" },
+		func(c *Config) { c.CollectionName = "" },
+		func(c *Config) { c.CollectionName = "casbin$rule" },
+		func(c *Config) { c.CollectionName = "system.users" },
+		func(c *Config) { c.ConnectTimeout = -time.Second },
+		func(c *Config) { c.ShutdownTimeout = -time.Second },
+		func(c *Config) { c.OperationTimeout = -time.Second },
+		func(c *Config) { c.SlowOpThreshold = -time.Second },
+		func(c *Config) { c.Compressors = []string{"lz4"} },
+		func(c *Config) { c.CosmosDBCompat, c.ExpireRules = true, true },
+		func(c *Config) { c.TrackUpdates = true },
+		func(c *Config) { c.TrackUpdates, c.SoftDelete, c.BufferSize = true, true, 10 },
+		func(c *Config) { c.IndexCollation = &options.Collation{Strength: 2} },
+		func(c *Config) { c.ArraySchema, c.Projection = true, []string{"v0"} },
+		func(c *Config) { c.MetadataField = "ptype" },
+		func(c *Config) { c.MetadataField = "audit.info" },
+		func(c *Config) { c.ArraySchema, c.ShardKey = true, []string{"ptype", "v0"} },
+		func(c *Config) { c.BatchSize = -1 },
+		func(c *Config) { c.BufferSize = -1 },
+		func(c *Config) { c.FlushInterval = time.Second },
+		func(c *Config) { c.BufferSize, c.FlushInterval = 10, -time.Second },
+		func(c *Config) { c.DocumentDBCompat, c.CosmosDBCompat = true, true },
+		func(c *Config) { c.DocumentDBCompat, c.CaseInsensitive = true, true },
+		func(c *Config) { retry := true; c.DocumentDBCompat, c.RetryWrites = true, &retry },
+	}
+
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Errorf("Expected the default config to be valid; got %v", err)
+	}
+	for i, modify := range invalid {
+		cfg := defaultConfig()
+		modify(&cfg)
+		if err := cfg.validate(); err == nil {
+			t.Errorf("Expected config %d to be invalid: %+v", i, cfg)
+		}
+	}
+}
+
+func TestNewAdapterFromConfig(t *testing.T) {
+	if _, err := NewAdapterFromConfig(Config{}); err == nil {
+		t.Error("Expected NewAdapterFromConfig() to fail without a URL")
+	}
+	if _, err := NewAdapterFromConfig(Config{URL: getDbURL(), DatabaseName: "bad/name"}); err == nil {
+		t.Error("Expected NewAdapterFromConfig() to fail with an invalid database name")
+	}
+
+	requireMongoDB(t)
+	a, err := NewAdapterFromConfig(Config{
+		URL:            getDbURL(),
+		DatabaseName:   getDbName(),
+		ConnectTimeout: 5 * time.Second,
+		EnsureIndexes:  true,
+	})
+	if err != nil {
+		t.Fatalf("Expected NewAdapterFromConfig() to be successful; got %v", err)
+	}
+	defer a.Close()
+
+	if name := a.collectionName(); name != getDbName()+".casbin_rule" {
+		t.Errorf("Expected the policy to be stored in %s.casbin_rule; got %s", getDbName(), name)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := e.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+}
+
+func TestMaxPoolSize(t *testing.T) {
+	a := &Adapter{}
+	if opts := a.clientOptions(); opts.MaxPoolSize != nil {
+		t.Errorf("Expected the pool size to be left to the driver; got %d", *opts.MaxPoolSize)
+	}
+
+	MaxPoolSize(200)(a)
+	if opts := a.clientOptions(); opts.MaxPoolSize == nil || *opts.MaxPoolSize != 200 {
+		t.Error("Expected the pool size to be 200")
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	a := &Adapter{}
+	if opts := a.clientOptions(); opts.Compressors != nil {
+		t.Errorf("Expected compression to be left to the driver; got %v", opts.Compressors)
+	}
+
+	Compressors("zstd", "snappy")(a)
+	if opts := a.clientOptions(); !reflect.DeepEqual(opts.Compressors, []string{"zstd", "snappy"}) {
+		t.Errorf("Compressors: %v, supposed to be [zstd snappy]", opts.Compressors)
+	}
+	if _, err := NewAdapterWithError(getDbURL(), DBName(getDbName()), Compressors("lz4")); err == nil {
+		t.Error("Expected an unknown compressor to be refused")
+	}
+
+	requireMongoDB(t)
+	a, err := NewAdapterWithError(getDbURL(), DBName(getDbName()), Compressors("zstd"))
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithError() to be successful; got %v", err)
+	}
+	defer a.Close()
+	// The server counts the compressed messages it receives.
+	compressed := func() int64 {
+		var status struct {
+			Network struct {
+				Compression map[string]struct {
+					Decompressor struct {
+						BytesIn int64 `bson:"bytesIn"`
+					} `bson:"decompressor"`
+				} `bson:"compression"`
+			} `bson:"network"`
+		}
+		cmd := bson.D{{Key: "serverStatus", Value: 1}}
+		if err := a.client.Database("admin").RunCommand(context.Background(), cmd).Decode(&status); err != nil {
+			t.Fatalf("Expected serverStatus to be successful; got %v", err)
+		}
+		return status.Network.Compression["zstd"].Decompressor.BytesIn
+	}
+	before := compressed()
+	newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if after := compressed(); after <= before {
+		t.Errorf("Expected zstd to be negotiated; compressed bytes received went from %d to %d", before, after)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+	if !a.dropsCollection() {
+		t.Error("Expected SavePolicy to drop the collection by default")
+	}
+
+	ShardKey("ptype", "v0")(a)
+	if err := a.cfg.validate(); err != nil {
+		t.Errorf("Expected the shard key to be valid; got %v", err)
+	}
+	if a.dropsCollection() {
+		t.Error("Expected SavePolicy not to drop a sharded collection")
+	}
+
+	for _, key := range [][]string{{"ptype", "_id"}, {"v0", "v0"}} {
+		ShardKey(key...)(a)
+		if err := a.cfg.validate(); err == nil {
+			t.Errorf("Expected shard key %v to be invalid", key)
+		}
+	}
+}
+
+func TestAutoEncryption(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+	kmsProviders := map[string]map[string]interface{}{
+		"local": {"key": make([]byte, 96)},
+	}
+	autoEncryption := options.AutoEncryption().
+		SetKeyVaultNamespace("encryption.__keyVault").
+		SetKmsProviders(kmsProviders).
+		SetBypassAutoEncryption(true)
+
+	AutoEncryption(autoEncryption, "v0", "v1")(a)
+	if err := a.cfg.validate(); err != nil {
+		t.Errorf("Expected the encryption settings to be valid; got %v", err)
+	}
+	if opts := a.clientOptions(); opts.AutoEncryptionOptions != autoEncryption {
+		t.Error("Expected auto encryption to be enabled on the client")
+	}
+	if fields := a.indexFields(); len(fields) != len(indexedFields)-2 || fields[1] != "v2" {
+		t.Errorf("Indexed fields: %v, supposed to leave out v0 and v1", fields)
+	}
+
+	// The validator accepts the encrypted values, stored as binary data.
+	ValidateDocuments(true)(a)
+	if err := a.cfg.validate(); err != nil {
+		t.Errorf("Expected ValidateDocuments to be valid with encrypted fields; got %v", err)
+	}
+	properties := a.policyValidator()[0].Value.(bson.D)[2].Value.(bson.D)
+	for _, p := range properties {
+		_, both := p.Value.(bson.D)[0].Value.(bson.A)
+		if want := p.Key == "v0" || p.Key == "v1"; both != want {
+			t.Errorf("Validator of %s: %v, binary data supposed to be allowed: %v", p.Key, p.Value, want)
+		}
+	}
+	ValidateDocuments(false)(a)
+
+	CaseInsensitive(true)(a)
+	if err := a.cfg.validate(); err == nil {
+		t.Error("Expected CaseInsensitive to be refused with encrypted fields")
+	}
+	CaseInsensitive(false)(a)
+	AutoEncryption(autoEncryption, "ptype")(a)
+	if err := a.cfg.validate(); err == nil {
+		t.Error("Expected ptype not to be allowed as an encrypted field")
+	}
+}
+
+func TestWithOption(t *testing.T) {
+	errFirst := errors.New("first")
+	fail := func(err error) Option {
+		return func(*Adapter) error { return err }
+	}
+	_, err := NewAdapterWithError("mongodb://127.0.0.1:1", WithOption(fail(errFirst)), WithOption(fail(errors.New("second"))))
+	if !errors.Is(err, errFirst) {
+		t.Errorf("Expected NewAdapterWithError() to fail with the first option error; got %v", err)
+	}
+
+	a, err := NewAdapterWithError("mongodb://127.0.0.1:1", LazyConnect(true), WithOption(func(a *Adapter) error {
+		a.cfg.BatchSize = 7
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithError() to be successful; got %v", err)
+	}
+	if a.cfg.BatchSize != 7 {
+		t.Errorf("Batch size: %d, supposed to be 7", a.cfg.BatchSize)
+	}
+}
+
+func TestRetryWrites(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+	if opts := a.clientOptions(); opts.RetryWrites != nil {
+		t.Errorf("Expected retryable writes to be left to the driver; got %v", *opts.RetryWrites)
+	}
+	RetryWrites(true)(a)
+	if opts := a.clientOptions(); opts.RetryWrites == nil || !*opts.RetryWrites {
+		t.Error("Expected retryable writes to be enabled")
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+	ctx, cancel := a.opContext(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Expected no deadline without OperationTimeout")
+	}
+	cancel()
+
+	OperationTimeout(time.Nanosecond)(a)
+	err := a.retryThrottled(context.Background(), func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the operation to time out; got %v", err)
+	}
+
+	// A shorter deadline of the caller prevails.
+	OperationTimeout(time.Hour)(a)
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelParent()
+	ctx, cancel = a.opContext(parent)
+	defer cancel()
+	want, _ := parent.Deadline()
+	if got, _ := ctx.Deadline(); !got.Equal(want) {
+		t.Errorf("Deadline: %v, supposed to be %v", got, want)
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// CopyOptions controls CopyTo.
+type CopyOptions struct {
+	// Client is the client of the target collection, e.g. connected to
+	// another cluster. The client of the adapter is used if nil.
+	Client *mongo.Client
+	// Overwrite deletes the documents of the target collection before
+	// copying instead of refusing to copy into a non-empty collection.
+	Overwrite bool
+}
+
+// CopyTo copies the documents of the policy collection, those of the tenant
+// with Tenant, into the collection targetCollection of the database
+// targetDB, e.g. to snapshot the policy before a migration or to refresh a
+// staging environment, and returns the number of documents copied. The
+// documents are copied as stored, soft-deleted and expired rules, _id and
+// metadata included, and inserted in batches as with SavePolicy, along with
+// the indexes of the policy collection. It fails with ErrNotEmpty if the
+// target already holds documents, of the tenant with Tenant, unless
+// opts.Overwrite is set. Only the policy collection is copied, not the
+// collections of ReadCollections or CollectionRouter.
+func (a *Adapter) CopyTo(ctx context.Context, targetDB string, targetCollection string, opts CopyOptions) (int64, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(ctx, "CopyTo", nil)
+	defer done()
+
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("CopyTo", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		return 0, a.wrapErr("CopyTo", err)
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = a.client
+	}
+	if client == a.client && targetDB == a.collection.Database().Name() && targetCollection == a.collection.Name() {
+		return 0, a.wrapErr("CopyTo", errors.New("cannot copy the policy collection onto itself"))
+	}
+
+	n, err := a.copyTo(ctx, a.collectionIn(client.Database(targetDB), targetCollection), opts.Overwrite)
+	return n, a.wrapErr("CopyTo", err)
+}
+
+func (a *Adapter) copyTo(ctx context.Context, target *mongo.Collection, overwrite bool) (int64, error) {
+	filter := a.tenantFilter(bson.D{})
+
+	if overwrite {
+		err := a.retryThrottled(ctx, func(ctx context.Context) error {
+			_, err := target.DeleteMany(ctx, filter)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		var n int64
+		err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+			n, err = target.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if n > 0 {
+			return 0, ErrNotEmpty
+		}
+	}
+
+	indexes, err := a.indexSpecs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(indexes) > 0 {
+		err := a.retryThrottled(ctx, func(ctx context.Context) error {
+			return target.Database().RunCommand(ctx, bson.D{
+				{Key: "createIndexes", Value: target.Name()},
+				{Key: "indexes", Value: indexes},
+			}).Err()
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var cur *mongo.Cursor
+	err = a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+
+	var copied int64
+	var batch []interface{}
+	write := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := a.retryThrottledBulk(ctx, len(batch), true, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			_, err := target.InsertMany(ctx, atPositions(batch, pos))
+			return nil, err
+		})
+		if err != nil {
+			return err
+		}
+		copied += int64(len(batch))
+		countDocs(ctx, int64(len(batch)))
+		batch = batch[:0]
+		return nil
+	}
+
+	size := a.writeBatchSize()
+	for cur.Next(ctx) {
+		// The cursor reuses its buffer, so each document is copied.
+		batch = append(batch, bson.Raw(append([]byte(nil), cur.Current...)))
+		if len(batch) == size {
+			if err := write(); err != nil {
+				return copied, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return copied, err
+	}
+	return copied, write()
+}
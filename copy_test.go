@@ -0,0 +1,54 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCopyTo(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := newTestAdapter()
+	defer a.Close()
+
+	if _, err := a.CopyTo(ctx, getDbName(), "casbin_rule", CopyOptions{}); err == nil {
+		t.Error("Expected CopyTo() to refuse copying the policy collection onto itself")
+	}
+
+	target := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_copy"))
+	defer target.Close()
+	defer target.collection.Drop(ctx)
+	if err := target.collection.Drop(ctx); err != nil {
+		t.Fatalf("Expected dropping the target to be successful; got %v", err)
+	}
+
+	if n, err := a.CopyTo(ctx, getDbName(), "casbin_rule_copy", CopyOptions{}); err != nil || n != 5 {
+		t.Fatalf("Expected CopyTo() to copy 5 rules; got %d (%v)", n, err)
+	}
+	if _, err := a.CopyTo(ctx, getDbName(), "casbin_rule_copy", CopyOptions{}); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("Expected CopyTo() to fail with ErrNotEmpty; got %v", err)
+	}
+	if n, err := a.CopyTo(ctx, getDbName(), "casbin_rule_copy", CopyOptions{Overwrite: true}); err != nil || n != 5 {
+		t.Errorf("Expected CopyTo() to overwrite the target with 5 rules; got %d (%v)", n, err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", target)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// ExportPolicy writes the stored rules matching filter to w in the CSV format
+// of casbin's file adapter, e.g. "p, alice, data1, read", one rule per line
+// in _id order. The rules are streamed from the database rather than loaded
+// at once. A nil filter matches all rules; other filters are checked as by
+// LoadFilteredPolicy, see RawFilters.
+func (a *Adapter) ExportPolicy(ctx context.Context, w io.Writer, filter interface{}) error {
+	return a.wrapErr("ExportPolicy", a.exportPolicy(ctx, w, filter))
+}
+
+// ExportCSV writes all the stored rules to w as ExportPolicy does, e.g. to
+// back up the policy or to load it with casbin's file adapter.
+func (a *Adapter) ExportCSV(ctx context.Context, w io.Writer) error {
+	return a.wrapErr("ExportCSV", a.exportPolicy(ctx, w, nil))
+}
+
+func (a *Adapter) exportPolicy(ctx context.Context, w io.Writer, filter interface{}) error {
+	if filter == nil {
+		filter = bson.D{}
+	} else if err := a.checkFilter(filter); err != nil {
+		return err
+	}
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+
+	findOpts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	if collation := a.collation(); collation != nil {
+		findOpts.SetCollation(collation)
+	}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, a.liveFilter(filter), findOpts)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+
+	bw := bufio.NewWriter(w)
+	for cur.Next(ctx) {
+		var line CasbinRule
+		if err := cur.Decode(&line); err != nil {
+			return err
+		}
+		line = a.normalizeLine(line)
+		if _, err := bw.WriteString(csvLine(append([]string{line.PType}, line.tokens()...)) + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// csvLine joins values into a line readable by persist.LoadPolicyLine,
+// quoting the values that would not read back unchanged otherwise.
+func csvLine(values []string) string {
+	fields := make([]string, len(values))
+	for i, v := range values {
+		if csvNeedsQuotes(v, i == 0) {
+			v = `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+		}
+		fields[i] = v
+	}
+	return strings.Join(fields, ", ")
+}
+
+// csvNeedsQuotes reports whether v must be quoted in a CSV line. A leading
+// '#' only matters in the first field, where it would start a comment.
+func csvNeedsQuotes(v string, first bool) bool {
+	if v == "" {
+		return false
+	}
+	if strings.ContainsAny(v, ",\"\r\n") {
+		return true
+	}
+	if v[0] == ' ' || v[0] == '\t' {
+		return true
+	}
+	return first && v[0] == '#'
+}
+
+// ImportMode selects how ImportPolicy combines the imported rules with the
+// stored ones.
+type ImportMode int
+
+const (
+	// ImportReplace replaces the stored rules with the imported ones, as
+	// SavePolicy does.
+	ImportReplace ImportMode = iota
+	// ImportMerge adds the imported rules that are not stored yet, looked up
+	// as HasPolicy does. It is not supported with CollectionRouter.
+	ImportMerge
+	// ImportSeedIfEmpty adds the imported rules only if no rule is stored,
+	// e.g. to provision a new environment on first boot.
+	ImportSeedIfEmpty
+	// ImportAppend inserts all the imported rules in batches, without
+	// checking whether they are stored already. It is the fastest mode, e.g.
+	// to migrate a large policy into an empty collection.
+	ImportAppend
+)
+
+// ImportPolicy reads rules in the CSV format of casbin's file adapter from r,
+// skipping blank lines and comments, and stores them according to mode.
+// Nothing is written if r cannot be parsed.
+func (a *Adapter) ImportPolicy(ctx context.Context, r io.Reader, mode ImportMode) error {
+	return a.wrapErr("ImportPolicy", a.importPolicy(ctx, r, mode))
+}
+
+// ImportCSV reads rules in the CSV format of casbin's file adapter from r, as
+// ImportPolicy does, and inserts them in batches with ImportAppend, e.g. to
+// migrate a file-based deployment. Nothing is written if a line cannot be
+// parsed or does not hold a ptype and 1 to 6 values.
+func (a *Adapter) ImportCSV(ctx context.Context, r io.Reader) error {
+	return a.wrapErr("ImportCSV", a.importPolicy(ctx, r, ImportAppend))
+}
+
+func (a *Adapter) importPolicy(ctx context.Context, r io.Reader, mode ImportMode) error {
+	lines, err := a.readPolicyCSV(r)
+	if err != nil {
+		return err
+	}
+
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+
+	switch mode {
+	case ImportReplace:
+		if len(lines) == 0 && a.cfg.RefuseEmptySave {
+			return ErrEmptySave
+		}
+		err = a.replaceAll(ctx, lines)
+	case ImportMerge:
+		if err := a.flush(ctx); err != nil {
+			return err
+		}
+		err = a.insertMissing(ctx, lines)
+	case ImportSeedIfEmpty:
+		if err := a.flush(ctx); err != nil {
+			return err
+		}
+		var n int64
+		err = a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+			n, err = a.collection.CountDocuments(ctx, a.liveFilter(bson.D{}), options.Count().SetLimit(1))
+			return err
+		})
+		if err != nil || n > 0 {
+			return err
+		}
+		err = a.insertMany(ctx, lines)
+	case ImportAppend:
+		if err := a.flush(ctx); err != nil {
+			return err
+		}
+		err = a.insertMany(ctx, lines)
+	default:
+		return fmt.Errorf("unknown import mode %d", mode)
+	}
+	if err != nil {
+		return err
+	}
+	return a.noteWrite(ctx)
+}
+
+// readPolicyCSV parses the rules read from r into documents, dropping
+// duplicated rules.
+func (a *Adapter) readPolicyCSV(r io.Reader) ([]interface{}, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+	cr.FieldsPerRecord = -1
+
+	var lines []interface{}
+	seen := make(map[string]bool)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(record) < 2 || len(record) > 7 || record[0] == "" {
+			line, _ := cr.FieldPos(0)
+			return nil, fmt.Errorf("line %d: invalid rule %q", line, record)
+		}
+
+		key := strings.Join(record, "\x00")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		line := a.policyLine("", record[0], record[1:])
+		lines = append(lines, &line)
+	}
+}
+
+// insertMissing inserts the documents of lines that are not stored yet. A
+// rule is matched as by HasPolicy, so that a rule stored without its
+// trailing empty values is not inserted again.
+func (a *Adapter) insertMissing(ctx context.Context, lines []interface{}) error {
+	if a.cfg.CollectionRouter != nil {
+		return errRouted
+	}
+	defer a.InvalidateCache()
+
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return err
+	}
+	size := a.writeBatchSize()
+	collation := a.collation()
+
+	var firstErr error
+	for start := 0; start < len(lines); start += size {
+		end := start + size
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		models := make([]mongo.WriteModel, 0, end-start)
+		for _, line := range lines[start:end] {
+			rule := *line.(*CasbinRule)
+			insert, err := canonical(a.document(rule))
+			if err != nil {
+				return err
+			}
+			m := mongo.NewUpdateOneModel().
+				SetFilter(a.liveFilter(a.ruleSelector(rule.PType, rule.tokens()))).
+				SetUpdate(bson.D{{Key: "$setOnInsert", Value: insert}}).
+				SetUpsert(true)
+			if collation != nil {
+				m.SetCollation(collation)
+			}
+			models = append(models, m)
+		}
+
+		_, err := a.retryThrottledBulk(ctx, len(models), false, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			return a.collection.BulkWrite(ctx, atPositions(models, pos), options.BulkWrite().SetOrdered(false))
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
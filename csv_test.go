@@ -0,0 +1,204 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+	"github.com/casbin/casbin/v2/util"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestCSVLine(t *testing.T) {
+	tests := [][]string{
+		{"p", "alice", "data1", "read"},
+		{"p", "a, b", `say "hi"`, " padded", "#tag"},
+		{"p", "", "data3", "multi\nline"},
+	}
+	for _, values := range tests {
+		line := csvLine(values)
+		r := csv.NewReader(strings.NewReader(line))
+		r.Comment = '#'
+		r.TrimLeadingSpace = true
+		got, err := r.Read()
+		if err != nil {
+			t.Errorf("Expected %q to be readable; got %v", line, err)
+			continue
+		}
+		if !util.ArrayEquals(got, values) {
+			t.Errorf("Read %q from %q, supposed to be %q", got, line, values)
+		}
+	}
+
+	if line := csvLine([]string{"p", "alice", "data1", "read"}); line != "p, alice, data1, read" {
+		t.Errorf("Line: %q, supposed to be %q", line, "p, alice, data1, read")
+	}
+}
+
+func TestExportPolicy(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	var buf bytes.Buffer
+	if err := a.ExportPolicy(context.Background(), &buf, nil); err != nil {
+		t.Fatalf("Expected ExportPolicy() to be successful; got %v", err)
+	}
+	want := "p, alice, data1, read\n" +
+		"p, bob, data2, write\n" +
+		"p, data2_admin, data2, read\n" +
+		"p, data2_admin, data2, write\n" +
+		"g, alice, data2_admin\n"
+	if buf.String() != want {
+		t.Errorf("Exported %q, supposed to be %q", buf.String(), want)
+	}
+
+	buf.Reset()
+	if err := a.ExportPolicy(context.Background(), &buf, map[string]interface{}{"ptype": "nobody"}); err != nil {
+		t.Errorf("Expected ExportPolicy() to be successful; got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Exported %q, supposed to be empty", buf.String())
+	}
+}
+
+func TestImportPolicy(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+	ctx := context.Background()
+
+	policy := "# Seeded policy\n" +
+		"p, alice, data1, read\n" +
+		"\n" +
+		"p, bob, data2, write\n" +
+		"p, bob, data2, write\n" +
+		"p, \"data, 3\", data3, \"say \"\"hi\"\"\"\n"
+	if err := a.ImportPolicy(ctx, strings.NewReader(policy), ImportReplace); err != nil {
+		t.Fatalf("Expected ImportPolicy() to be successful; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data, 3", "data3", `say "hi"`}})
+
+	if err := a.ImportPolicy(ctx, strings.NewReader("p, alice, data1, read\np, carol, data1, read\n"), ImportMerge); err != nil {
+		t.Errorf("Expected ImportPolicy() to be successful; got %v", err)
+	}
+	if err := a.ImportPolicy(ctx, strings.NewReader("p, dave, data1, read\n"), ImportSeedIfEmpty); err != nil {
+		t.Errorf("Expected ImportPolicy() to be successful; got %v", err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data, 3", "data3", `say "hi"`}, {"carol", "data1", "read"}})
+
+	if err := a.ImportPolicy(ctx, strings.NewReader("p, \"unterminated\n"), ImportReplace); err == nil {
+		t.Error("Expected ImportPolicy() to fail on invalid CSV")
+	}
+	if err := a.ImportPolicy(ctx, strings.NewReader("p\n"), ImportReplace); err == nil {
+		t.Error("Expected ImportPolicy() to fail on a rule without values")
+	}
+
+	var buf bytes.Buffer
+	if err := a.ExportPolicy(ctx, &buf, nil); err != nil {
+		t.Fatalf("Expected ExportPolicy() to be successful; got %v", err)
+	}
+	if err := a.ImportPolicy(ctx, &buf, ImportReplace); err != nil {
+		t.Errorf("Expected ImportPolicy() to read back exported policy; got %v", err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data, 3", "data3", `say "hi"`}, {"carol", "data1", "read"}})
+}
+
+func TestExportCSV(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	path := filepath.Join(t.TempDir(), "policy.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ExportCSV(context.Background(), f); err != nil {
+		t.Fatalf("Expected ExportCSV() to be successful; got %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file adapter reads back the exported policy.
+	e := newTestEnforcer(t, "examples/rbac_model.conf", fileadapter.NewAdapter(path))
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected the exported grouping rule to be loaded")
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+	ctx := context.Background()
+	if err := a.ClearPolicies(ctx); err != nil {
+		t.Fatalf("Expected ClearPolicies() to be successful; got %v", err)
+	}
+
+	policy, err := os.Open("examples/rbac_policy.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer policy.Close()
+	if err := a.ImportCSV(ctx, policy); err != nil {
+		t.Fatalf("Expected ImportCSV() to be successful; got %v", err)
+	}
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+		t.Error("Expected the imported grouping rule to be stored")
+	}
+
+	invalid := "p, carol, data3, read\np, a, b, c, d, e, f, g\n"
+	if err := a.ImportCSV(ctx, strings.NewReader(invalid)); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected ImportCSV() to report the invalid line; got %v", err)
+	}
+	if ok, err := a.HasPolicy(ctx, "p", []string{"carol", "data3", "read"}); err != nil || ok {
+		t.Errorf("Expected nothing to be imported from invalid CSV; got %t (%v)", ok, err)
+	}
+}
+
+func TestImportMerge(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	ctx := context.Background()
+	a := newTestAdapter()
+	// A rule stored without its trailing empty values, e.g. by another
+	// adapter, is not imported again.
+	if _, err := a.collection.InsertOne(ctx, bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "erin"}, {Key: "v1", Value: "data1"}, {Key: "v2", Value: "read"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ImportPolicy(ctx, strings.NewReader("p, erin, data1, read\np, alice, data1, read\np, frank, data1, read\n"), ImportMerge); err != nil {
+		t.Errorf("Expected ImportPolicy() to be successful; got %v", err)
+	}
+	if n, err := a.collection.CountDocuments(ctx, bson.D{{Key: "v0", Value: bson.D{{Key: "$in", Value: bson.A{"erin", "alice"}}}}}); err != nil || n != 2 {
+		t.Errorf("Expected the stored rules not to be imported again; got %d rules (%v)", n, err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"erin", "data1", "read"}, {"frank", "data1", "read"}})
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// duplicateGroup is a rule stored several times, with the _id of its copies
+// from the oldest to the newest.
+type duplicateGroup struct {
+	Rule CasbinRule    `bson:"_id"`
+	IDs  []interface{} `bson:"ids"`
+}
+
+// duplicates returns the rules stored more than once.
+func (a *Adapter) duplicates(ctx context.Context) ([]duplicateGroup, error) {
+	key := bson.D{{Key: "ptype", Value: "$ptype"}}
+	fields := []string{"v0", "v1", "v2", "v3", "v4", "v5", tenantField}
+	if a.cfg.ArraySchema {
+		fields = []string{valsField, tenantField}
+	}
+	for _, field := range fields {
+		key = append(key, bson.E{Key: field, Value: "$" + field})
+	}
+	pipeline := a.livePipeline(mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: key},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	})
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []duplicateGroup{}
+	if err := cur.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// FindDuplicates returns the rules stored more than once, each listed once.
+func (a *Adapter) FindDuplicates(ctx context.Context) ([]CasbinRule, error) {
+	if err := a.ensureOpen(); err != nil {
+		return nil, a.wrapErr("FindDuplicates", err)
+	}
+
+	groups, err := a.duplicates(ctx)
+	if err != nil {
+		return nil, a.wrapErr("FindDuplicates", err)
+	}
+
+	rules := make([]CasbinRule, 0, len(groups))
+	for _, group := range groups {
+		rules = append(rules, group.Rule)
+	}
+	return rules, nil
+}
+
+// RemoveDuplicates removes all but the oldest copy of the rules stored more
+// than once, and returns the number of copies removed. The copies are
+// removed by _id in batches of BatchSize, so that it can run while the
+// policy is in use.
+func (a *Adapter) RemoveDuplicates(ctx context.Context) (int64, error) {
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("RemoveDuplicates", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		return 0, a.wrapErr("RemoveDuplicates", err)
+	}
+
+	groups, err := a.duplicates(ctx)
+	if err != nil {
+		return 0, a.wrapErr("RemoveDuplicates", err)
+	}
+
+	var ids []interface{}
+	for _, group := range groups {
+		ids = append(ids, group.IDs[1:]...)
+	}
+
+	var removed int64
+	size := a.writeBatchSize()
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		n, err := a.removeMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids[start:end]}}}})
+		removed += n
+		if err != nil {
+			return removed, a.wrapErr("RemoveDuplicates", err)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// AutoEncryption enables client-side field level encryption or Queryable
+// Encryption on the client built by the adapter, which then needs to be built
+// with the cse tag. A client configured for encryption can also be passed to
+// NewAdapterFromClient.
+//
+// The fields listed in encryptedFields, among v0 to v5, must be encrypted
+// with deterministic encryption, or be Queryable Encryption equality fields,
+// so that the exact-match selectors of the adapter, such as those of
+// RemovePolicy and RemoveFilteredPolicy, still work. The adapter creates no
+// index on them. Filters passed to LoadFilteredPolicy that are not
+// exact matches on these fields, e.g. regular expressions or ranges, are
+// refused by the driver, and CaseInsensitive cannot be used.
+func AutoEncryption(opts *options.AutoEncryptionOptions, encryptedFields ...string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.AutoEncryption = opts
+		a.cfg.EncryptedFields = encryptedFields
+	}
+}
+
+// encrypted reports whether field is encrypted.
+func (a *Adapter) encrypted(field string) bool {
+	for _, f := range a.cfg.EncryptedFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEncryptedFields checks that only rule values are encrypted, since
+// the adapter needs to read and index ptype.
+func validateEncryptedFields(fields []string) error {
+	for _, field := range fields {
+		switch field {
+		case "v0", "v1", "v2", "v3", "v4", "v5":
+		default:
+			return fmt.Errorf("invalid encrypted field %q", field)
+		}
+	}
+	return nil
+}
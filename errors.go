@@ -0,0 +1,199 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+var (
+	// ErrFilteredSave is returned by SavePolicy when the loaded policy has
+	// been filtered, or the adapter was constructed as filtered, as saving
+	// the policy would delete the rules left out.
+	ErrFilteredSave = errors.New("cannot save a filtered policy")
+	// ErrEmptyURL is returned by the constructors given an empty connection
+	// URL, e.g. read from an unset environment variable.
+	ErrEmptyURL = errors.New("empty connection URL")
+	// ErrNotConnected is returned when the adapter has no usable client,
+	// e.g. after Close.
+	ErrNotConnected = errors.New("client is not connected")
+	// ErrCollectionNotFound is returned when opening an adapter with
+	// RequireExistingCollection if the policy collection does not exist.
+	ErrCollectionNotFound = errors.New("policy collection does not exist")
+	// ErrPolicyNotFound is returned by RemovePolicy in StrictRemove mode when
+	// no stored rule matches.
+	ErrPolicyNotFound = errors.New("policy not found")
+	// ErrNotEmpty is returned by MigrateFrom when the policy collection
+	// already holds rules and Force is not set, and by CopyTo when the
+	// target collection does and Overwrite is not set.
+	ErrNotEmpty = errors.New("policy collection is not empty")
+	// ErrConcurrentModification is returned by SavePolicy with
+	// OptimisticConcurrency when the stored policy was modified since the
+	// adapter last loaded or saved it.
+	ErrConcurrentModification = errors.New("policy was modified concurrently")
+	// ErrEmptySave is returned when saving an empty policy with
+	// AllowEmptySave(false).
+	ErrEmptySave = errors.New("refusing to save an empty policy")
+	// ErrReadOnly matches errors caused by the server refusing writes, e.g.
+	// when connected to a secondary, to a server started in read-only mode or
+	// when the policy collection is a view.
+	ErrReadOnly = errors.New("policy storage is read-only")
+	// ErrCapped matches errors caused by the policy collection being capped,
+	// which forbids removing rules on older servers and soft-deleting them
+	// on all of them.
+	ErrCapped = errors.New("policy collection is capped")
+	// ErrValueTooLong matches errors caused by a rule value too long to be
+	// indexed. Servers before MongoDB 4.2 reject index keys over 1024 bytes,
+	// so indexed values must stay below about 1000 bytes there, see
+	// EnsureIndexesOnOpen.
+	ErrValueTooLong = errors.New("rule value too long to be indexed")
+	// ErrInvalidDocument matches errors caused by a document failing the
+	// validator of the policy collection, see ValidateDocuments.
+	ErrInvalidDocument = errors.New("document failed the validation of the policy collection")
+	// ErrDuplicateRule matches errors caused by a unique index of the policy
+	// collection refusing a rule already stored, see SkipDuplicates.
+	ErrDuplicateRule = errors.New("rule already stored")
+	// ErrInvalidFilter is returned by LoadFilteredPolicy when its filter uses
+	// a field or an operator only allowed with RawFilters.
+	ErrInvalidFilter = errors.New("invalid filter")
+	// ErrSnapshotUnsupported is returned by LoadPolicyAtClusterTime when the
+	// server cannot read at a cluster time, e.g. a standalone server or one
+	// before MongoDB 5.0.
+	ErrSnapshotUnsupported = errors.New("snapshot reads are not supported")
+	// ErrSnapshotTooOld is returned by LoadPolicyAtClusterTime when the
+	// cluster time is older than the history kept by the server.
+	ErrSnapshotTooOld = errors.New("cluster time is outside the snapshot history window")
+	// ErrUnsupportedInMemory is returned by the methods of an adapter created
+	// with NewMemoryAdapter that need a MongoDB collection.
+	ErrUnsupportedInMemory = errors.New("operation is not supported by the in-memory adapter")
+)
+
+// readOnlyCodes are the server error codes meaning that writes are refused.
+var readOnlyCodes = []int{
+	10107, // NotWritablePrimary
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+	166,   // CommandNotSupportedOnView
+}
+
+// illegalOperation is the code of the server errors refusing a write in
+// read-only mode or on a capped collection, told apart by their message.
+const illegalOperation = 20
+
+// cappedSizeChange is the code of the server error refusing an update that
+// grows a document of a capped collection.
+const cappedSizeChange = 10003
+
+// keyTooLong is the code of the server error refusing an index key over 1024
+// bytes.
+const keyTooLong = 17280
+
+// duplicateKey is the code of the server error refusing a document whose
+// key is already stored.
+const duplicateKey = 11000
+
+// documentValidationFailure is the code of the server error refusing a
+// document failing the validator of the collection.
+const documentValidationFailure = 121
+
+// classify returns ErrReadOnly, ErrCapped, ErrValueTooLong,
+// ErrInvalidDocument or ErrDuplicateRule if err is a server error refusing a
+// write for that reason, and nil otherwise.
+func classify(err error) error {
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return nil
+	}
+	for _, code := range readOnlyCodes {
+		if se.HasErrorCode(code) {
+			return ErrReadOnly
+		}
+	}
+	if se.HasErrorCodeWithMessage(illegalOperation, "read-only") {
+		return ErrReadOnly
+	}
+	if se.HasErrorCode(cappedSizeChange) || se.HasErrorCodeWithMessage(illegalOperation, "capped") {
+		return ErrCapped
+	}
+	if se.HasErrorCode(keyTooLong) {
+		return ErrValueTooLong
+	}
+	if se.HasErrorCode(documentValidationFailure) {
+		return ErrInvalidDocument
+	}
+	if se.HasErrorCode(duplicateKey) {
+		return ErrDuplicateRule
+	}
+	return nil
+}
+
+// OpError records the adapter operation and the collection involved in a
+// failure. The underlying error, typically a driver error such as
+// mongo.WriteException, can be retrieved with errors.As, and sentinel errors
+// of this package are matched with errors.Is.
+type OpError struct {
+	Op         string
+	Collection string
+	Err        error
+}
+
+// Error returns the message of the underlying error, prefixed with the
+// operation, the collection and, for writes refused by the server, the
+// reason why.
+func (e *OpError) Error() string {
+	msg := e.Err.Error()
+	if reason := classify(e.Err); reason != nil {
+		msg = reason.Error() + ": " + msg
+	}
+	return "mongodbadapter: " + e.Op + " on " + e.Collection + ": " + msg
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the error matches target, classifying driver errors
+// against ErrNotConnected, ErrReadOnly, ErrCapped, ErrValueTooLong,
+// ErrInvalidDocument and ErrDuplicateRule.
+func (e *OpError) Is(target error) bool {
+	switch target {
+	case ErrNotConnected:
+		return errors.Is(e.Err, mongo.ErrClientDisconnected)
+	case ErrReadOnly, ErrCapped, ErrValueTooLong, ErrInvalidDocument, ErrDuplicateRule:
+		return classify(e.Err) == target
+	}
+	return false
+}
+
+// wrapErr wraps err in an OpError for the operation op. It returns nil if
+// err is nil, and err itself if it is already an OpError.
+func (a *Adapter) wrapErr(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return err
+	}
+	return &OpError{Op: op, Collection: a.collectionName(), Err: err}
+}
+
+// collectionName returns the full name of the policy collection.
+func (a *Adapter) collectionName() string {
+	return a.cfg.DatabaseName + "." + a.cfg.CollectionName
+}
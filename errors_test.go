@@ -0,0 +1,305 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+func TestFilteredSaveError(t *testing.T) {
+	requireMongoDB(t)
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+
+	if err := e.LoadFilteredPolicy(&bson.M{"v0": "bob"}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	err := a.SavePolicy(e.GetModel())
+	if !errors.Is(err, ErrFilteredSave) {
+		t.Errorf("Expected SavePolicy() to fail with ErrFilteredSave; got %v", err)
+	}
+	var opErr *OpError
+	if !errors.As(err, &opErr) || opErr.Op != "SavePolicy" {
+		t.Errorf("Expected SavePolicy() to fail with an OpError for SavePolicy; got %v", err)
+	}
+}
+
+func TestPolicyNotFoundError(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), StrictRemove(true))
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected RemovePolicy() to fail with ErrPolicyNotFound; got %v", err)
+	}
+}
+
+func TestOpErrorIs(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+
+	err := a.wrapErr("AddPolicy", mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 10107, Message: "not primary"}}})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected %v to match ErrReadOnly", err)
+	}
+	var we mongo.WriteException
+	if !errors.As(err, &we) {
+		t.Errorf("Expected %v to unwrap to a mongo.WriteException", err)
+	}
+	if !strings.HasPrefix(err.Error(), "mongodbadapter: AddPolicy on casbin.casbin_rule: ") {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+	if errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected %v not to match ErrNotConnected", err)
+	}
+
+	if err := a.wrapErr("Flush", mongo.ErrClientDisconnected); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected %v to match ErrNotConnected", err)
+	}
+	if err := a.wrapErr("LoadPolicy", a.wrapErr("Flush", errors.New("boom"))); err.(*OpError).Op != "Flush" {
+		t.Errorf("Expected OpErrors not to be wrapped twice; got %v", err)
+	}
+	if err := a.Ping(context.Background()); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected Ping() to fail with ErrNotConnected; got %v", err)
+	}
+}
+
+func TestOpErrorOp(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+	ctx := context.Background()
+	m := model.NewModel()
+
+	_, hasErr := a.HasPolicy(ctx, "p", []string{"alice", "data1", "read"})
+	_, countErr := a.CountPolicies(ctx, "p")
+	_, _, listErr := a.ListPolicies(ctx, nil, 0, 10)
+	_, purgeErr := a.PurgeDeleted(ctx, 0)
+	errs := map[string]error{
+		"LoadPolicy":           a.LoadPolicyCtx(ctx, m),
+		"SavePolicy":           a.SavePolicyCtx(ctx, m),
+		"AddPolicy":            a.AddPolicy("p", "p", []string{"alice", "data1", "read"}),
+		"RemovePolicy":         a.RemovePolicy("p", "p", []string{"alice", "data1", "read"}),
+		"RemoveFilteredPolicy": a.RemoveFilteredPolicy("p", "p", 0, "alice"),
+		"UpdatePolicy":         a.UpdatePolicy("p", "p", []string{"alice", "data1", "read"}, []string{"alice", "data1", "write"}),
+		"HasPolicy":            hasErr,
+		"CountPolicies":        countErr,
+		"ListPolicies":         listErr,
+		"PurgeDeleted":         purgeErr,
+	}
+	for op, err := range errs {
+		var opErr *OpError
+		if !errors.As(err, &opErr) || opErr.Op != op {
+			t.Errorf("Expected %s() to fail with an OpError of its operation; got %v", op, err)
+			continue
+		}
+		if !errors.Is(err, ErrNotConnected) {
+			t.Errorf("Expected %s() to fail with ErrNotConnected; got %v", op, err)
+		}
+		if !strings.HasPrefix(err.Error(), "mongodbadapter: "+op+" on ") {
+			t.Errorf("Unexpected error message %q", err.Error())
+		}
+	}
+
+	if _, err := PTypeFilter(nil, map[int][]string{6: {"x"}}); err == nil || !strings.HasPrefix(err.Error(), "mongodbadapter: PTypeFilter: ") {
+		t.Errorf("Expected PTypeFilter() to name itself in its error; got %v", err)
+	}
+}
+
+func TestWriteRefusedError(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{mongo.CommandError{Code: 10107, Message: "not primary"}, ErrReadOnly},
+		{mongo.CommandError{Code: 166, Message: "Namespace casbin.casbin_rule is a view, not a collection"}, ErrReadOnly},
+		{mongo.CommandError{Code: 20, Message: "Cannot execute a write operation in read-only mode"}, ErrReadOnly},
+		{mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 20, Message: "cannot remove from a capped collection: casbin.casbin_rule"}}}, ErrCapped},
+		{mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 10003, Message: "Cannot change the size of a document in a capped collection"}}}, ErrCapped},
+		{mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: 17280, Message: "WiredTigerIndex::insert: key too large to index"}}}}, ErrValueTooLong},
+		{mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121, Message: "Document failed validation"}}}, ErrInvalidDocument},
+		{mongo.CommandError{Code: 20, Message: "some other illegal operation"}, nil},
+	}
+	for _, tt := range tests {
+		err := a.wrapErr("SavePolicy", tt.err)
+		for _, sentinel := range []error{ErrReadOnly, ErrCapped, ErrValueTooLong, ErrInvalidDocument} {
+			if errors.Is(err, sentinel) != (sentinel == tt.want) {
+				t.Errorf("Expected errors.Is(%v, %v) to be %t", err, sentinel, sentinel == tt.want)
+			}
+		}
+		if tt.want != nil && !strings.HasPrefix(err.Error(), "mongodbadapter: SavePolicy on casbin.casbin_rule: "+tt.want.Error()+": ") {
+			t.Errorf("Unexpected error message %q", err.Error())
+		}
+	}
+}
+
+func TestCollectionNotFoundError(t *testing.T) {
+	requireMongoDB(t)
+	_, err := NewAdapterWithClientOptions(options.Client().ApplyURI(getDbURL()), DBName("casbin_missing_db"), RequireExistingCollection(true))
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("Expected NewAdapterWithClientOptions() to fail with ErrCollectionNotFound; got %v", err)
+	}
+
+	initPolicy(t)
+	a, err := NewAdapterWithClientOptions(options.Client().ApplyURI(getDbURL()), DBName(getDbName()), RequireExistingCollection(true))
+	if err != nil {
+		t.Fatalf("Expected NewAdapterWithClientOptions() to be successful; got %v", err)
+	}
+	a.Close()
+}
+
+func TestEmptyURLError(t *testing.T) {
+	if _, err := NewAdapterWithError(""); !errors.Is(err, ErrEmptyURL) {
+		t.Errorf("Expected NewAdapterWithError() to fail with ErrEmptyURL; got %v", err)
+	}
+	if _, err := NewAdapterFromConfig(Config{}); !errors.Is(err, ErrEmptyURL) {
+		t.Errorf("Expected NewAdapterFromConfig() to fail with ErrEmptyURL; got %v", err)
+	}
+	if _, err := NewAdapterWithError("localhost:27017"); err == nil || errors.Is(err, ErrEmptyURL) {
+		t.Errorf("Expected NewAdapterWithError() to reject a URL without scheme; got %v", err)
+	}
+}
+
+func TestConcurrentModificationError(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a1 := NewAdapter(getDbURL(), DBName(getDbName()), OptimisticConcurrency(true))
+	a2 := NewAdapter(getDbURL(), DBName(getDbName()), OptimisticConcurrency(true))
+	ctx := context.Background()
+	if err := a1.meta().Drop(ctx); err != nil {
+		t.Fatalf("Expected Drop() to be successful; got %v", err)
+	}
+
+	e1 := newTestEnforcer(t, "examples/rbac_model.conf", a1)
+	e2 := newTestEnforcer(t, "examples/rbac_model.conf", a2)
+	if err := e1.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if rev, err := a2.PolicyRevision(ctx); err != nil || rev != 1 {
+		t.Errorf("Expected revision 1; got %d (%v)", rev, err)
+	}
+
+	err := e2.SavePolicy()
+	if !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("Expected SavePolicy() to fail with ErrConcurrentModification; got %v", err)
+	}
+	if err := e2.LoadPolicy(); err != nil {
+		t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+	}
+	if err := e2.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful after a reload; got %v", err)
+	}
+
+	// Incremental writes bump the revision without making the writer stale.
+	if _, err := e2.AddPolicy("carol", "data3", "read"); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := e2.SavePolicy(); err != nil {
+		t.Errorf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	if rev, err := a1.PolicyRevision(ctx); err != nil || rev != 4 {
+		t.Errorf("Expected revision 4; got %d (%v)", rev, err)
+	}
+
+	// A missing revision document is not taken for the revision last seen.
+	if err := a1.meta().Drop(ctx); err != nil {
+		t.Fatalf("Expected Drop() to be successful; got %v", err)
+	}
+	if err := e2.SavePolicy(); !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("Expected SavePolicy() to fail with ErrConcurrentModification; got %v", err)
+	}
+}
+
+func TestSavePolicyIfVersion(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	if err := a.meta().Drop(ctx); err != nil {
+		t.Fatalf("Expected Drop() to be successful; got %v", err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	// Without a stored revision, only version 0 is current.
+	err := a.SavePolicyIfVersion(e.GetModel(), 7)
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCodeWithMessage(20, "Transaction numbers") {
+		t.Skip("transactions require a replica set")
+	}
+	if !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("Expected SavePolicyIfVersion() to fail with ErrConcurrentModification; got %v", err)
+	}
+	if rev, err := a.PolicyRevision(ctx); err != nil || rev != 0 {
+		t.Errorf("Expected revision 0; got %d (%v)", rev, err)
+	}
+
+	if err := a.SavePolicyIfVersion(e.GetModel(), 0); err != nil {
+		t.Fatalf("Expected SavePolicyIfVersion() to be successful; got %v", err)
+	}
+	if rev, err := a.PolicyRevision(ctx); err != nil || rev != 1 {
+		t.Errorf("Expected revision 1; got %d (%v)", rev, err)
+	}
+
+	e.EnableAutoSave(false)
+	e.AddPolicy("carol", "data3", "read")
+	if err := a.SavePolicyIfVersion(e.GetModel(), 0); !errors.Is(err, ErrConcurrentModification) {
+		t.Errorf("Expected SavePolicyIfVersion() to fail with ErrConcurrentModification; got %v", err)
+	}
+	if ok, err := a.HasPolicy(ctx, "p", []string{"carol", "data3", "read"}); err != nil || ok {
+		t.Errorf("Expected the failed save to be rolled back; got %t (%v)", ok, err)
+	}
+
+	if err := a.SavePolicyIfVersion(e.GetModel(), 1); err != nil {
+		t.Errorf("Expected SavePolicyIfVersion() to be successful; got %v", err)
+	}
+	if ok, err := a.HasPolicy(ctx, "p", []string{"carol", "data3", "read"}); err != nil || !ok {
+		t.Errorf("Expected the saved rule to be stored; got %t (%v)", ok, err)
+	}
+}
+
+func TestBatchError(t *testing.T) {
+	a := &Adapter{cfg: defaultConfig()}
+
+	var refused BatchError
+	if refused.err() != nil {
+		t.Error("Expected an empty BatchError not to be an error")
+	}
+	refused.add(2, mongo.BulkWriteError{WriteError: mongo.WriteError{Code: duplicateKey, Message: "duplicate key"}})
+	refused.add(5, mongo.BulkWriteError{WriteError: mongo.WriteError{Code: documentValidationFailure, Message: "validation failed"}})
+
+	err := a.wrapErr("AddPolicies", refused.err())
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Failed) != 2 || batchErr.Failed[0] != 2 || batchErr.Failed[1] != 5 {
+		t.Errorf("Expected %v to unwrap to a BatchError of rules 2 and 5", err)
+	}
+	if !errors.Is(err, ErrDuplicateRule) || !errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("Expected %v to match ErrDuplicateRule and ErrInvalidDocument", err)
+	}
+	if errors.Is(err, ErrReadOnly) {
+		t.Errorf("Expected %v not to match ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// expiresAtField is the field recording when a rule added with
+// AddPolicyWithTTL expires.
+const expiresAtField = "expiresAt"
+
+// ExpireRules enables rules that expire, added with AddPolicyWithTTL, e.g. to
+// grant temporary access. The adapter creates a TTL index on their expiresAt
+// field, so that the server deletes them once expired, and ignores the
+// expired rules it has not deleted yet when loading, counting or listing
+// policy. Rules without expiresAt never expire. The server deletes expired
+// rules from the policy collection only, not from the collections of
+// CollectionRouter. Rules loaded before they expired stay in the model, and
+// in the policy cache for up to CacheTTL, until the next load. SavePolicy
+// stores the rules of the model without their expiry, except with SaveDiff,
+// which leaves the unchanged rules in place. It cannot be combined with
+// CosmosDBCompat.
+func ExpireRules(expire bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ExpireRules = expire
+	}
+}
+
+// notExpired returns the selector matching the rules that do not expire or
+// have not expired yet.
+func notExpired() bson.D {
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: expiresAtField, Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: expiresAtField, Value: bson.D{{Key: "$gt", Value: time.Now()}}}},
+	}}}
+}
+
+// AddPolicyWithTTL adds a policy rule to the storage that expires at
+// expiresAt, as described by ExpireRules, which it requires. Buffered writes
+// are flushed first, and the rule is inserted immediately.
+func (a *Adapter) AddPolicyWithTTL(ctx context.Context, sec string, ptype string, rule []string, expiresAt time.Time) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	if !a.cfg.ExpireRules {
+		return a.wrapErr("AddPolicyWithTTL", errors.New("rules can only expire with ExpireRules"))
+	}
+	ctx, done := a.startOp(ctx, "AddPolicyWithTTL", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return a.wrapErr("AddPolicyWithTTL", err)
+	}
+
+	line := a.policyLine(sec, ptype, rule)
+	_, err := a.addDocument(ctx, line, a.documentWith(line, bson.M{expiresAtField: expiresAt}))
+	return a.wrapErr("AddPolicyWithTTL", err)
+}
@@ -0,0 +1,267 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// LegacyFieldNames maps the fields of rules stored with the casing of the Go
+// fields, e.g. by forks of the adapter tagging the fields of CasbinRule with
+// their Go names, to the fields the adapter writes and queries. It is the
+// mapping used by MigrateFieldNames when given none.
+var LegacyFieldNames = map[string]string{
+	"PType": "ptype",
+	"V0":    "v0",
+	"V1":    "v1",
+	"V2":    "v2",
+	"V3":    "v3",
+	"V4":    "v4",
+	"V5":    "v5",
+}
+
+// schemaSampleSize is the number of documents DetectSchema examines.
+const schemaSampleSize = 100
+
+// StoredSchema is the form of the documents of a policy collection, as
+// reported by DetectSchema.
+type StoredSchema int
+
+const (
+	// SchemaEmpty reports a collection without documents.
+	SchemaEmpty StoredSchema = iota
+	// SchemaFields reports rules stored in the ptype and v0 to v5 fields,
+	// the default schema of the adapter.
+	SchemaFields
+	// SchemaArray reports rules storing their values in the vals array, see
+	// ArraySchema.
+	SchemaArray
+	// SchemaLegacyFields reports rules stored in the fields of
+	// LegacyFieldNames. The driver decodes them into CasbinRule regardless
+	// of case, so loads read them, but the queries of the adapter name the
+	// lowercase fields: filtered loads and removals, RemovePolicy, HasPolicy
+	// and UpdatePolicy miss them and the indexes do not cover them until
+	// they are converted with MigrateFieldNames.
+	SchemaLegacyFields
+	// SchemaUnknown reports documents holding none of the above fields.
+	SchemaUnknown
+	// SchemaMixed reports a collection whose sampled documents use several
+	// of the above forms, e.g. during a conversion.
+	SchemaMixed
+)
+
+// SchemaReport is the result of DetectSchema.
+type SchemaReport struct {
+	// Schema is the form of all the sampled documents, SchemaMixed if they
+	// use several.
+	Schema StoredSchema
+	// Counts holds the number of sampled documents in each form.
+	Counts map[StoredSchema]int64
+}
+
+// DetectSchema samples up to 100 documents of the policy collection,
+// whatever their tenant, and reports the form in which they store rules,
+// e.g. to check whether a collection needs MigrateFieldNames or
+// MigrateSchema before using it.
+func (a *Adapter) DetectSchema(ctx context.Context) (SchemaReport, error) {
+	if err := a.ensureOpen(); err != nil {
+		return SchemaReport{}, a.wrapErr("DetectSchema", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		return SchemaReport{}, a.wrapErr("DetectSchema", err)
+	}
+
+	report, err := a.detectSchema(ctx)
+	return report, a.wrapErr("DetectSchema", err)
+}
+
+func (a *Adapter) detectSchema(ctx context.Context) (SchemaReport, error) {
+	pipeline := mongo.Pipeline{{{Key: "$sample", Value: bson.D{{Key: "size", Value: schemaSampleSize}}}}}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Aggregate(ctx, pipeline)
+		return err
+	})
+	if err != nil {
+		return SchemaReport{}, err
+	}
+	defer cur.Close(context.Background())
+
+	report := SchemaReport{Counts: make(map[StoredSchema]int64)}
+	for cur.Next(ctx) {
+		report.Counts[documentSchema(cur.Current)]++
+	}
+	if err := cur.Err(); err != nil {
+		return SchemaReport{}, err
+	}
+	report.Schema = overallSchema(report.Counts)
+	return report, nil
+}
+
+// documentSchema returns the form of the rule stored in doc.
+func documentSchema(doc bson.Raw) StoredSchema {
+	if _, err := doc.LookupErr(valsField); err == nil {
+		return SchemaArray
+	}
+	if _, err := doc.LookupErr("ptype"); err == nil {
+		return SchemaFields
+	}
+	for field := range LegacyFieldNames {
+		if _, err := doc.LookupErr(field); err == nil {
+			return SchemaLegacyFields
+		}
+	}
+	return SchemaUnknown
+}
+
+// overallSchema returns the form of a collection whose sampled documents
+// are of the forms counted in counts.
+func overallSchema(counts map[StoredSchema]int64) StoredSchema {
+	schema := SchemaEmpty
+	for s, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if schema != SchemaEmpty {
+			return SchemaMixed
+		}
+		schema = s
+	}
+	return schema
+}
+
+// MigrateFieldNames renames the fields of the documents of the policy
+// collection, whatever their tenant, from the keys of mapping to its values,
+// LegacyFieldNames if mapping is empty, e.g. to convert the rules written by
+// a fork of the adapter using other field names. The documents are renamed
+// with $rename in batches, and the conversion can be run again to resume if
+// interrupted. It returns the number of documents converted. A field already
+// holding a new name is overwritten by the renamed one. The names must be
+// top-level fields other than _id, and a new name cannot be renamed itself.
+func (a *Adapter) MigrateFieldNames(ctx context.Context, mapping map[string]string) (int64, error) {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if len(mapping) == 0 {
+		mapping = LegacyFieldNames
+	}
+	rename, err := renameDocument(mapping)
+	if err != nil {
+		return 0, a.wrapErr("MigrateFieldNames", err)
+	}
+
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("MigrateFieldNames", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		return 0, a.wrapErr("MigrateFieldNames", err)
+	}
+
+	n, err := a.migrateFieldNames(ctx, rename)
+	return n, a.wrapErr("MigrateFieldNames", err)
+}
+
+// renameDocument checks mapping and returns it as the operand of $rename,
+// ordered by former name.
+func renameDocument(mapping map[string]string) (bson.D, error) {
+	targets := make(map[string]string, len(mapping))
+	for from, to := range mapping {
+		for _, name := range []string{from, to} {
+			if name == "" || name == "_id" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+				return nil, fmt.Errorf("invalid field name %q", name)
+			}
+		}
+		if from == to {
+			return nil, fmt.Errorf("field %q renamed to itself", from)
+		}
+		if other, ok := targets[to]; ok {
+			return nil, fmt.Errorf("fields %q and %q both renamed to %q", other, from, to)
+		}
+		targets[to] = from
+	}
+	for to := range targets {
+		if _, ok := mapping[to]; ok {
+			return nil, fmt.Errorf("field %q is both renamed and a new name", to)
+		}
+	}
+
+	rename := make(bson.D, 0, len(mapping))
+	for from, to := range mapping {
+		rename = append(rename, bson.E{Key: from, Value: to})
+	}
+	sort.Slice(rename, func(i, j int) bool { return rename[i].Key < rename[j].Key })
+	return rename, nil
+}
+
+func (a *Adapter) migrateFieldNames(ctx context.Context, rename bson.D) (int64, error) {
+	defer a.InvalidateCache()
+
+	// Only the documents still holding a former name are read, so that
+	// running it again resumes an interrupted conversion.
+	exists := make(bson.A, len(rename))
+	for i, e := range rename {
+		exists[i] = bson.D{{Key: e.Key, Value: bson.D{{Key: "$exists", Value: true}}}}
+	}
+	filter := bson.D{{Key: "$or", Value: exists}}
+	update := bson.D{{Key: "$rename", Value: rename}}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, filter, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+
+	var converted int64
+	var models []mongo.WriteModel
+	write := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := a.retryThrottledBulk(ctx, len(models), false, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			return a.collection.BulkWrite(ctx, atPositions(models, pos), options.BulkWrite().SetOrdered(false))
+		})
+		converted += res.ModifiedCount
+		models = models[:0]
+		return err
+	}
+
+	size := a.writeBatchSize()
+	for cur.Next(ctx) {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: cur.Current.Lookup("_id")}}).
+			SetUpdate(update))
+		if len(models) == size {
+			if err := write(); err != nil {
+				return converted, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return converted, err
+	}
+	return converted, write()
+}
@@ -0,0 +1,195 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestMigrateFieldNames(t *testing.T) {
+	requireMongoDB(t)
+
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_legacy"))
+	defer a.Close()
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer a.collection.Drop(ctx)
+
+	if report, err := a.DetectSchema(ctx); err != nil || report.Schema != SchemaEmpty {
+		t.Errorf("Expected DetectSchema() to report an empty collection; got %v (%v)", report.Schema, err)
+	}
+
+	legacy := []interface{}{
+		bson.D{{Key: "PType", Value: "p"}, {Key: "V0", Value: "alice"}, {Key: "V1", Value: "data1"}, {Key: "V2", Value: "read"}},
+		bson.D{{Key: "PType", Value: "p"}, {Key: "V0", Value: "bob"}, {Key: "V1", Value: "data2"}, {Key: "V2", Value: "write"}},
+		bson.D{{Key: "PType", Value: "g"}, {Key: "V0", Value: "alice"}, {Key: "V1", Value: "data2_admin"}},
+	}
+	if _, err := a.collection.InsertMany(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := a.DetectSchema(ctx); err != nil || report.Schema != SchemaLegacyFields || report.Counts[SchemaLegacyFields] != 3 {
+		t.Errorf("Expected DetectSchema() to report 3 legacy rules; got %v (%v)", report, err)
+	}
+
+	if _, err := a.MigrateFieldNames(ctx, map[string]string{"V0": "v0", "V1": "v0"}); err == nil {
+		t.Error("Expected MigrateFieldNames() to refuse two fields renamed to the same name")
+	}
+	if n, err := a.MigrateFieldNames(ctx, nil); err != nil || n != 3 {
+		t.Errorf("Expected MigrateFieldNames() to convert 3 rules; got %d (%v)", n, err)
+	}
+	if n, err := a.MigrateFieldNames(ctx, nil); err != nil || n != 0 {
+		t.Errorf("Expected MigrateFieldNames() to have nothing left to convert; got %d (%v)", n, err)
+	}
+	if report, err := a.DetectSchema(ctx); err != nil || report.Schema != SchemaFields {
+		t.Errorf("Expected DetectSchema() to report converted rules; got %v (%v)", report, err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+	if ok, _ := e.Enforce("alice", "data2", "write"); !ok {
+		t.Error("Expected the converted grouping rule to be loaded")
+	}
+}
+
+func TestLegacyFieldsQueries(t *testing.T) {
+	requireMongoDB(t)
+
+	ctx := context.Background()
+	a := NewAdapter(getDbURL(), DBName(getDbName()), CollectionName("casbin_rule_legacy"))
+	defer a.Close()
+	if err := a.collection.Drop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer a.collection.Drop(ctx)
+
+	legacy := []interface{}{
+		bson.D{{Key: "PType", Value: "p"}, {Key: "V0", Value: "alice"}, {Key: "V1", Value: "data1"}, {Key: "V2", Value: "read"}},
+		bson.D{{Key: "PType", Value: "p"}, {Key: "V0", Value: "bob"}, {Key: "V1", Value: "data2"}, {Key: "V2", Value: "write"}},
+	}
+	if _, err := a.collection.InsertMany(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	// check verifies that the legacy rules are loaded in any case, and that
+	// the queries on the rule fields find them only once converted.
+	check := func(converted bool) {
+		t.Helper()
+		e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+		testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+
+		if ok, err := a.HasPolicy(ctx, "p", []string{"alice", "data1", "read"}); err != nil || ok != converted {
+			t.Errorf("HasPolicy() = %t (%v), supposed to be %t", ok, err, converted)
+		}
+
+		if err := e.LoadFilteredPolicy(bson.M{"v0": "alice"}); err != nil {
+			t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+		}
+		want := [][]string{}
+		if converted {
+			want = [][]string{{"alice", "data1", "read"}}
+		}
+		testGetPolicy(t, e, want)
+
+		if err := a.RemovePolicy("p", "p", []string{"bob", "data2", "write"}); err != nil {
+			t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+		}
+		var stored int64 = 2
+		if converted {
+			stored = 1
+		}
+		if n, err := a.collection.CountDocuments(ctx, bson.D{}); err != nil || n != stored {
+			t.Errorf("Found %d rules after RemovePolicy() (%v), supposed to be %d", n, err, stored)
+		}
+	}
+
+	check(false)
+	if n, err := a.MigrateFieldNames(ctx, nil); err != nil || n != 2 {
+		t.Fatalf("Expected MigrateFieldNames() to convert 2 rules; got %d (%v)", n, err)
+	}
+	check(true)
+}
+
+func TestMigrateFieldNamesMemory(t *testing.T) {
+	a := newMemoryTestAdapter(t)
+	if _, err := a.MigrateFieldNames(context.Background(), nil); !errors.Is(err, ErrUnsupportedInMemory) {
+		t.Errorf("Expected MigrateFieldNames() to fail with ErrUnsupportedInMemory; got %v", err)
+	}
+	if _, err := a.DetectSchema(context.Background()); !errors.Is(err, ErrUnsupportedInMemory) {
+		t.Errorf("Expected DetectSchema() to fail with ErrUnsupportedInMemory; got %v", err)
+	}
+}
+
+func TestRenameDocument(t *testing.T) {
+	rename, err := renameDocument(LegacyFieldNames)
+	if err != nil {
+		t.Fatalf("Expected renameDocument() to accept LegacyFieldNames; got %v", err)
+	}
+	if len(rename) != 7 || rename[0].Key != "PType" || rename[0].Value != "ptype" || rename[1].Key != "V0" {
+		t.Errorf("renameDocument(LegacyFieldNames) = %v, supposed to be ordered by former name", rename)
+	}
+
+	for _, mapping := range []map[string]string{
+		{"V0": ""},
+		{"": "v0"},
+		{"V0": "$v0"},
+		{"V0": "rule.v0"},
+		{"_id": "id"},
+		{"v0": "v0"},
+		{"V0": "v0", "v0": "w0"},
+		{"V0": "v0", "V1": "v0"},
+	} {
+		if _, err := renameDocument(mapping); err == nil {
+			t.Errorf("Expected renameDocument(%v) to fail", mapping)
+		}
+	}
+}
+
+func TestDocumentSchema(t *testing.T) {
+	tests := []struct {
+		doc  bson.D
+		want StoredSchema
+	}{
+		{bson.D{{Key: "ptype", Value: "p"}, {Key: "v0", Value: "alice"}}, SchemaFields},
+		{bson.D{{Key: "ptype", Value: "p"}, {Key: "vals", Value: bson.A{"alice"}}}, SchemaArray},
+		{bson.D{{Key: "PType", Value: "p"}, {Key: "V0", Value: "alice"}}, SchemaLegacyFields},
+		{bson.D{{Key: "V0", Value: "alice"}}, SchemaLegacyFields},
+		{bson.D{{Key: "name", Value: "alice"}}, SchemaUnknown},
+	}
+	for _, tt := range tests {
+		raw, err := bson.Marshal(tt.doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := documentSchema(raw); got != tt.want {
+			t.Errorf("documentSchema(%v) = %v, supposed to be %v", tt.doc, got, tt.want)
+		}
+	}
+
+	if got := overallSchema(map[StoredSchema]int64{}); got != SchemaEmpty {
+		t.Errorf("overallSchema() of no documents = %v, supposed to be SchemaEmpty", got)
+	}
+	if got := overallSchema(map[StoredSchema]int64{SchemaArray: 4}); got != SchemaArray {
+		t.Errorf("overallSchema() of array rules = %v, supposed to be SchemaArray", got)
+	}
+	if got := overallSchema(map[StoredSchema]int64{SchemaFields: 2, SchemaLegacyFields: 1}); got != SchemaMixed {
+		t.Errorf("overallSchema() of both schemas = %v, supposed to be SchemaMixed", got)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// PTypeFilter returns a filter for LoadFilteredPolicy matching the rules of
+// any of ptypes whose values satisfy fieldFilters, which maps a field index,
+// 0 to 5 for v0 to v5, to the values accepted for that field. For instance,
+// the g and g2 rules of domain1 are selected by
+//
+//	PTypeFilter([]string{"g", "g2"}, map[int][]string{2: {"domain1"}})
+//
+// An empty ptypes matches all ptypes and an empty list of values accepts any
+// value. If nothing is constrained, the returned filter is nil, so that
+// LoadFilteredPolicy loads the whole policy and leaves the adapter
+// unfiltered.
+func PTypeFilter(ptypes []string, fieldFilters map[int][]string) (interface{}, error) {
+	indexes := make([]int, 0, len(fieldFilters))
+	for fieldIndex := range fieldFilters {
+		if fieldIndex < 0 || fieldIndex > 5 {
+			return nil, fmt.Errorf("mongodbadapter: PTypeFilter: invalid field index %d", fieldIndex)
+		}
+		indexes = append(indexes, fieldIndex)
+	}
+	sort.Ints(indexes)
+
+	var filter bson.D
+	if len(ptypes) > 0 {
+		filter = append(filter, bson.E{Key: "ptype", Value: anyOf(ptypes)})
+	}
+	for _, fieldIndex := range indexes {
+		if values := fieldFilters[fieldIndex]; len(values) > 0 {
+			filter = append(filter, bson.E{Key: fmt.Sprintf("v%d", fieldIndex), Value: anyOf(values)})
+		}
+	}
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+// LoadPolicyByPType loads the rules of the given ptypes only, e.g. "g" for
+// the role links, as LoadFilteredPolicy does with a filter on ptype, and
+// leaves the adapter filtered. At least one ptype must be given. Role links
+// must be rebuilt afterwards, e.g. with the BuildRoleLinks method of the
+// enforcer, if grouping rules were loaded.
+func (a *Adapter) LoadPolicyByPType(model model.Model, ptypes ...string) error {
+	if len(ptypes) == 0 {
+		return a.wrapErr("LoadPolicyByPType", errors.New("no ptype to load"))
+	}
+	filter := bson.D{{Key: "ptype", Value: anyOf(ptypes)}}
+
+	ctx, done := a.startOp(context.TODO(), "LoadPolicyByPType", filter)
+	defer done()
+
+	return a.wrapErr("LoadPolicyByPType", a.loadPolicyCtx(ctx, model, filter))
+}
+
+// orFilter returns the filter matching the rules matched by any of filters.
+func orFilter(filters []interface{}) (interface{}, error) {
+	switch len(filters) {
+	case 0:
+		return nil, errors.New("no filter to combine")
+	case 1:
+		return filters[0], nil
+	}
+	return bson.D{{Key: "$or", Value: bson.A(filters)}}, nil
+}
+
+// anyOf returns the condition matching any of values.
+func anyOf(values []string) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return bson.D{{Key: "$in", Value: values}}
+}
+
+// RawFilters makes LoadFilteredPolicy, ListPolicies and ExportPolicy pass
+// their filters to the server as they are. By default, a filter may only
+// constrain the rule fields, ptype and v0 to v5, plus priority, tenant with
+// Tenant, deletedAt with SoftDelete, expiresAt with ExpireRules, updatedAt
+// with TrackUpdates and vals and vals.0 to vals.5 with ArraySchema, with
+// plain values and the $eq, $in and $regex operators, combined with $and and
+// $or, so that a filter built from user input cannot run arbitrary operators
+// such as $where. Other filters fail with ErrInvalidFilter before any query
+// is sent. Aggregation pipelines are never checked.
+func RawFilters(allow bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.AllowRawFilters = allow
+	}
+}
+
+// filterOperators are the query operators allowed on a rule field.
+var filterOperators = map[string]bool{"$eq": true, "$in": true, "$regex": true, "$options": true}
+
+// checkFilter returns an error wrapping ErrInvalidFilter if filter uses a
+// field or an operator not allowed without RawFilters.
+func (a *Adapter) checkFilter(filter interface{}) error {
+	if a.cfg.AllowRawFilters {
+		return nil
+	}
+
+	data, err := bson.Marshal(filter)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidFilter, err)
+	}
+	return a.checkSelector(doc)
+}
+
+// checkSelector checks the fields and operators of a selector document.
+func (a *Adapter) checkSelector(doc bson.D) error {
+	for _, e := range doc {
+		switch {
+		case e.Key == "$and" || e.Key == "$or":
+			clauses, ok := e.Value.(bson.A)
+			if !ok || len(clauses) == 0 {
+				return fmt.Errorf("%w: %s must be a non-empty array", ErrInvalidFilter, e.Key)
+			}
+			for _, clause := range clauses {
+				sub, ok := clause.(bson.D)
+				if !ok {
+					return fmt.Errorf("%w: %s must hold documents", ErrInvalidFilter, e.Key)
+				}
+				if err := a.checkSelector(sub); err != nil {
+					return err
+				}
+			}
+		case !a.filterField(e.Key):
+			return fmt.Errorf("%w: %q is not a rule field", ErrInvalidFilter, e.Key)
+		default:
+			cond, ok := e.Value.(bson.D)
+			if !ok || len(cond) == 0 || cond[0].Key == "" || cond[0].Key[0] != '$' {
+				// A plain value, matched as is.
+				continue
+			}
+			for _, op := range cond {
+				if !filterOperators[op.Key] {
+					return fmt.Errorf("%w: operator %s is not allowed on %s", ErrInvalidFilter, op.Key, e.Key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// filterField reports whether a filter may constrain field.
+func (a *Adapter) filterField(field string) bool {
+	switch field {
+	case "ptype", "v0", "v1", "v2", "v3", "v4", "v5", "priority":
+		return true
+	case tenantField:
+		return a.cfg.Tenant != ""
+	case deletedAtField:
+		return a.cfg.SoftDelete
+	case expiresAtField:
+		return a.cfg.ExpireRules
+	case updatedAtField:
+		return a.cfg.TrackUpdates
+	case valsField, "vals.0", "vals.1", "vals.2", "vals.3", "vals.4", "vals.5":
+		return a.cfg.ArraySchema
+	}
+	return false
+}
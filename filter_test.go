@@ -0,0 +1,215 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestPTypeFilter(t *testing.T) {
+	filter, err := PTypeFilter([]string{"g", "g2"}, map[int][]string{2: {"domain1"}, 0: {"alice", "bob"}, 1: nil})
+	if err != nil {
+		t.Fatalf("Expected PTypeFilter() to be successful; got %v", err)
+	}
+	want := bson.D{
+		{Key: "ptype", Value: bson.D{{Key: "$in", Value: []string{"g", "g2"}}}},
+		{Key: "v0", Value: bson.D{{Key: "$in", Value: []string{"alice", "bob"}}}},
+		{Key: "v2", Value: "domain1"},
+	}
+	if !reflect.DeepEqual(filter, want) {
+		t.Errorf("Filter: %v, supposed to be %v", filter, want)
+	}
+
+	if filter, err := PTypeFilter(nil, map[int][]string{0: {}}); err != nil || filter != nil {
+		t.Errorf("Expected a nil filter when nothing is constrained; got %v (%v)", filter, err)
+	}
+	if _, err := PTypeFilter([]string{"p"}, map[int][]string{6: {"x"}}); err == nil {
+		t.Error("Expected PTypeFilter() to fail with an invalid field index")
+	}
+}
+
+func TestLoadPTypeFilter(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	filter, err := PTypeFilter([]string{"g"}, map[int][]string{0: {"alice"}})
+	if err != nil {
+		t.Fatalf("Expected PTypeFilter() to be successful; got %v", err)
+	}
+	if err := e.LoadFilteredPolicy(filter); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	if !e.IsFiltered() {
+		t.Error("Expected the adapter to be filtered")
+	}
+	testGetPolicy(t, e, [][]string{})
+	if roles, _ := e.GetRolesForUser("alice"); !reflect.DeepEqual(roles, []string{"data2_admin"}) {
+		t.Errorf("Roles: %v, supposed to be [data2_admin]", roles)
+	}
+}
+
+func TestLoadPolicyByPType(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := a.LoadPolicyByPType(e.GetModel(), "g"); err != nil {
+		t.Fatalf("Expected LoadPolicyByPType() to be successful; got %v", err)
+	}
+	if !a.IsFiltered() {
+		t.Error("Expected the adapter to be filtered")
+	}
+	testGetPolicy(t, e, [][]string{})
+	if err := e.BuildRoleLinks(); err != nil {
+		t.Fatal(err)
+	}
+	if roles, _ := e.GetRolesForUser("alice"); !reflect.DeepEqual(roles, []string{"data2_admin"}) {
+		t.Errorf("Roles: %v, supposed to be [data2_admin]", roles)
+	}
+
+	if err := a.LoadPolicyByPType(e.GetModel(), "p", "g"); err != nil {
+		t.Fatalf("Expected LoadPolicyByPType() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	if err := a.LoadPolicyByPType(e.GetModel()); err == nil {
+		t.Error("Expected LoadPolicyByPType() to fail without a ptype")
+	}
+}
+
+func TestLoadFilteredPolicyOr(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	filters := []interface{}{
+		bson.M{"ptype": "p", "v1": "data2"},
+		bson.M{"ptype": "g", "v1": "data2_admin"},
+		bson.M{"v0": "data2_admin"},
+	}
+	if err := e.LoadFilteredPolicy(filters); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if roles, _ := e.GetRolesForUser("alice"); !reflect.DeepEqual(roles, []string{"data2_admin"}) {
+		t.Errorf("Roles: %v, supposed to be [data2_admin]", roles)
+	}
+
+	if err := e.LoadFilteredPolicy(bson.A{bson.M{"v0": "alice"}}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}})
+
+	if err := e.LoadFilteredPolicy([]interface{}{}); err == nil {
+		t.Error("Expected LoadFilteredPolicy() to fail without filters")
+	}
+	if err := e.LoadFilteredPolicy([]interface{}{bson.M{"v0": "alice"}, bson.M{"$where": "true"}}); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("Expected LoadFilteredPolicy() to fail with ErrInvalidFilter; got %v", err)
+	}
+}
+
+func TestLoadFilteredPolicyClearsModel(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	m := e.GetModel().Copy()
+	for _, filter := range []bson.M{{"v0": "alice"}, {"v0": "bob"}} {
+		if err := a.LoadFilteredPolicy(m, filter); err != nil {
+			t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+		}
+	}
+	rules, _ := m.GetPolicy("p", "p")
+	if want := [][]string{{"bob", "data2", "write"}}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("Policy: %v, supposed to be %v", rules, want)
+	}
+	if groups, _ := m.GetPolicy("g", "g"); len(groups) != 0 {
+		t.Errorf("Grouping policy: %v, supposed to be empty", groups)
+	}
+
+	a = NewAdapter(getDbURL(), DBName(getDbName()), AppendFilteredLoads(true))
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := e.LoadFilteredPolicy(bson.M{"v0": "alice"}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	if err := e.LoadIncrementalFilteredPolicy(bson.M{"v0": "bob"}); err != nil {
+		t.Fatalf("Expected LoadIncrementalFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+}
+
+func TestCheckFilter(t *testing.T) {
+	a := &Adapter{}
+	groups, _ := PTypeFilter([]string{"g", "g2"}, map[int][]string{2: {"domain1"}})
+	valid := []interface{}{
+		&bson.M{"v0": "bob"},
+		groups,
+		bson.M{"$or": bson.A{bson.M{"v0": "alice"}, bson.M{"v1": bson.M{"$regex": "^data", "$options": "i"}}}},
+		bson.D{{Key: "ptype", Value: bson.D{{Key: "$eq", Value: "p"}}}, {Key: "v2", Value: bson.Regex{Pattern: "^re"}}},
+	}
+	for _, filter := range valid {
+		if err := a.checkFilter(filter); err != nil {
+			t.Errorf("Expected %v to be valid; got %v", filter, err)
+		}
+	}
+
+	invalid := []interface{}{
+		bson.M{"$where": "sleep(1000)"},
+		bson.M{"owner": "alice"},
+		bson.M{"v0": bson.M{"$ne": "alice"}},
+		bson.M{"$or": "alice"},
+		bson.M{"$and": bson.A{bson.M{"v0": "alice"}, bson.M{"$expr": true}}},
+		bson.M{"tenant": "acme"},
+		"v0",
+	}
+	for _, filter := range invalid {
+		if err := a.checkFilter(filter); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("Expected %v to fail with ErrInvalidFilter; got %v", filter, err)
+		}
+	}
+
+	a.cfg.Tenant = "acme"
+	if err := a.checkFilter(bson.M{"tenant": "acme"}); err != nil {
+		t.Errorf("Expected the tenant field to be allowed with Tenant; got %v", err)
+	}
+	RawFilters(true)(a)
+	if err := a.checkFilter(bson.M{"$where": "true"}); err != nil {
+		t.Errorf("Expected any filter to be allowed with RawFilters; got %v", err)
+	}
+}
+
+func TestCheckFilterOfReads(t *testing.T) {
+	// The filters are checked before connecting.
+	a := NewAdapter("mongodb://fakeserver:27017/?serverSelectionTimeoutMS=500", LazyConnect(true))
+	filter := bson.M{"$where": "sleep(1000)"}
+	if _, _, err := a.ListPolicies(context.Background(), filter, 0, 0); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("Expected ListPolicies() to fail with ErrInvalidFilter; got %v", err)
+	}
+	var buf bytes.Buffer
+	if err := a.ExportPolicy(context.Background(), &buf, filter); !errors.Is(err, ErrInvalidFilter) {
+		t.Errorf("Expected ExportPolicy() to fail with ErrInvalidFilter; got %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// QueryHint makes filtered loads and filtered removes use the given index,
+// given by name or by key document, e.g. bson.D{{Key: "v1", Value: 1}}, when
+// the query planner picks a bad plan for them. It only applies to selectors
+// constraining some of the v0 to v5 fields, see QueryHintFunc.
+func QueryHint(hint interface{}) func(*Adapter) {
+	return QueryHintFunc(func([]string) interface{} {
+		return hint
+	})
+}
+
+// QueryHintFunc makes filtered loads and filtered removes use the index
+// returned by hint for the rule fields their selector constrains, e.g.
+// ["ptype", "v1", "v2"] for RemoveFilteredPolicy("p", "p", 1, "data1",
+// "read"). A nil hint leaves the choice to the query planner. Hints are not
+// used for the selectors constraining none of the v0 to v5 fields, nor for
+// aggregation pipelines. A write or load failing because the hinted index
+// does not exist reports the hint in its error.
+func QueryHintFunc(hint func(fields []string) interface{}) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.QueryHint = hint
+	}
+}
+
+// queryHint returns the index hint for filter, or nil.
+func (a *Adapter) queryHint(filter interface{}) interface{} {
+	if a.cfg.QueryHint == nil {
+		return nil
+	}
+	fields := ruleFields(filter)
+	for _, field := range fields {
+		if strings.HasPrefix(field, "v") {
+			return a.cfg.QueryHint(fields)
+		}
+	}
+	return nil
+}
+
+// ruleFields returns the rule fields, among ptype and v0 to v5, that filter
+// constrains at its top level, in this order.
+func ruleFields(filter interface{}) []string {
+	var keys []string
+	switch f := filter.(type) {
+	case map[string]interface{}:
+		for k := range f {
+			keys = append(keys, k)
+		}
+	case *map[string]interface{}:
+		return ruleFields(*f)
+	case bson.M:
+		return ruleFields(map[string]interface{}(f))
+	case *bson.M:
+		return ruleFields(map[string]interface{}(*f))
+	case bson.D:
+		for _, e := range f {
+			keys = append(keys, e.Key)
+		}
+	case *bson.D:
+		return ruleFields(*f)
+	}
+
+	var fields []string
+	for _, field := range indexedFields {
+		for _, k := range keys {
+			if k == field {
+				fields = append(fields, field)
+				break
+			}
+		}
+	}
+	return fields
+}
+
+// hintErr adds hint to the error of a query using it, so that an operator
+// can tell which hint to fix when the hinted index does not exist.
+func hintErr(hint interface{}, err error) error {
+	if err == nil || hint == nil {
+		return err
+	}
+	return fmt.Errorf("query hint %v: %w", hint, err)
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestRuleFields(t *testing.T) {
+	tests := []struct {
+		filter interface{}
+		want   []string
+	}{
+		{filteredSelector("p", 1, "data1", "read"), []string{"ptype", "v1", "v2"}},
+		{&bson.M{"v0": "alice", "tenant": "t1"}, []string{"v0"}},
+		{bson.D{{Key: "v2", Value: "read"}, {Key: "ptype", Value: "p"}}, []string{"ptype", "v2"}},
+		{bson.D{}, nil},
+		{"invalid", nil},
+	}
+	for _, test := range tests {
+		if got := ruleFields(test.filter); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Fields of %v: %v, supposed to be %v", test.filter, got, test.want)
+		}
+	}
+
+	a := &Adapter{cfg: Config{QueryHint: func(fields []string) interface{} { return strings.Join(fields, ",") }}}
+	if hint := a.queryHint(filteredSelector("p", 0, "alice")); hint != "ptype,v0" {
+		t.Errorf("Hint: %v, supposed to be ptype,v0", hint)
+	}
+	if hint := a.queryHint(bson.D{{Key: "_id", Value: 1}}); hint != nil {
+		t.Errorf("Expected no hint for a selector without rule values; got %v", hint)
+	}
+}
+
+func TestQueryHint(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), QueryHint("v1_1"))
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	if err := e.LoadFilteredPolicy(bson.M{"v1": "data2"}); err != nil {
+		t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+	if err := a.RemoveFilteredPolicy("p", "p", 1, "data2", "read"); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+
+	a = NewAdapter(getDbURL(), DBName(getDbName()), QueryHint("missing_1"))
+	err := a.RemoveFilteredPolicy("p", "p", 1, "data2")
+	if err == nil || !strings.Contains(err.Error(), "query hint missing_1") {
+		t.Errorf("Expected RemoveFilteredPolicy() to report the missing hinted index; got %v", err)
+	}
+	if err := a.LoadFilteredPolicy(e.GetModel(), bson.M{"v1": "data2"}); err == nil || !strings.Contains(err.Error(), "query hint missing_1") {
+		t.Errorf("Expected LoadFilteredPolicy() to report the missing hinted index; got %v", err)
+	}
+}
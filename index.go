@@ -0,0 +1,288 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// indexedFields are the rule fields indexed by the adapter.
+var indexedFields = []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5"}
+
+// indexFields returns the fields indexed by the adapter in its schema,
+// leaving out the encrypted ones.
+func (a *Adapter) indexFields() []string {
+	if a.cfg.ArraySchema {
+		return arrayIndexedFields
+	}
+	fields := make([]string, 0, len(indexedFields))
+	for _, field := range indexedFields {
+		if !a.encrypted(field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// createIndexes creates single-field indexes on the given fields of
+// collection and returns their names. Indexes that already exist are left
+// untouched. With a collation, the indexes are named after it, e.g.
+// "v0_1_en_2", so that they do not conflict with the indexes of the same
+// fields created without it.
+func createIndexes(ctx context.Context, collection *mongo.Collection, fields []string, collation *options.Collation) ([]string, error) {
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	models := make([]mongo.IndexModel, 0, len(fields))
+	for _, k := range fields {
+		model := mongo.IndexModel{Keys: bson.D{{Key: k, Value: 1}}}
+		if collation != nil {
+			model.Options = options.Index().
+				SetCollation(collation).
+				SetName(fmt.Sprintf("%s_1_%s_%d", k, collation.Locale, collation.Strength))
+		}
+		models = append(models, model)
+	}
+
+	return collection.Indexes().CreateMany(ctx, models)
+}
+
+// ensureIndexes creates the indexes used by the adapter in collection and
+// returns their names: those of the rule fields and, with ExpireRules, the
+// TTL index.
+func (a *Adapter) ensureIndexes(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+	names, err := createIndexes(ctx, collection, a.indexFields(), a.cfg.IndexCollation)
+	if err != nil || !a.cfg.ExpireRules {
+		return names, err
+	}
+
+	name, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: expiresAtField, Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	if err != nil {
+		return names, err
+	}
+	return append(names, name), nil
+}
+
+// ensureWriteIndexes creates the indexes of the adapter before its first
+// write, with EnsureIndexesOnOpen, once even if several writes start
+// concurrently: the others wait for it. The indexes are not created in the
+// transaction ctx may hold, if any, but within its deadline. If the user is
+// not allowed to create them, a warning is logged and the write proceeds
+// without them. Any other error is returned to the write, and the next write
+// tries again.
+func (a *Adapter) ensureWriteIndexes(ctx context.Context) error {
+	if !a.cfg.EnsureIndexes || a.store != nil {
+		return nil
+	}
+
+	a.indexMu.Lock()
+	defer a.indexMu.Unlock()
+	if a.indexed {
+		return nil
+	}
+
+	ictx := context.Background()
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		ictx, cancel = context.WithDeadline(ictx, deadline)
+		defer cancel()
+	}
+
+	err := a.retryThrottled(ictx, func(ctx context.Context) error {
+		_, err := a.ensureIndexes(ctx, a.collection)
+		return err
+	})
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(unauthorizedCode) {
+		a.logger().Warn("mongodbadapter: not allowed to create the indexes of the policy collection; writing without them",
+			slog.String("collection", a.collectionName()), slog.Any("error", err))
+		err = nil
+	}
+	a.indexed = err == nil
+	return err
+}
+
+// resetWriteIndexes makes the next write create the indexes again, after
+// the collection was dropped.
+func (a *Adapter) resetWriteIndexes() {
+	a.indexMu.Lock()
+	a.indexed = false
+	a.indexMu.Unlock()
+}
+
+// EnsureIndexes creates the indexes used by the adapter if they do not exist
+// yet, and returns their names. It is safe to call repeatedly, e.g. to rebuild
+// the indexes after DropIndexes and a bulk import.
+func (a *Adapter) EnsureIndexes(ctx context.Context) ([]string, error) {
+	if err := a.ensureOpen(); err != nil {
+		return nil, a.wrapErr("EnsureIndexes", err)
+	}
+
+	names, err := a.ensureIndexes(ctx, a.collection)
+	return names, a.wrapErr("EnsureIndexes", err)
+}
+
+// EnsureModelIndexes creates compound indexes suited to the ptypes defined by
+// m, if they do not exist yet, and returns the names of those it created.
+// Each index covers ptype and the first two values of a ptype's rules,
+// leaving out priority tokens, e.g. {ptype, v0, v1} for both the p and g
+// rules of an RBAC model with domains, so that a filter on a ptype and its
+// leading values uses a single index. An index whose fields lead another
+// index, existing or created, is not created. With AutoEncryption, the
+// fields following the first encrypted one are left out. They complement
+// the single-field indexes of EnsureIndexes and, like them, are dropped
+// along with the policy collection, e.g. by SavePolicy with SaveDropInsert.
+func (a *Adapter) EnsureModelIndexes(ctx context.Context, m model.Model) ([]string, error) {
+	if err := a.ensureOpen(); err != nil {
+		return nil, a.wrapErr("EnsureModelIndexes", err)
+	}
+
+	names, err := a.ensureModelIndexes(ctx, m)
+	return names, a.wrapErr("EnsureModelIndexes", err)
+}
+
+func (a *Adapter) ensureModelIndexes(ctx context.Context, m model.Model) ([]string, error) {
+	if err := checkModel(m); err != nil {
+		return nil, err
+	}
+
+	var existing [][]string
+	cur, err := a.collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var specs []struct {
+		Key bson.D `bson:"key"`
+	}
+	if err := cur.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+	for _, spec := range specs {
+		keys := make([]string, len(spec.Key))
+		for i, e := range spec.Key {
+			keys[i] = e.Key
+		}
+		existing = append(existing, keys)
+	}
+
+	candidates := a.modelIndexKeys(m)
+	var models []mongo.IndexModel
+	for i, keys := range candidates {
+		if leadsAny(keys, existing) || leadsAny(keys, candidates[i+1:]) {
+			continue
+		}
+		index := make(bson.D, len(keys))
+		name := make([]string, len(keys))
+		for j, k := range keys {
+			index[j] = bson.E{Key: k, Value: 1}
+			name[j] = k + "_1"
+		}
+		model := mongo.IndexModel{Keys: index}
+		if collation := a.cfg.IndexCollation; collation != nil {
+			model.Options = options.Index().
+				SetCollation(collation).
+				SetName(fmt.Sprintf("%s_%s_%d", strings.Join(name, "_"), collation.Locale, collation.Strength))
+		}
+		models = append(models, model)
+	}
+	if len(models) == 0 {
+		return nil, nil
+	}
+	return a.collection.Indexes().CreateMany(ctx, models)
+}
+
+// modelIndexKeys returns the distinct fields of the compound indexes of
+// EnsureModelIndexes for the ptypes of m, sorted.
+func (a *Adapter) modelIndexKeys(m model.Model) [][]string {
+	seen := make(map[string]bool)
+	var candidates [][]string
+	for _, sec := range []string{"p", "g"} {
+		for ptype, ast := range m[sec] {
+			tokens := ast.Tokens
+			if len(tokens) == 0 {
+				// Grouping tokens are only parsed by recent versions of casbin.
+				tokens = strings.Split(ast.Value, ",")
+			}
+
+			keys := []string{"ptype"}
+			for i, token := range tokens {
+				if len(keys) == 3 || i > 5 {
+					break
+				}
+				if token == ptype+"_"+priorityField {
+					continue
+				}
+				field := fmt.Sprintf("v%d", i)
+				if a.encrypted(field) {
+					break
+				}
+				if a.cfg.ArraySchema {
+					field = arrayField(field)
+				}
+				keys = append(keys, field)
+			}
+			if len(keys) == 1 || seen[strings.Join(keys, ",")] {
+				continue
+			}
+			seen[strings.Join(keys, ",")] = true
+			candidates = append(candidates, keys)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return strings.Join(candidates[i], ",") < strings.Join(candidates[j], ",")
+	})
+	return candidates
+}
+
+// leadsAny reports whether keys are the leading fields of one of indexes.
+func leadsAny(keys []string, indexes [][]string) bool {
+	for _, index := range indexes {
+		if len(index) < len(keys) {
+			continue
+		}
+		leads := true
+		for i, k := range keys {
+			leads = leads && index[i] == k
+		}
+		if leads {
+			return true
+		}
+	}
+	return false
+}
+
+// DropIndexes drops all indexes of the policy collection except the one on
+// _id.
+func (a *Adapter) DropIndexes(ctx context.Context) error {
+	if err := a.ensureOpen(); err != nil {
+		return a.wrapErr("DropIndexes", err)
+	}
+
+	return a.wrapErr("DropIndexes", a.collection.Indexes().DropAll(ctx))
+}
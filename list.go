@@ -0,0 +1,84 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// ListPolicies returns a page of the stored rules matching filter, each as
+// its ptype followed by its values, along with the total number of matching
+// rules. The rules are sorted by _id, so that pages do not overlap as rules
+// are added. A nil filter matches all rules and a zero limit returns all the
+// rules after offset. Other filters are checked as by LoadFilteredPolicy, see
+// RawFilters.
+func (a *Adapter) ListPolicies(ctx context.Context, filter interface{}, offset, limit int64) ([][]string, int64, error) {
+	if offset < 0 || limit < 0 {
+		return nil, 0, a.wrapErr("ListPolicies", errors.New("offset and limit must not be negative"))
+	}
+	if filter == nil {
+		filter = bson.D{}
+	} else if err := a.checkFilter(filter); err != nil {
+		return nil, 0, a.wrapErr("ListPolicies", err)
+	}
+	filter = a.liveFilter(filter)
+	if err := a.ensureOpen(); err != nil {
+		return nil, 0, a.wrapErr("ListPolicies", err)
+	}
+
+	countOpts := options.Count()
+	findOpts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetSkip(offset).
+		SetLimit(limit)
+	if collation := a.collation(); collation != nil {
+		countOpts.SetCollation(collation)
+		findOpts.SetCollation(collation)
+	}
+
+	var total int64
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		total, err = a.collection.CountDocuments(ctx, filter, countOpts)
+		return err
+	})
+	if err != nil {
+		return nil, 0, a.wrapErr("ListPolicies", err)
+	}
+
+	var cur *mongo.Cursor
+	err = a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, filter, findOpts)
+		return err
+	})
+	if err != nil {
+		return nil, 0, a.wrapErr("ListPolicies", err)
+	}
+	defer cur.Close(ctx)
+
+	rules := [][]string{}
+	for cur.Next(ctx) {
+		var line CasbinRule
+		if err := cur.Decode(&line); err != nil {
+			return nil, 0, a.wrapErr("ListPolicies", err)
+		}
+		rules = append(rules, append([]string{line.PType}, line.tokens()...))
+	}
+	return rules, total, a.wrapErr("ListPolicies", cur.Err())
+}
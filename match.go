@@ -0,0 +1,398 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// errUnsupportedOperator is returned for the query operators the in-memory
+// store does not implement.
+var errUnsupportedOperator = errors.New("query operator not supported by the in-memory adapter")
+
+// matchDocument reports whether doc matches the selector filter, both in the
+// form returned by canonical, as the server would for the operators the
+// adapter and RawFilters use: $and, $or, $nor, $eq, $ne, $in, $nin,
+// $exists, $gt, $gte, $lt, $lte, $regex and $not. Fields are looked up by
+// path, e.g. vals.1, and a condition on an array field matches if it holds
+// for the array or for any of its elements.
+func matchDocument(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		var ok bool
+		var err error
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			ok, err = matchLogical(doc, e.Key, e.Value)
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return false, fmt.Errorf("%w: %s", errUnsupportedOperator, e.Key)
+			}
+			value, found := lookupField(doc, e.Key)
+			ok, err = matchCondition(value, found, e.Value)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchLogical evaluates the $and, $or or $nor clauses of op against doc.
+func matchLogical(doc bson.D, op string, value interface{}) (bool, error) {
+	clauses, ok := value.(bson.A)
+	if !ok || len(clauses) == 0 {
+		return false, fmt.Errorf("%s must be a non-empty array", op)
+	}
+	for _, clause := range clauses {
+		sub, ok := clause.(bson.D)
+		if !ok {
+			return false, fmt.Errorf("%s must hold documents", op)
+		}
+		matched, err := matchDocument(doc, sub)
+		if err != nil {
+			return false, err
+		}
+		switch {
+		case op == "$and" && !matched:
+			return false, nil
+		case op == "$or" && matched:
+			return true, nil
+		case op == "$nor" && matched:
+			return false, nil
+		}
+	}
+	return op != "$or", nil
+}
+
+// lookupField returns the value at path in doc, e.g. vals.1 for the second
+// element of vals, and whether there is one.
+func lookupField(doc bson.D, path string) (interface{}, bool) {
+	var value interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case bson.D:
+			found := false
+			for _, e := range v {
+				if e.Key == part {
+					value, found = e.Value, true
+					break
+				}
+			}
+			if !found {
+				return nil, false
+			}
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// matchCondition reports whether value, found or missing, satisfies cond,
+// either a document of operators or a value to be equal to.
+func matchCondition(value interface{}, found bool, cond interface{}) (bool, error) {
+	ops, ok := cond.(bson.D)
+	if !ok || len(ops) == 0 || !strings.HasPrefix(ops[0].Key, "$") {
+		return matchEqual(value, found, cond), nil
+	}
+
+	for _, op := range ops {
+		var ok bool
+		var err error
+		switch op.Key {
+		case "$eq":
+			ok = matchEqual(value, found, op.Value)
+		case "$ne":
+			ok = !matchEqual(value, found, op.Value)
+		case "$in", "$nin":
+			list, isArray := op.Value.(bson.A)
+			if !isArray {
+				return false, fmt.Errorf("%s needs an array", op.Key)
+			}
+			for _, want := range list {
+				if ok = matchEqual(value, found, want); ok {
+					break
+				}
+			}
+			if op.Key == "$nin" {
+				ok = !ok
+			}
+		case "$exists":
+			ok = found == truthy(op.Value)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = matchAny(value, func(v interface{}) bool {
+				c, comparable := compareValues(v, op.Value)
+				if !comparable {
+					return false
+				}
+				switch op.Key {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				}
+				return c <= 0
+			})
+		case "$regex":
+			ok, err = matchRegex(value, op.Value, ops)
+		case "$options":
+			// Read along with $regex.
+			continue
+		case "$not":
+			ok, err = matchCondition(value, found, op.Value)
+			ok = !ok
+		default:
+			return false, fmt.Errorf("%w: %s", errUnsupportedOperator, op.Key)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchEqual reports whether value, found or missing, equals want. Null
+// matches a missing field, a regular expression the strings it matches.
+func matchEqual(value interface{}, found bool, want interface{}) bool {
+	if want == nil {
+		return !found || value == nil
+	}
+	if !found {
+		return false
+	}
+	if re, ok := want.(bson.Regex); ok {
+		matched, err := matchRegex(value, re, nil)
+		return err == nil && matched
+	}
+	if equalValues(value, want) {
+		return true
+	}
+	if _, ok := want.(bson.A); ok {
+		return false
+	}
+	return matchAny(value, func(v interface{}) bool { return equalValues(v, want) })
+}
+
+// matchAny reports whether match holds for the elements of value, if it is
+// an array, or for value itself otherwise.
+func matchAny(value interface{}, match func(interface{}) bool) bool {
+	array, ok := value.(bson.A)
+	if !ok {
+		return match(value)
+	}
+	for _, v := range array {
+		if match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRegex reports whether value, or one of its elements, is a string
+// matched by pattern, a string with the $options of ops or a bson.Regex.
+func matchRegex(value interface{}, pattern interface{}, ops bson.D) (bool, error) {
+	var expr, flags string
+	switch p := pattern.(type) {
+	case string:
+		expr = p
+	case bson.Regex:
+		expr, flags = p.Pattern, p.Options
+	default:
+		return false, fmt.Errorf("$regex needs a string, got %T", pattern)
+	}
+	for _, op := range ops {
+		if op.Key == "$options" {
+			s, _ := op.Value.(string)
+			flags += s
+		}
+	}
+
+	var inline string
+	for _, f := range flags {
+		switch f {
+		case 'i', 'm', 's':
+			inline += string(f)
+		default:
+			return false, fmt.Errorf("%w: regular expression option %q", errUnsupportedOperator, f)
+		}
+	}
+	if inline != "" {
+		expr = "(?" + inline + ")" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return false, err
+	}
+	return matchAny(value, func(v interface{}) bool {
+		s, ok := v.(string)
+		return ok && re.MatchString(s)
+	}), nil
+}
+
+// truthy reports whether v, the operand of $exists, is true.
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case nil:
+		return false
+	}
+	c, ok := compareValues(v, int32(0))
+	return !ok || c != 0
+}
+
+// equalValues reports whether a and b are equal, numbers comparing by value
+// whatever their type.
+func equalValues(a, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compareValues compares a and b if they are of the same kind, numbers,
+// strings, booleans, dates or object IDs, and reports whether they are.
+func compareValues(a, b interface{}) (int, bool) {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case y:
+				return -1, true
+			}
+			return 1, true
+		}
+	case bson.DateTime:
+		if y, ok := b.(bson.DateTime); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case bson.ObjectID:
+		if y, ok := b.(bson.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	}
+	return 0, false
+}
+
+// number returns v as a float64 if it is a number.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// typeOrder returns the rank of the type of v in the order in which the
+// server sorts values of different types.
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return 0
+	case int32, int64, float64:
+		return 1
+	case string:
+		return 2
+	case bson.D:
+		return 3
+	case bson.A:
+		return 4
+	case bson.ObjectID:
+		return 5
+	case bool:
+		return 6
+	case bson.DateTime:
+		return 7
+	}
+	return 8
+}
+
+// sortDocuments sorts docs by the fields of order, in the form returned by
+// canonical, each with 1 for an ascending or -1 for a descending order.
+// Documents missing a field sort first, as if it were null, and documents
+// equal on all fields keep their order.
+func sortDocuments(docs []bson.D, order bson.D) error {
+	for _, e := range order {
+		if dir, ok := number(e.Value); !ok || (dir != 1 && dir != -1) {
+			return fmt.Errorf("invalid sort order %v for %s", e.Value, e.Key)
+		}
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, e := range order {
+			a, _ := lookupField(docs[i], e.Key)
+			b, _ := lookupField(docs[j], e.Key)
+			c, ok := compareValues(a, b)
+			if !ok {
+				c = typeOrder(a) - typeOrder(b)
+			}
+			if dir, _ := number(e.Value); dir < 0 {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return nil
+}
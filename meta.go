@@ -0,0 +1,107 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// defaultMetadataField is the field holding the metadata of a rule added with
+// AddPolicyWithMeta, unless set with MetadataField.
+const defaultMetadataField = "meta"
+
+// MetadataField sets the field holding the metadata of the rules added with
+// AddPolicyWithMeta. It defaults to "meta", and cannot be a field of the
+// rules themselves, such as ptype or v0.
+func MetadataField(name string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.MetadataField = name
+	}
+}
+
+// metadataField returns the field holding the metadata of rules.
+func (a *Adapter) metadataField() string {
+	if a.cfg.MetadataField == "" {
+		return defaultMetadataField
+	}
+	return a.cfg.MetadataField
+}
+
+// validateMetadataField checks that the metadata field is a top-level field
+// that no rule field conflicts with.
+func validateMetadataField(name string) error {
+	switch name {
+	case "":
+		return nil
+	case "_id", "ptype", sectionField, "v0", "v1", "v2", "v3", "v4", "v5", valsField, tenantField, "priority",
+		deletedAtField, expiresAtField, updatedAtField:
+		return fmt.Errorf("metadata field %q is a rule field", name)
+	}
+	if strings.HasPrefix(name, "$") || strings.ContainsAny(name, ".\x00") {
+		return fmt.Errorf("invalid metadata field %q", name)
+	}
+	return nil
+}
+
+// AddPolicyWithMeta adds a policy rule to the storage along with meta, e.g.
+// {"createdBy": "alice"}, stored as a document in the field set with
+// MetadataField, for audit queries run on the collection. Its createdAt key
+// is set to the current time unless meta has one. Loads ignore the metadata,
+// which SavePolicy does not keep, except with SaveDiff for the rules it
+// leaves in place. Buffered writes are flushed first, and the rule is
+// inserted immediately.
+func (a *Adapter) AddPolicyWithMeta(sec string, ptype string, rule []string, meta map[string]interface{}) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(context.TODO(), "AddPolicyWithMeta", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return a.wrapErr("AddPolicyWithMeta", err)
+	}
+
+	doc := make(bson.M, len(meta)+1)
+	for k, v := range meta {
+		doc[k] = v
+	}
+	if _, ok := doc["createdAt"]; !ok {
+		doc["createdAt"] = time.Now()
+	}
+
+	line := a.policyLine(sec, ptype, rule)
+	_, err := a.addDocument(ctx, line, a.documentWith(line, bson.M{a.metadataField(): doc}))
+	return a.wrapErr("AddPolicyWithMeta", err)
+}
+
+// documentWith returns the document storing line, as document does, with the
+// fields of extra.
+func (a *Adapter) documentWith(line CasbinRule, extra bson.M) interface{} {
+	if a.cfg.ArraySchema {
+		return struct {
+			Rule  arrayRule `bson:",inline"`
+			Extra bson.M    `bson:",inline"`
+		}{a.document(line).(arrayRule), extra}
+	}
+	return struct {
+		Rule  CasbinRule `bson:",inline"`
+		Extra bson.M     `bson:",inline"`
+	}{line, extra}
+}
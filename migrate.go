@@ -0,0 +1,143 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/casbin/casbin/v2/model"
+	"github.com/casbin/casbin/v2/persist"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// MigrateOptions controls MigrateFrom.
+type MigrateOptions struct {
+	// Force replaces the stored rules instead of refusing to migrate into a
+	// non-empty collection.
+	Force bool
+	// Verify loads the policy back after writing it and fails if it differs
+	// from the source policy.
+	Verify bool
+}
+
+// MigrateFrom copies the policy stored by src, e.g. another casbin adapter,
+// into the policy collection and returns the number of rules copied per
+// ptype. The policy is loaded into a copy of m, which is left unchanged, and
+// written in batches as with SavePolicy. It fails with ErrNotEmpty if the
+// collection already holds rules, unless opts.Force is set.
+func (a *Adapter) MigrateFrom(ctx context.Context, src persist.Adapter, m model.Model, opts MigrateOptions) (map[string]int64, error) {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if err := a.ensureOpen(); err != nil {
+		return nil, a.wrapErr("MigrateFrom", err)
+	}
+
+	if !opts.Force {
+		if err := a.flush(ctx); err != nil {
+			return nil, a.wrapErr("MigrateFrom", err)
+		}
+		var n int64
+		err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+			n, err = a.collection.CountDocuments(ctx, a.liveFilter(bson.D{}), options.Count().SetLimit(1))
+			return err
+		})
+		if err != nil {
+			return nil, a.wrapErr("MigrateFrom", err)
+		}
+		if n > 0 {
+			return nil, a.wrapErr("MigrateFrom", ErrNotEmpty)
+		}
+	}
+
+	source := m.Copy()
+	clearPolicy(source)
+	if err := src.LoadPolicy(source); err != nil {
+		return nil, a.wrapErr("MigrateFrom", fmt.Errorf("loading source policy: %w", err))
+	}
+
+	if err := a.replaceAll(ctx, a.modelLines(source)); err != nil {
+		return nil, a.wrapErr("MigrateFrom", err)
+	}
+	if err := a.noteWrite(ctx); err != nil {
+		return nil, a.wrapErr("MigrateFrom", err)
+	}
+
+	counts := make(map[string]int64)
+	for _, sec := range policySections(source) {
+		for ptype, ast := range source[sec] {
+			if len(ast.Policy) > 0 {
+				counts[ptype] = int64(len(ast.Policy))
+			}
+		}
+	}
+
+	if opts.Verify {
+		stored := m.Copy()
+		clearPolicy(stored)
+		// Loading into a private model must not change what IsFiltered
+		// reports about the policy loaded by the caller.
+		if err := a.loadRules(ctx, stored, nil); err != nil {
+			return counts, a.wrapErr("MigrateFrom", err)
+		}
+		if err := comparePolicies(source, stored); err != nil {
+			return counts, a.wrapErr("MigrateFrom", err)
+		}
+	}
+
+	return counts, nil
+}
+
+// comparePolicies returns an error describing the first ptype whose rules
+// differ between want and got.
+func comparePolicies(want, got model.Model) error {
+	for _, sec := range policySections(want) {
+		ptypes := make(map[string]bool)
+		for ptype := range want[sec] {
+			ptypes[ptype] = true
+		}
+		for ptype := range got[sec] {
+			ptypes[ptype] = true
+		}
+
+		for ptype := range ptypes {
+			wantRules := ruleSet(want, sec, ptype)
+			gotRules := ruleSet(got, sec, ptype)
+			if len(wantRules) != len(gotRules) {
+				return fmt.Errorf("verification failed: %d %s rules in source, %d stored", len(wantRules), ptype, len(gotRules))
+			}
+			for rule := range wantRules {
+				if !gotRules[rule] {
+					return fmt.Errorf("verification failed: %s rule %q not stored", ptype, strings.Split(rule, "\x00"))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ruleSet returns the rules of the given ptype in m, joined by NUL bytes.
+func ruleSet(m model.Model, sec string, ptype string) map[string]bool {
+	set := make(map[string]bool)
+	if ast, ok := m[sec][ptype]; ok {
+		for _, rule := range ast.Policy {
+			set[strings.Join(rule, "\x00")] = true
+		}
+	}
+	return set
+}
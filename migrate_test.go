@@ -0,0 +1,63 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	fileadapter "github.com/casbin/casbin/v2/persist/file-adapter"
+)
+
+func TestMigrateFrom(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	src := fileadapter.NewAdapter("examples/rbac_policy.csv")
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	ctx := context.Background()
+
+	if _, err := a.MigrateFrom(ctx, src, e.GetModel(), MigrateOptions{}); !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("Expected MigrateFrom() to fail with ErrNotEmpty; got %v", err)
+	}
+
+	counts, err := a.MigrateFrom(ctx, src, e.GetModel(), MigrateOptions{Force: true, Verify: true})
+	if err != nil {
+		t.Fatalf("Expected MigrateFrom() to be successful; got %v", err)
+	}
+	if len(counts) != 2 || counts["p"] != 4 || counts["g"] != 1 {
+		t.Errorf("Counts: %v, supposed to be map[g:1 p:4]", counts)
+	}
+
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+}
+
+func TestComparePolicies(t *testing.T) {
+	want := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv").GetModel()
+	got := want.Copy()
+	if err := comparePolicies(want, got); err != nil {
+		t.Errorf("Expected identical policies to compare equal; got %v", err)
+	}
+
+	if _, err := got.RemovePolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := comparePolicies(want, got); err == nil {
+		t.Error("Expected policies with different rules not to compare equal")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"strings"
+)
+
+// NormalizeValues makes the adapter normalize rule values, so that a value
+// is stored and matched the same whether it comes from the API or from a
+// policy file: surrounding whitespace is trimmed, and a value quoted as in a
+// CSV file, e.g. "GET, POST" with its double quotes, is unquoted. Values are
+// normalized when writing and matching rules and again when loading them, so
+// that rules stored before the option was enabled load normalized without
+// being rewritten.
+func NormalizeValues(normalize bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.NormalizeValues = normalize
+	}
+}
+
+// normalizeValue trims v and unquotes it if it is quoted.
+func normalizeValue(v string) string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = strings.ReplaceAll(v[1:len(v)-1], `""`, `"`)
+	}
+	return v
+}
+
+// normalizeRule returns the values of rule normalized with NormalizeValues,
+// or rule itself without it.
+func (a *Adapter) normalizeRule(rule []string) []string {
+	if !a.cfg.NormalizeValues {
+		return rule
+	}
+	normalized := make([]string, len(rule))
+	for i, v := range rule {
+		normalized[i] = normalizeValue(v)
+	}
+	return normalized
+}
+
+// normalizeLine normalizes the values of line with NormalizeValues.
+func (a *Adapter) normalizeLine(line CasbinRule) CasbinRule {
+	if !a.cfg.NormalizeValues {
+		return line
+	}
+	for _, v := range []*string{&line.V0, &line.V1, &line.V2, &line.V3, &line.V4, &line.V5} {
+		*v = normalizeValue(*v)
+	}
+	return line
+}
+
+// fieldSelector returns the selector of filteredSelector for the normalized
+// fieldValues. A value normalizing to an empty one is kept as is, so that it
+// does not turn into a wildcard.
+func (a *Adapter) fieldSelector(ptype string, fieldIndex int, fieldValues ...string) map[string]interface{} {
+	if a.cfg.NormalizeValues {
+		normalized := make([]string, len(fieldValues))
+		for i, v := range fieldValues {
+			if normalized[i] = normalizeValue(v); normalized[i] == "" {
+				normalized[i] = v
+			}
+		}
+		fieldValues = normalized
+	}
+	return filteredSelector(ptype, fieldIndex, fieldValues...)
+}
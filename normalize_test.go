@@ -0,0 +1,87 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	for _, tc := range []struct {
+		value, want string
+	}{
+		{"alice", "alice"},
+		{"  alice\t", "alice"},
+		{`"GET, POST"`, "GET, POST"},
+		{` "say ""hi""" `, `say "hi"`},
+		{`"`, `"`},
+		{`"unbalanced`, `"unbalanced`},
+		{" données ", "données"},
+		{" ユーザー　", "ユーザー"},
+	} {
+		if got := normalizeValue(tc.value); got != tc.want {
+			t.Errorf("normalizeValue(%q) = %q, supposed to be %q", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeValues(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := NewAdapter(getDbURL(), DBName(getDbName()), NormalizeValues(true))
+	ctx := context.Background()
+	if err := a.AddPolicy("p", "p", []string{" carol ", `"data, 3"`, "read"}); err != nil {
+		t.Errorf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.ImportPolicy(ctx, strings.NewReader("p, dave, \"data, 4\", read\np, ユーザー, données, read\n"), ImportMerge); err != nil {
+		t.Errorf("Expected ImportPolicy() to be successful; got %v", err)
+	}
+	if ok, err := a.HasPolicy(ctx, "p", []string{"ユーザー ", " données", "read"}); err != nil || !ok {
+		t.Errorf("Expected the imported rule to be found; got %t (%v)", ok, err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"},
+		{"carol", "data, 3", "read"}, {"dave", "data, 4", "read"}, {"ユーザー", "données", "read"},
+	})
+
+	var buf bytes.Buffer
+	if err := a.ExportPolicy(ctx, &buf, map[string]interface{}{"v0": "carol"}); err != nil {
+		t.Errorf("Expected ExportPolicy() to be successful; got %v", err)
+	}
+	if buf.String() != "p, carol, \"data, 3\", read\n" {
+		t.Errorf("Exported %q, supposed to be %q", buf.String(), "p, carol, \"data, 3\", read\n")
+	}
+
+	if ok, err := a.HasPolicy(ctx, "p", []string{"carol", "data, 3", "read "}); err != nil || !ok {
+		t.Errorf("Expected the normalized rule to be found; got %t (%v)", ok, err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{`"carol"`, `"data, 3"`, "read"}); err != nil {
+		t.Errorf("Expected RemovePolicy() to be successful; got %v", err)
+	}
+	if err := a.RemoveFilteredPolicy("p", "p", 0, " ユーザー "); err != nil {
+		t.Errorf("Expected RemoveFilteredPolicy() to be successful; got %v", err)
+	}
+	e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+	testGetPolicy(t, e, [][]string{
+		{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"},
+		{"dave", "data, 4", "read"},
+	})
+}
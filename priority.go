@@ -0,0 +1,75 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"strconv"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// priorityField is the field holding the priority of a rule of a priority
+// model.
+const priorityField = "priority"
+
+// notePriorityTokens records the position of the priority token in the rules
+// of each ptype of model, e.g. 0 for "p = priority, sub, obj, act, eft", so
+// that the rules written afterwards store their priority in the priority
+// field and are loaded by increasing priority.
+func (a *Adapter) notePriorityTokens(model model.Model) {
+	indexes := make(map[string]int)
+	for ptype, ast := range model["p"] {
+		for i, token := range ast.Tokens {
+			if token == ptype+"_"+priorityField {
+				indexes[ptype] = i
+			}
+		}
+	}
+
+	a.priorityMu.Lock()
+	a.priorityIndex = indexes
+	a.priorityMu.Unlock()
+}
+
+// rulePriority returns the priority of a rule of the given ptype, or 0 if
+// its ptype has no priority token or the priority is not an integer.
+func (a *Adapter) rulePriority(ptype string, rule []string) int {
+	a.priorityMu.Lock()
+	i, ok := a.priorityIndex[ptype]
+	a.priorityMu.Unlock()
+
+	if !ok || i >= len(rule) {
+		return 0
+	}
+	priority, err := strconv.Atoi(rule[i])
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// prioritySort returns the sort loading rules by increasing priority, as
+// casbin evaluates them, if the last model seen has a priority token, and
+// nil otherwise.
+func (a *Adapter) prioritySort() bson.D {
+	a.priorityMu.Lock()
+	defer a.priorityMu.Unlock()
+
+	if len(a.priorityIndex) == 0 {
+		return nil
+	}
+	return bson.D{{Key: priorityField, Value: 1}, {Key: "_id", Value: 1}}
+}
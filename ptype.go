@@ -0,0 +1,108 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// RemovePoliciesByPtype removes all the stored rules of the given ptype,
+// e.g. "g2", and returns the number of rules removed.
+func (a *Adapter) RemovePoliciesByPtype(ctx context.Context, ptype string) (int64, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("RemovePoliciesByPtype", err)
+	}
+	ctx, done := a.startOp(ctx, "RemovePoliciesByPtype", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return 0, a.wrapErr("RemovePoliciesByPtype", err)
+	}
+
+	n, err := a.removeMany(ctx, bson.D{{Key: "ptype", Value: ptype}})
+	if err != nil {
+		return n, a.wrapErr("RemovePoliciesByPtype", err)
+	}
+	return n, a.wrapErr("RemovePoliciesByPtype", a.noteWrite(ctx))
+}
+
+// ReplacePoliciesByPtype replaces the stored rules of the given ptype with
+// rules, leaving the other ptypes untouched, e.g. to refresh a regenerated
+// resource hierarchy without saving the whole model. On a replica set or a
+// sharded cluster, the rules are replaced in a transaction, so that the
+// previous rules are kept if it fails. Otherwise they are removed, then
+// inserted in batches.
+func (a *Adapter) ReplacePoliciesByPtype(ctx context.Context, ptype string, rules [][]string) error {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if err := a.ensureOpen(); err != nil {
+		return a.wrapErr("ReplacePoliciesByPtype", err)
+	}
+	ctx, done := a.startOp(ctx, "ReplacePoliciesByPtype", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return a.wrapErr("ReplacePoliciesByPtype", err)
+	}
+
+	lines := make([]interface{}, 0, len(rules))
+	for _, rule := range rules {
+		line := a.policyLine("", ptype, rule)
+		lines = append(lines, &line)
+	}
+
+	if err := a.inTransaction(ctx, func(ctx context.Context) error {
+		if _, err := a.removeMany(ctx, bson.D{{Key: "ptype", Value: ptype}}); err != nil {
+			return err
+		}
+		return a.insertMany(ctx, lines)
+	}); err != nil {
+		return a.wrapErr("ReplacePoliciesByPtype", err)
+	}
+	return a.wrapErr("ReplacePoliciesByPtype", a.noteWrite(ctx))
+}
+
+// inTransaction runs fn in a transaction, or directly if the server does not
+// support transactions, e.g. a standalone server.
+func (a *Adapter) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	sess, err := a.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		return nil, fn(ctx)
+	})
+	if transactionsUnsupported(err) {
+		return fn(ctx)
+	}
+	return err
+}
+
+// transactionsUnsupported reports whether err was caused by the server not
+// supporting transactions.
+func transactionsUnsupported(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCodeWithMessage(illegalOperation, "Transaction numbers")
+}
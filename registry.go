@@ -0,0 +1,42 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// Registry makes the adapter encode and decode rules with r instead of the
+// registry of its client, e.g. to register custom codecs for CasbinRule. The
+// same registry is used for every read and write, so a rule stored by
+// AddPolicy decodes identically in LoadPolicy. Without it, the client's
+// registry is used, which is the driver's default one unless set in the
+// client options.
+func Registry(r *bson.Registry) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.Registry = r
+	}
+}
+
+// collectionIn returns the collection name of db, using the adapter's
+// registry if one was set.
+func (a *Adapter) collectionIn(db *mongo.Database, name string) *mongo.Collection {
+	if a.cfg.Registry == nil {
+		return db.Collection(name)
+	}
+	return db.Collection(name, options.Collection().SetRegistry(a.cfg.Registry))
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Reloadable is the part of an enforcer AutoReload needs, implemented by
+// *casbin.Enforcer and *casbin.SyncedEnforcer.
+type Reloadable interface {
+	LoadPolicy() error
+}
+
+// AutoReload keeps e in sync with the stored policy: it watches the policy
+// collection with a change stream and calls e.LoadPolicy once interval has
+// elapsed after the first change seen, so that a burst of writes causes a
+// single reload. A failed reload is retried after interval, and the change
+// stream is reopened after interval if it fails. Since e is reloaded from
+// another goroutine, it should be a *casbin.SyncedEnforcer. Change streams
+// require a replica set or a sharded cluster.
+//
+// Calling AutoReload again replaces the enforcer kept in sync. Watching stops
+// on Close.
+func (a *Adapter) AutoReload(e Reloadable, interval time.Duration) error {
+	if interval <= 0 {
+		return a.wrapErr("AutoReload", errors.New("reload interval must be positive"))
+	}
+	if err := a.checkChangeStreams(); err != nil {
+		return a.wrapErr("AutoReload", err)
+	}
+	if err := a.ensureOpen(); err != nil {
+		return a.wrapErr("AutoReload", err)
+	}
+
+	a.stopAutoReload()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := a.collection.Watch(ctx, mongo.Pipeline{})
+	if err != nil {
+		cancel()
+		return a.wrapErr("AutoReload", err)
+	}
+
+	done := make(chan struct{})
+	a.reloadMu.Lock()
+	a.stopReload = cancel
+	a.reloadDone = done
+	a.reloadMu.Unlock()
+
+	go a.watchPolicy(ctx, done, stream, e, interval)
+	return nil
+}
+
+// stopAutoReload stops watching the policy collection and waits for the
+// watching goroutine to exit.
+func (a *Adapter) stopAutoReload() {
+	a.reloadMu.Lock()
+	cancel, done := a.stopReload, a.reloadDone
+	a.stopReload, a.reloadDone = nil, nil
+	if a.reloadTimer != nil {
+		a.reloadTimer.Stop()
+		a.reloadTimer = nil
+	}
+	a.reloadMu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// watchPolicy schedules a reload of e for each change read from stream, and
+// reopens the stream when it ends, until ctx is canceled.
+func (a *Adapter) watchPolicy(ctx context.Context, done chan struct{}, stream *mongo.ChangeStream, e Reloadable, interval time.Duration) {
+	defer close(done)
+
+	changed := func() { a.scheduleReload(ctx, e, interval) }
+	for {
+		err := readChanges(ctx, stream, changed)
+		for ctx.Err() == nil {
+			if err != nil {
+				timer := time.NewTimer(interval)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				case <-timer.C:
+				}
+			}
+
+			var werr error
+			stream, werr = a.collection.Watch(ctx, mongo.Pipeline{})
+			if werr == nil {
+				break
+			}
+			err = werr
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// Changes made while the stream was broken went unseen.
+			changed()
+		}
+	}
+}
+
+// readChanges calls changed for each change read from stream, and closes it.
+// It returns when the stream is invalidated, e.g. because SavePolicy dropped
+// the collection, or fails.
+func readChanges(ctx context.Context, stream *mongo.ChangeStream, changed func()) error {
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event struct {
+			OperationType string `bson:"operationType"`
+		}
+		if err := stream.Decode(&event); err != nil {
+			return err
+		}
+		changed()
+		if event.OperationType == "invalidate" {
+			return nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return stream.Err()
+}
+
+// scheduleReload reloads e once interval has elapsed, unless a reload is
+// already scheduled.
+func (a *Adapter) scheduleReload(ctx context.Context, e Reloadable, interval time.Duration) {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	if ctx.Err() != nil || a.reloadTimer != nil {
+		return
+	}
+	a.reloadTimer = time.AfterFunc(interval, func() {
+		a.reloadMu.Lock()
+		a.reloadTimer = nil
+		a.reloadMu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		// Another instance changed the policy, so a cached one is stale.
+		a.InvalidateCache()
+		if err := e.LoadPolicy(); err != nil {
+			a.scheduleReload(ctx, e, interval)
+		}
+	})
+}
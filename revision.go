@@ -0,0 +1,231 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// metaCollection is the collection holding the revision of each policy.
+const metaCollection = "casbin_meta"
+
+// OptimisticConcurrency makes the adapter maintain a revision of the stored
+// policy in the casbin_meta collection, incremented by every write, and makes
+// SavePolicy fail with ErrConcurrentModification if the policy was modified
+// since it was last loaded or saved by the adapter. The caller can then
+// reload the policy and retry.
+func OptimisticConcurrency(enabled bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.OptimisticConcurrency = enabled
+	}
+}
+
+// metaID returns the _id of the document holding the policy's revision.
+func (a *Adapter) metaID() string {
+	if a.cfg.Tenant == "" {
+		return a.cfg.CollectionName
+	}
+	return a.cfg.CollectionName + "/" + a.cfg.Tenant
+}
+
+// meta returns the collection holding the policy's revision.
+func (a *Adapter) meta() *mongo.Collection {
+	return a.collectionIn(a.collection.Database(), metaCollection)
+}
+
+// PolicyRevision returns the revision of the stored policy, so that an
+// instance can tell that the policy it loaded is stale without reloading it.
+// It is 0 until the policy is first written with OptimisticConcurrency.
+func (a *Adapter) PolicyRevision(ctx context.Context) (int64, error) {
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("PolicyRevision", err)
+	}
+
+	rev, err := a.readRevision(ctx)
+	return rev, a.wrapErr("PolicyRevision", err)
+}
+
+func (a *Adapter) readRevision(ctx context.Context) (int64, error) {
+	ctx, cancel := a.opContext(ctx)
+	defer cancel()
+
+	var doc struct {
+		Revision int64 `bson:"revision"`
+	}
+	err := a.meta().FindOne(ctx, bson.D{{Key: "_id", Value: a.metaID()}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return doc.Revision, err
+}
+
+// noteLoad records the revision of the policy about to be loaded.
+func (a *Adapter) noteLoad(ctx context.Context) error {
+	if !a.cfg.OptimisticConcurrency {
+		return nil
+	}
+
+	rev, err := a.readRevision(ctx)
+	if err != nil {
+		return err
+	}
+	a.setRevision(rev)
+	return nil
+}
+
+// currentRevision returns the revision last loaded or saved.
+func (a *Adapter) currentRevision() int64 {
+	a.stateMu.Lock()
+	defer a.stateMu.Unlock()
+	return a.revision
+}
+
+func (a *Adapter) setRevision(rev int64) {
+	a.stateMu.Lock()
+	a.revision = rev
+	a.stateMu.Unlock()
+}
+
+// noteWrite increments the revision after a write to the policy. The
+// adapter keeps considering its policy current only if no other writer
+// incremented the revision in the meantime.
+func (a *Adapter) noteWrite(ctx context.Context) error {
+	if !a.cfg.OptimisticConcurrency {
+		return nil
+	}
+	ctx, cancel := a.opContext(ctx)
+	defer cancel()
+
+	var doc struct {
+		Revision int64 `bson:"revision"`
+	}
+	err := a.meta().FindOneAndUpdate(ctx,
+		bson.D{{Key: "_id", Value: a.metaID()}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "revision", Value: 1}}}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return err
+	}
+	a.stateMu.Lock()
+	if doc.Revision == a.revision+1 {
+		a.revision = doc.Revision
+	}
+	a.stateMu.Unlock()
+	return nil
+}
+
+// claimRevision increments the revision if it still is the one last loaded
+// or saved by the adapter, and fails with ErrConcurrentModification
+// otherwise.
+func (a *Adapter) claimRevision(ctx context.Context) error {
+	if !a.cfg.OptimisticConcurrency {
+		return nil
+	}
+	ctx, cancel := a.opContext(ctx)
+	defer cancel()
+
+	current := a.currentRevision()
+	if err := a.bumpRevision(ctx, current); err != nil {
+		return err
+	}
+	a.setRevision(current + 1)
+	return nil
+}
+
+// bumpRevision increments the stored revision if it is current, and fails
+// with ErrConcurrentModification otherwise. A missing meta document stands
+// for revision 0, so it is only created when current is 0.
+func (a *Adapter) bumpRevision(ctx context.Context, current int64) error {
+	filter := bson.D{{Key: "_id", Value: a.metaID()}, {Key: "revision", Value: current}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "revision", Value: current + 1}}}}
+	if current == 0 {
+		_, err := a.meta().UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			// The filter did not match an existing document, so the upsert
+			// collided with it: its revision has moved on.
+			return ErrConcurrentModification
+		}
+		return err
+	}
+
+	res, err := a.meta().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrConcurrentModification
+	}
+	return nil
+}
+
+// SavePolicyIfVersion saves the policy as SavePolicy does, but only if the
+// revision of the stored policy, see PolicyRevision, is expectedVersion. The
+// revision is checked and incremented in the same transaction as the rules
+// are replaced, so two concurrent saves of the same revision cannot both
+// succeed: the other one fails with ErrConcurrentModification. Transactions
+// require a replica set or a sharded cluster. Other writes only increment the
+// revision with OptimisticConcurrency.
+func (a *Adapter) SavePolicyIfVersion(model model.Model, expectedVersion int64) error {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if a.IsFiltered() || a.cfg.IsFiltered {
+		return a.wrapErr("SavePolicyIfVersion", ErrFilteredSave)
+	}
+	if err := a.ensureOpen(); err != nil {
+		return a.wrapErr("SavePolicyIfVersion", err)
+	}
+
+	lines := a.modelLines(model)
+	if len(lines) == 0 && a.cfg.RefuseEmptySave {
+		return a.wrapErr("SavePolicyIfVersion", ErrEmptySave)
+	}
+	// The new rules supersede any writes still waiting in the buffer.
+	a.discardPending()
+
+	ctx, done := a.startOp(context.TODO(), "SavePolicyIfVersion", nil)
+	defer done()
+
+	sess, err := a.collection.Database().Client().StartSession()
+	if err != nil {
+		return a.wrapErr("SavePolicyIfVersion", err)
+	}
+	defer sess.EndSession(ctx)
+
+	_, err = sess.WithTransaction(ctx, func(ctx context.Context) (interface{}, error) {
+		if err := a.bumpRevision(ctx, expectedVersion); err != nil {
+			return nil, err
+		}
+
+		// Collections cannot be dropped in a transaction, so the rules are
+		// deleted instead.
+		if _, err := a.removeMany(ctx, bson.D{}); err != nil {
+			return nil, err
+		}
+		return nil, a.insertMany(ctx, lines)
+	})
+	if err != nil {
+		return a.wrapErr("SavePolicyIfVersion", err)
+	}
+	a.setRevision(expectedVersion + 1)
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// errRouted is returned by the operations that cannot tell which collection
+// a rule is stored in with CollectionRouter.
+var errRouted = errors.New("not supported with CollectionRouter")
+
+// CollectionRouter spreads the rules over several collections of the
+// database: route returns the name of the collection a rule is stored in,
+// e.g. from a hash of its subject, or "" for the policy collection.
+//
+// AddPolicy, AddPolicyEx and RemovePolicy write to the collection of their
+// rule, and SavePolicy stores each rule in its collection. Loads, filtered
+// removes and the removal of the stored rules by SavePolicy or ClearPolicies
+// apply to the collections set with ReadCollections, which is required and
+// must cover all the names route returns, e.g. ReadCollections("casbin_rule",
+// "casbin_rule_*"). UpdatePolicy and its variants are not supported, and the
+// other methods, such as HasPolicy or PolicyStats, only query the policy
+// collection. It cannot be used with BufferWrites or SaveViaStaging.
+func CollectionRouter(route func(rule CasbinRule) string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.CollectionRouter = route
+	}
+}
+
+// routedCollection returns the collection storing line.
+func (a *Adapter) routedCollection(line CasbinRule) *mongo.Collection {
+	if a.cfg.CollectionRouter == nil {
+		return a.collection
+	}
+	name := a.cfg.CollectionRouter(line)
+	if name == "" || name == a.cfg.CollectionName {
+		return a.collection
+	}
+	return a.collectionIn(a.collection.Database(), name)
+}
+
+// writeCollections returns the collections removals apply to.
+func (a *Adapter) writeCollections(ctx context.Context) ([]*mongo.Collection, error) {
+	if a.cfg.CollectionRouter == nil {
+		return []*mongo.Collection{a.collection}, nil
+	}
+	return a.readCollections(ctx)
+}
+
+// insertRouted inserts each of docs into its collection, as insertMany
+// does. Documents other than rules go to the policy collection.
+func (a *Adapter) insertRouted(ctx context.Context, docs []interface{}) error {
+	var names []string
+	groups := make(map[string][]interface{})
+	positions := make(map[string][]int)
+	collections := make(map[string]*mongo.Collection)
+	for i, doc := range docs {
+		collection := a.collection
+		if line, ok := doc.(*CasbinRule); ok {
+			collection = a.routedCollection(*line)
+		}
+		name := collection.Name()
+		if _, ok := groups[name]; !ok {
+			names = append(names, name)
+			collections[name] = collection
+		}
+		groups[name] = append(groups[name], doc)
+		positions[name] = append(positions[name], i)
+	}
+
+	var firstErr error
+	var refused BatchError
+	for _, name := range names {
+		err := a.insertInto(ctx, collections[name], groups[name])
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			// Report the positions of the refused documents in docs.
+			for i, pos := range batchErr.Failed {
+				refused.add(positions[name][pos], batchErr.Errs[i])
+			}
+			continue
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return refused.err()
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// replaceByDiff replaces the stored rules with lines, as SaveDiff describes.
+// Stored duplicates of a rule and documents that cannot be decoded are
+// deleted. The writes are not cancelled along with ctx, so that the policy is
+// not left half saved.
+func (a *Adapter) replaceByDiff(ctx context.Context, lines []interface{}) error {
+	defer a.InvalidateCache()
+
+	models, err := a.diffWrites(ctx, lines)
+	if err != nil {
+		return err
+	}
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return err
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	size := a.writeBatchSize()
+	for start := 0; start < len(models); start += size {
+		end := start + size
+		if end > len(models) {
+			end = len(models)
+		}
+		batch := models[start:end]
+
+		res, err := a.retryThrottledBulk(ctx, len(batch), false, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			return a.collection.BulkWrite(ctx, atPositions(batch, pos), options.BulkWrite().SetOrdered(false))
+		})
+		if err != nil {
+			return err
+		}
+		countDocs(ctx, res.InsertedCount+res.ModifiedCount+res.DeletedCount)
+	}
+	return nil
+}
+
+// diffWrites returns the writes removing the stored rules missing from lines
+// and inserting the rules of lines that are not stored.
+func (a *Adapter) diffWrites(ctx context.Context, lines []interface{}) ([]mongo.WriteModel, error) {
+	wanted := make(map[string]*CasbinRule, len(lines))
+	for _, l := range lines {
+		line := l.(*CasbinRule)
+		wanted[diffKey(*line)] = line
+	}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, a.liveFilter(bson.D{}))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+
+	var models []mongo.WriteModel
+	for cur.Next(ctx) {
+		var line CasbinRule
+		if err := cur.Decode(&line); err == nil {
+			key := diffKey(line)
+			if _, ok := wanted[key]; ok {
+				// Any other stored copy of the rule is a duplicate.
+				delete(wanted, key)
+				continue
+			}
+		}
+		id := cur.Current.Lookup("_id")
+		models = append(models, a.removeOneModel(bson.D{{Key: "_id", Value: id}}))
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	// The rules are inserted in the order of the model.
+	for _, l := range lines {
+		line := l.(*CasbinRule)
+		if wanted[diffKey(*line)] == line {
+			models = append(models, mongo.NewInsertOneModel().SetDocument(a.document(*line)))
+		}
+	}
+	return models, nil
+}
+
+// diffKey identifies the rule of line when diffing the stored rules against
+// a model. A stored rule whose priority is outdated is replaced.
+func diffKey(line CasbinRule) string {
+	values := append([]string{line.PType}, line.tokens()...)
+	return strconv.Itoa(line.Priority) + "\x00" + strings.Join(values, "\x00")
+}
@@ -0,0 +1,293 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// valsField is the field holding the values of a rule with ArraySchema.
+const valsField = "vals"
+
+// arrayIndexedFields are the rule fields indexed by the adapter with
+// ArraySchema: the vals array, for rules holding a value at any position,
+// and each of its positions, for filtered loads and removals.
+var arrayIndexedFields = []string{"ptype", "vals", "vals.0", "vals.1", "vals.2", "vals.3", "vals.4", "vals.5"}
+
+// ArraySchema makes the adapter store the values of a rule as an array in
+// the vals field, e.g. {ptype: "p", vals: ["alice", "data1", "read"]},
+// instead of in the v0 to v5 fields. Rules are loaded from either form, so
+// that a collection can be converted with MigrateSchema while in use.
+// Removals match the whole array, and the v0 to v5 fields of
+// RemoveFilteredPolicy and of filters, e.g. built with PTypeFilter, are
+// matched against the positions of the array: a filter on v1 matches
+// vals.1. Filters may also constrain vals itself, e.g. to select the rules
+// holding a value at any position. It cannot be combined with encrypted
+// fields, Projection or a shard key on v0 to v5.
+func ArraySchema(array bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ArraySchema = array
+	}
+}
+
+// arrayRule is the document storing a rule with ArraySchema.
+type arrayRule struct {
+	PType     string     `bson:"ptype"`
+	Vals      []string   `bson:"vals"`
+	Tenant    string     `bson:"tenant,omitempty"`
+	Section   string     `bson:"sec,omitempty"`
+	Priority  int        `bson:"priority,omitempty"`
+	UpdatedAt *time.Time `bson:"updatedAt,omitempty"`
+}
+
+// UnmarshalBSON decodes a rule stored with either schema, taking its values
+// from the vals array if the document has one, see ArraySchema.
+func (line *CasbinRule) UnmarshalBSON(data []byte) error {
+	// plainRule has the fields of CasbinRule but not its methods, so that
+	// decoding it does not recurse.
+	type plainRule CasbinRule
+	var doc struct {
+		Rule plainRule `bson:",inline"`
+		Vals []string  `bson:"vals,omitempty"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	*line = CasbinRule(doc.Rule)
+	if doc.Vals == nil {
+		return nil
+	}
+	if len(doc.Vals) > 6 {
+		return fmt.Errorf("rule with %d values, at most 6 are supported", len(doc.Vals))
+	}
+	values := savePolicyLine(line.PType, doc.Vals)
+	line.V0, line.V1, line.V2, line.V3, line.V4, line.V5 = values.V0, values.V1, values.V2, values.V3, values.V4, values.V5
+	return nil
+}
+
+// document returns the document storing line in the schema of the adapter.
+func (a *Adapter) document(line CasbinRule) interface{} {
+	if !a.cfg.ArraySchema {
+		return line
+	}
+	return arrayRule{
+		PType:     line.PType,
+		Vals:      line.tokens(),
+		Tenant:    line.Tenant,
+		Section:   line.Section,
+		Priority:  line.Priority,
+		UpdatedAt: line.UpdatedAt,
+	}
+}
+
+// documents returns docs with the rules they hold as *CasbinRule stored in
+// the schema of the adapter.
+func (a *Adapter) documents(docs []interface{}) []interface{} {
+	if !a.cfg.ArraySchema {
+		return docs
+	}
+	out := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		if line, ok := doc.(*CasbinRule); ok {
+			out[i] = a.document(*line)
+		} else {
+			out[i] = doc
+		}
+	}
+	return out
+}
+
+// schemaFilter returns filter with its v0 to v5 fields, at any depth,
+// replaced by the positions of the vals array with ArraySchema, or filter
+// itself otherwise.
+func (a *Adapter) schemaFilter(filter interface{}) interface{} {
+	if !a.cfg.ArraySchema {
+		return filter
+	}
+	return arrayFilter(filter)
+}
+
+func arrayFilter(filter interface{}) interface{} {
+	switch f := filter.(type) {
+	case bson.D:
+		out := make(bson.D, len(f))
+		for i, e := range f {
+			out[i] = bson.E{Key: arrayField(e.Key), Value: arrayFilter(e.Value)}
+		}
+		return out
+	case *bson.D:
+		return arrayFilter(*f)
+	case bson.M:
+		return bson.M(arrayFilter(map[string]interface{}(f)).(map[string]interface{}))
+	case *bson.M:
+		return arrayFilter(*f)
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(f))
+		for k, v := range f {
+			out[arrayField(k)] = arrayFilter(v)
+		}
+		return out
+	case *map[string]interface{}:
+		return arrayFilter(*f)
+	case bson.A:
+		out := make(bson.A, len(f))
+		for i, v := range f {
+			out[i] = arrayFilter(v)
+		}
+		return out
+	case []interface{}:
+		return arrayFilter(bson.A(f))
+	case []bson.D:
+		out := make(bson.A, len(f))
+		for i, v := range f {
+			out[i] = arrayFilter(v)
+		}
+		return out
+	}
+	return filter
+}
+
+// arrayField returns the position of the vals array storing field, if it is
+// one of v0 to v5, or field itself.
+func arrayField(field string) string {
+	if len(field) == 2 && field[0] == 'v' && field[1] >= '0' && field[1] <= '5' {
+		return valsField + "." + field[1:]
+	}
+	return field
+}
+
+// arraySelector returns the selector matching the stored rule of the given
+// ptype with ArraySchema, comparing the whole array of its values. As with
+// the v0 to v5 fields, trailing empty values match whether they are stored
+// or not.
+func arraySelector(ptype string, rule []string) bson.D {
+	vals := savePolicyLine(ptype, rule).tokens()
+	arrays := bson.A{vals}
+	for padded := vals; len(padded) < 6; {
+		padded = append(padded[:len(padded):len(padded)], "")
+		arrays = append(arrays, padded)
+	}
+	return bson.D{
+		{Key: "ptype", Value: ptype},
+		{Key: valsField, Value: bson.D{{Key: "$in", Value: arrays}}},
+	}
+}
+
+// MigrateSchema converts the stored rules, those of the tenant with Tenant,
+// to the schema of the adapter: to the vals array with ArraySchema, to the
+// v0 to v5 fields otherwise. It returns the number of rules converted, and
+// can be run again to resume a failed conversion. The indexes of the former
+// schema are left in place, see DropIndexes and EnsureIndexes.
+func (a *Adapter) MigrateSchema(ctx context.Context) (int64, error) {
+	a.policyMu.Lock()
+	defer a.policyMu.Unlock()
+
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("MigrateSchema", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		return 0, a.wrapErr("MigrateSchema", err)
+	}
+
+	n, err := a.migrateSchema(ctx)
+	return n, a.wrapErr("MigrateSchema", err)
+}
+
+func (a *Adapter) migrateSchema(ctx context.Context) (int64, error) {
+	defer a.InvalidateCache()
+
+	// Soft-deleted and expired rules are converted too, so that they are
+	// still matched once restored or inspected.
+	filter := a.tenantFilter(bson.D{{Key: valsField, Value: bson.D{{Key: "$exists", Value: !a.cfg.ArraySchema}}}})
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, filter)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(context.Background())
+
+	var converted int64
+	var models []mongo.WriteModel
+	write := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := a.retryThrottledBulk(ctx, len(models), false, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+			return a.collection.BulkWrite(ctx, atPositions(models, pos), options.BulkWrite().SetOrdered(false))
+		})
+		converted += res.ModifiedCount
+		models = models[:0]
+		return err
+	}
+
+	size := a.writeBatchSize()
+	for cur.Next(ctx) {
+		var line CasbinRule
+		if err := cur.Decode(&line); err != nil {
+			return converted, fmt.Errorf("decoding policy document: %w", err)
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: cur.Current.Lookup("_id")}}).
+			SetUpdate(a.schemaUpdate(line)))
+		if len(models) == size {
+			if err := write(); err != nil {
+				return converted, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return converted, err
+	}
+	return converted, write()
+}
+
+// schemaUpdate returns the update storing the values of line in the schema
+// of the adapter and removing those of the other schema.
+func (a *Adapter) schemaUpdate(line CasbinRule) bson.D {
+	columns := bson.D{
+		{Key: "v0", Value: line.V0},
+		{Key: "v1", Value: line.V1},
+		{Key: "v2", Value: line.V2},
+		{Key: "v3", Value: line.V3},
+		{Key: "v4", Value: line.V4},
+		{Key: "v5", Value: line.V5},
+	}
+	if !a.cfg.ArraySchema {
+		return bson.D{
+			{Key: "$set", Value: columns},
+			{Key: "$unset", Value: bson.D{{Key: valsField, Value: ""}}},
+		}
+	}
+
+	unset := make(bson.D, len(columns))
+	for i, e := range columns {
+		unset[i] = bson.E{Key: e.Key, Value: ""}
+	}
+	return bson.D{
+		{Key: "$set", Value: bson.D{{Key: valsField, Value: line.tokens()}}},
+		{Key: "$unset", Value: unset},
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// shardKeyFields are the fields a shard key may be made of: those present in
+// every rule document written by the adapter, and the tenant.
+var shardKeyFields = []string{"ptype", "v0", "v1", "v2", "v3", "v4", "v5", tenantField}
+
+// ShardKey declares the shard key of a sharded policy collection, e.g.
+// ShardKey("ptype", "v0"). SavePolicy then deletes the rules instead of
+// dropping the collection, which would drop its sharding metadata. AddPolicy
+// and RemovePolicy always include all the rule fields, so they are routed to
+// a single shard. RemoveFilteredPolicy only is if the given values cover the
+// shard key, which is more likely with a key starting with ptype.
+//
+// The key may only be made of the fields ptype, v0 to v5 and tenant. The
+// adapter creates no unique index, so none can conflict with the key.
+func ShardKey(fields ...string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ShardKey = fields
+	}
+}
+
+// validateShardKey checks that the shard key is made of rule fields.
+func validateShardKey(fields []string) error {
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		valid := false
+		for _, f := range shardKeyFields {
+			valid = valid || f == field
+		}
+		if !valid {
+			return fmt.Errorf("invalid shard key field %q", field)
+		}
+		if seen[field] {
+			return fmt.Errorf("duplicate shard key field %q", field)
+		}
+		seen[field] = true
+	}
+	return nil
+}
+
+// ShardCollection shards the policy collection on the key set with ShardKey.
+// It runs the shardCollection admin command, so the adapter's user needs the
+// privileges to do so on a sharded cluster. The collection's shard key index
+// is created by the server if the collection is empty.
+func (a *Adapter) ShardCollection(ctx context.Context) error {
+	if len(a.cfg.ShardKey) == 0 {
+		return a.wrapErr("ShardCollection", errors.New("no shard key set"))
+	}
+	if err := a.ensureOpen(); err != nil {
+		return a.wrapErr("ShardCollection", err)
+	}
+
+	key := bson.D{}
+	for _, field := range a.cfg.ShardKey {
+		key = append(key, bson.E{Key: field, Value: 1})
+	}
+	cmd := bson.D{
+		{Key: "shardCollection", Value: a.collectionName()},
+		{Key: "key", Value: key},
+	}
+	return a.wrapErr("ShardCollection", a.client.Database("admin").RunCommand(ctx, cmd).Err())
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// Logger sets the logger the adapter reports slow operations, see
+// SlowOpThreshold, and other warnings to. It defaults to slog.Default().
+func Logger(logger *slog.Logger) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.Logger = logger
+	}
+}
+
+// SlowOpThreshold makes the adapter log a warning for each operation loading,
+// saving, adding, removing or updating rules that takes longer than
+// threshold, e.g. to correlate slow policy loads with the slow query log of
+// the server. The entry holds the name of the operation, the ptype and the v0
+// to v5 fields its selector constrains, but not their values, the number of
+// documents it loaded or wrote and its duration. Zero disables it.
+func SlowOpThreshold(threshold time.Duration) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.SlowOpThreshold = threshold
+	}
+}
+
+// logger returns the logger of the adapter.
+func (a *Adapter) logger() *slog.Logger {
+	if a.cfg.Logger != nil {
+		return a.cfg.Logger
+	}
+	return slog.Default()
+}
+
+type opStatsKey struct{}
+
+// opStats counts the documents loaded or written by an operation.
+type opStats struct {
+	docs atomic.Int64
+}
+
+// startOp starts measuring the operation op on the rules matching selector.
+// The operation must run with the returned context, so that the documents it
+// loads or writes are counted, and call the returned function once done.
+func (a *Adapter) startOp(ctx context.Context, op string, selector interface{}) (context.Context, func()) {
+	threshold := a.cfg.SlowOpThreshold
+	if threshold <= 0 {
+		return ctx, func() {}
+	}
+
+	stats := &opStats{}
+	ctx = context.WithValue(ctx, opStatsKey{}, stats)
+	start := time.Now()
+	return ctx, func() {
+		elapsed := time.Since(start)
+		if elapsed < threshold {
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("op", op),
+			slog.String("collection", a.collectionName()),
+		}
+		if ptype, ok := selectorPType(selector); ok {
+			attrs = append(attrs, slog.String("ptype", ptype))
+		}
+		var fields []string
+		for _, field := range ruleFields(selector) {
+			if field != "ptype" {
+				fields = append(fields, field)
+			}
+		}
+		attrs = append(attrs,
+			slog.Any("fields", fields),
+			slog.Int64("docs", stats.docs.Load()),
+			slog.Duration("duration", elapsed),
+		)
+		a.logger().LogAttrs(ctx, slog.LevelWarn, "mongodbadapter: slow operation", attrs...)
+	}
+}
+
+// countDocs adds n to the documents loaded or written by the operation ctx
+// belongs to, if it is measured.
+func countDocs(ctx context.Context, n int64) {
+	if stats, ok := ctx.Value(opStatsKey{}).(*opStats); ok {
+		stats.docs.Add(n)
+	}
+}
+
+// selectorPType returns the ptype selector matches, if it matches a single
+// one at its top level.
+func selectorPType(selector interface{}) (string, bool) {
+	switch s := selector.(type) {
+	case map[string]interface{}:
+		ptype, ok := s["ptype"].(string)
+		return ptype, ok
+	case *map[string]interface{}:
+		return selectorPType(*s)
+	case bson.M:
+		return selectorPType(map[string]interface{}(s))
+	case *bson.M:
+		return selectorPType(map[string]interface{}(*s))
+	case bson.D:
+		for _, e := range s {
+			if e.Key == "ptype" {
+				ptype, ok := e.Value.(string)
+				return ptype, ok
+			}
+		}
+	case *bson.D:
+		return selectorPType(*s)
+	}
+	return "", false
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowOpEntries decodes the slow operation entries logged as JSON to buf.
+func slowOpEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Expected a JSON log entry; got %q", line)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestStartOp(t *testing.T) {
+	var buf bytes.Buffer
+	a := &Adapter{cfg: defaultConfig()}
+	Logger(slog.New(slog.NewJSONHandler(&buf, nil)))(a)
+
+	ctx, done := a.startOp(context.Background(), "RemoveFilteredPolicy", filteredSelector("p", 1, "data1", "", "secret"))
+	countDocs(ctx, 3)
+	done()
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be logged without SlowOpThreshold; got %q", buf.String())
+	}
+
+	SlowOpThreshold(time.Nanosecond)(a)
+	ctx, done = a.startOp(context.Background(), "RemoveFilteredPolicy", filteredSelector("p", 1, "data1", "", "secret"))
+	countDocs(ctx, 3)
+	time.Sleep(time.Millisecond)
+	done()
+
+	entries := slowOpEntries(t, &buf)
+	if len(entries) != 1 {
+		t.Fatalf("Logged %d entries, supposed to be 1", len(entries))
+	}
+	entry := entries[0]
+	if entry["level"] != "WARN" || entry["op"] != "RemoveFilteredPolicy" || entry["ptype"] != "p" || entry["docs"] != 3.0 {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+	if fields := entry["fields"]; !reflect.DeepEqual(fields, []interface{}{"v1", "v3"}) {
+		t.Errorf("Fields: %v, supposed to be [v1 v3]", fields)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Expected the values of the selector not to be logged; got %q", buf.String())
+	}
+
+	SlowOpThreshold(time.Hour)(a)
+	buf.Reset()
+	_, done = a.startOp(context.Background(), "LoadPolicy", nil)
+	done()
+	if buf.Len() != 0 {
+		t.Errorf("Expected a fast operation not to be logged; got %q", buf.String())
+	}
+}
+
+func TestSlowOpThreshold(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	var buf bytes.Buffer
+	a := NewAdapter(getDbURL(), DBName(getDbName()),
+		SlowOpThreshold(time.Nanosecond), Logger(slog.New(slog.NewJSONHandler(&buf, nil))))
+	newTestEnforcer(t, "examples/rbac_model.conf", a)
+
+	entries := slowOpEntries(t, &buf)
+	if len(entries) != 1 || entries[0]["op"] != "LoadPolicy" || entries[0]["docs"] != 5.0 {
+		t.Errorf("Logged %v, supposed to be a LoadPolicy of 5 documents", entries)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/casbin/casbin/v2/model"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Server error codes of reads at a cluster time.
+const (
+	invalidOptions                = 72
+	readConcernMajorityNotEnabled = 148
+	snapshotTooOld                = 239
+)
+
+// LoadPolicyAtClusterTime loads the policy as it was stored at the cluster
+// time ts, e.g. to tell who had access at that time, with a snapshot read
+// concern. It needs a replica set or a sharded cluster running MongoDB 5.0 or
+// later, and fails with ErrSnapshotUnsupported otherwise, and with
+// ErrSnapshotTooOld when ts is older than the history the server keeps, see
+// its minSnapshotHistoryWindowInSeconds parameter. Only the policy collection
+// is read, and the adapter is left unfiltered as by LoadPolicy.
+func (a *Adapter) LoadPolicyAtClusterTime(model model.Model, ts bson.Timestamp) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(context.TODO(), "LoadPolicyAtClusterTime", nil)
+	defer done()
+
+	return a.wrapErr("LoadPolicyAtClusterTime", a.loadAtClusterTime(ctx, model, ts))
+}
+
+func (a *Adapter) loadAtClusterTime(ctx context.Context, model model.Model, ts bson.Timestamp) error {
+	if err := checkModel(model); err != nil {
+		return err
+	}
+	a.notePriorityTokens(model)
+	a.setFiltered(false)
+
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+
+	cmd := bson.D{
+		{Key: "find", Value: a.collection.Name()},
+		{Key: "filter", Value: a.liveFilter(bson.D{})},
+		{Key: "projection", Value: a.loadProjection()},
+		{Key: "sort", Value: a.loadSort()},
+		{Key: "readConcern", Value: bson.D{
+			{Key: "level", Value: "snapshot"},
+			{Key: "atClusterTime", Value: ts},
+		}},
+	}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Database().RunCommandCursor(ctx, cmd)
+		return err
+	})
+	if err != nil {
+		return snapshotErr(ts, err)
+	}
+
+	err = a.loadCursor(ctx, cur, func(line CasbinRule) error {
+		return loadPolicyLine(line, model)
+	})
+	return snapshotErr(ts, err)
+}
+
+// snapshotErr classifies the error of a read at cluster time ts.
+func snapshotErr(ts bson.Timestamp, err error) error {
+	if err == nil {
+		return nil
+	}
+	var se mongo.ServerError
+	if errors.As(err, &se) {
+		switch {
+		case se.HasErrorCode(snapshotTooOld):
+			return fmt.Errorf("%w: %v (%v)", ErrSnapshotTooOld, ts, err)
+		case se.HasErrorCode(readConcernMajorityNotEnabled), se.HasErrorCodeWithMessage(invalidOptions, "snapshot"):
+			return fmt.Errorf("%w: %v", ErrSnapshotUnsupported, err)
+		}
+	}
+	return fmt.Errorf("reading at cluster time %v: %w", ts, err)
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+func TestSnapshotErr(t *testing.T) {
+	ts := bson.Timestamp{T: 1700000000, I: 1}
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{mongo.CommandError{Code: 239, Message: "Read timestamp is older than the oldest available timestamp"}, ErrSnapshotTooOld},
+		{mongo.CommandError{Code: 72, Message: "readConcern level 'snapshot' is not supported on standalone"}, ErrSnapshotUnsupported},
+		{mongo.CommandError{Code: 148, Message: "majority read concern is not enabled"}, ErrSnapshotUnsupported},
+	}
+	for _, test := range tests {
+		if err := snapshotErr(ts, test.err); !errors.Is(err, test.want) {
+			t.Errorf("Expected %v to be classified as %v; got %v", test.err, test.want, err)
+		}
+	}
+
+	other := mongo.CommandError{Code: 72, Message: "atClusterTime must not be greater than the current clusterTime"}
+	if err := snapshotErr(ts, other); errors.Is(err, ErrSnapshotUnsupported) || !errors.As(err, new(mongo.CommandError)) {
+		t.Errorf("Expected %v to be passed through; got %v", other, err)
+	}
+	if err := snapshotErr(ts, nil); err != nil {
+		t.Errorf("Expected no error; got %v", err)
+	}
+}
+
+func TestLoadPolicyAtClusterTime(t *testing.T) {
+	requireMongoDB(t)
+	initPolicy(t)
+
+	a := newTestAdapter()
+	ctx := context.Background()
+	var res struct {
+		OperationTime *bson.Timestamp `bson:"operationTime"`
+	}
+	if err := a.collection.Database().RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Decode(&res); err != nil {
+		t.Fatalf("Expected ping to be successful; got %v", err)
+	}
+	if res.OperationTime == nil {
+		t.Skip("cluster times require a replica set")
+	}
+
+	if err := a.AddPolicy("p", "p", []string{"carol", "data3", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+
+	e := newTestEnforcer(t, "examples/rbac_model.conf", a)
+	m := e.GetModel()
+	m.ClearPolicy()
+	err := a.LoadPolicyAtClusterTime(m, *res.OperationTime)
+	if errors.Is(err, ErrSnapshotUnsupported) {
+		t.Skip("snapshot reads are not supported by the server")
+	}
+	if err != nil {
+		t.Fatalf("Expected LoadPolicyAtClusterTime() to be successful; got %v", err)
+	}
+	testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+
+	if err := a.LoadPolicyAtClusterTime(m, bson.Timestamp{T: 1, I: 1}); !errors.Is(err, ErrSnapshotTooOld) {
+		t.Errorf("Expected LoadPolicyAtClusterTime() to fail with ErrSnapshotTooOld; got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// deletedAtField is the field recording when a rule was soft-deleted.
+const deletedAtField = "deletedAt"
+
+// SoftDelete makes the adapter mark removed rules as deleted, by setting
+// their deletedAt field to the time of removal, instead of deleting them.
+// Soft-deleted rules are ignored when loading, counting or listing policy
+// and can be deleted for good with PurgeDeleted. SavePolicy also soft-deletes
+// the rules it replaces.
+func SoftDelete(soft bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.SoftDelete = soft
+	}
+}
+
+// liveFilter restricts filter, in the schema of the adapter, to the rules of
+// the adapter's tenant that are neither soft-deleted nor expired.
+func (a *Adapter) liveFilter(filter interface{}) interface{} {
+	filter = a.tenantFilter(a.schemaFilter(filter))
+	if !a.cfg.SoftDelete && !a.cfg.ExpireRules {
+		return filter
+	}
+	and := bson.A{filter}
+	if a.cfg.SoftDelete {
+		and = append(and, bson.D{{Key: deletedAtField, Value: bson.D{{Key: "$exists", Value: false}}}})
+	}
+	if a.cfg.ExpireRules {
+		and = append(and, notExpired())
+	}
+	return bson.D{{Key: "$and", Value: and}}
+}
+
+// livePipeline prepends to pipeline a stage dropping the rules filtered out
+// by liveFilter.
+func (a *Adapter) livePipeline(pipeline mongo.Pipeline) mongo.Pipeline {
+	if !a.cfg.SoftDelete && !a.cfg.ExpireRules && a.cfg.Tenant == "" {
+		return pipeline
+	}
+	match := bson.D{{Key: "$match", Value: a.liveFilter(bson.D{})}}
+	return append(mongo.Pipeline{match}, pipeline...)
+}
+
+// softDeleteUpdate returns the update marking rules as deleted now, and with
+// TrackUpdates, as updated now.
+func (a *Adapter) softDeleteUpdate() bson.D {
+	now := time.Now()
+	set := bson.D{{Key: deletedAtField, Value: now}}
+	if a.cfg.TrackUpdates {
+		set = append(set, bson.E{Key: updatedAtField, Value: now})
+	}
+	return bson.D{{Key: "$set", Value: set}}
+}
+
+// removeOneModel returns the write removing the first rule matching filter.
+func (a *Adapter) removeOneModel(filter interface{}) mongo.WriteModel {
+	if a.cfg.SoftDelete {
+		return mongo.NewUpdateOneModel().SetFilter(a.liveFilter(filter)).SetUpdate(a.softDeleteUpdate())
+	}
+	return mongo.NewDeleteOneModel().SetFilter(a.liveFilter(filter))
+}
+
+// removeManyModel returns the write removing all rules matching filter.
+func (a *Adapter) removeManyModel(filter interface{}) mongo.WriteModel {
+	collation := a.collation()
+	hint := a.queryHint(filter)
+	if a.cfg.SoftDelete {
+		m := mongo.NewUpdateManyModel().SetFilter(a.liveFilter(filter)).SetUpdate(a.softDeleteUpdate())
+		if collation != nil {
+			m.SetCollation(collation)
+		}
+		if hint != nil {
+			m.SetHint(hint)
+		}
+		return m
+	}
+
+	m := mongo.NewDeleteManyModel().SetFilter(a.liveFilter(filter))
+	if collation != nil {
+		m.SetCollation(collation)
+	}
+	if hint != nil {
+		m.SetHint(hint)
+	}
+	return m
+}
+
+// removeOne removes the first rule matching filter and returns the number of
+// rules removed.
+func (a *Adapter) removeOne(ctx context.Context, filter interface{}) (int64, error) {
+	return a.removeOneIn(ctx, a.collection, filter)
+}
+
+// removeOneIn removes the first rule of collection matching filter, as
+// removeOne does.
+func (a *Adapter) removeOneIn(ctx context.Context, collection *mongo.Collection, filter interface{}) (int64, error) {
+	defer a.InvalidateCache()
+
+	var n int64
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		if a.store != nil {
+			n, err = a.store.deleteOne(ctx, a.liveFilter(filter))
+			return err
+		}
+		if a.cfg.SoftDelete {
+			res, err := collection.UpdateOne(ctx, a.liveFilter(filter), a.softDeleteUpdate())
+			if err != nil {
+				return err
+			}
+			n = res.ModifiedCount
+			return nil
+		}
+
+		res, err := collection.DeleteOne(ctx, a.liveFilter(filter))
+		if err != nil {
+			return err
+		}
+		n = res.DeletedCount
+		return nil
+	})
+	countDocs(ctx, n)
+	return n, err
+}
+
+// removeMany removes all rules matching filter and returns the number of
+// rules removed. With CollectionRouter, it removes them from all the
+// collections read.
+func (a *Adapter) removeMany(ctx context.Context, filter interface{}) (int64, error) {
+	defer a.InvalidateCache()
+
+	collections, err := a.writeCollections(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, collection := range collections {
+		n, err := a.removeManyIn(ctx, collection, filter)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// removeManyIn removes all rules of collection matching filter.
+func (a *Adapter) removeManyIn(ctx context.Context, collection *mongo.Collection, filter interface{}) (int64, error) {
+	collation := a.collation()
+	hint := a.queryHint(filter)
+
+	var n int64
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		if a.store != nil {
+			n, err = a.store.deleteMany(ctx, a.liveFilter(filter))
+			return err
+		}
+		if a.cfg.SoftDelete {
+			opts := options.UpdateMany()
+			if collation != nil {
+				opts.SetCollation(collation)
+			}
+			if hint != nil {
+				opts.SetHint(hint)
+			}
+			res, err := collection.UpdateMany(ctx, a.liveFilter(filter), a.softDeleteUpdate(), opts)
+			if err != nil {
+				return err
+			}
+			n = res.ModifiedCount
+			return nil
+		}
+
+		opts := options.DeleteMany()
+		if collation != nil {
+			opts.SetCollation(collation)
+		}
+		if hint != nil {
+			opts.SetHint(hint)
+		}
+		res, err := collection.DeleteMany(ctx, a.liveFilter(filter), opts)
+		if err != nil {
+			return err
+		}
+		n = res.DeletedCount
+		return nil
+	})
+	countDocs(ctx, n)
+	return n, hintErr(hint, err)
+}
+
+// PurgeDeleted deletes for good the rules soft-deleted more than olderThan
+// ago and returns their number. With Tenant, only the tenant's rules are
+// purged.
+func (a *Adapter) PurgeDeleted(ctx context.Context, olderThan time.Duration) (int64, error) {
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("PurgeDeleted", err)
+	}
+
+	filter := bson.D{{Key: deletedAtField, Value: bson.D{{Key: "$lte", Value: time.Now().Add(-olderThan)}}}}
+	var res *mongo.DeleteResult
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		res, err = a.collection.DeleteMany(ctx, a.tenantFilter(filter))
+		return err
+	})
+	if err != nil {
+		return 0, a.wrapErr("PurgeDeleted", err)
+	}
+	return res.DeletedCount, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// SaveMode selects how SavePolicy replaces the stored rules.
+type SaveMode int
+
+const (
+	// SaveDropInsert drops the policy collection, or deletes its rules, and
+	// inserts the new ones. Readers may see an empty or partial policy in
+	// the meantime.
+	SaveDropInsert SaveMode = iota
+	// SaveViaStaging inserts the new rules into a staging collection, with
+	// the indexes of the policy collection, then renames it over the policy
+	// collection, so that readers see either the old or the new policy. It
+	// requires the renameCollection privilege on the admin database; without
+	// it, SavePolicy logs why and falls back to SaveDropInsert. It is not
+	// supported with Tenant, ShardKey, SoftDelete or DocumentDBCompat.
+	SaveViaStaging
+	// SaveInTransaction deletes the stored rules and inserts the new ones in
+	// a transaction, so that readers see either the old or the new policy
+	// and a failed or cancelled save leaves the old one in place. It needs a
+	// replica set or a sharded cluster, and the policy must fit within the
+	// transaction limits of the server; otherwise, the rules are deleted and
+	// inserted without a transaction.
+	SaveInTransaction
+	// SaveDiff reads the stored rules, then deletes those missing from the
+	// model and inserts those not stored yet in unordered bulk writes,
+	// leaving the unchanged rules in place. It is the fastest mode when few
+	// rules changed in a large policy. Readers see the policy change rule by
+	// rule, but never an empty one. It is not supported with
+	// CollectionRouter.
+	SaveDiff
+)
+
+// unauthorizedCode is the code of the server error refusing an operation the
+// user lacks the privilege for.
+const unauthorizedCode = 13
+
+// SaveStrategy sets how SavePolicy replaces the stored rules. It defaults to
+// SaveDropInsert.
+func SaveStrategy(mode SaveMode) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.SaveMode = mode
+	}
+}
+
+// validateSaveMode reports an unknown save mode, or a staged save with
+// settings storing other rules, or keeping deleted ones, in the policy
+// collection.
+func (c *Config) validateSaveMode() error {
+	switch c.SaveMode {
+	case SaveDropInsert, SaveInTransaction, SaveDiff:
+		return nil
+	case SaveViaStaging:
+		if c.Tenant != "" || len(c.ShardKey) > 0 || c.SoftDelete || c.DocumentDBCompat {
+			return errors.New("SaveViaStaging is not supported with Tenant, ShardKey, SoftDelete or DocumentDBCompat")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown save mode %d", c.SaveMode)
+}
+
+// replaceViaStaging replaces the stored rules with lines by renaming a
+// staging collection over the policy collection. The staging collection is
+// dropped if anything fails.
+func (a *Adapter) replaceViaStaging(ctx context.Context, lines []interface{}) error {
+	defer a.InvalidateCache()
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	db := a.collection.Database()
+	name := a.cfg.CollectionName + "_staging_" + hex.EncodeToString(suffix)
+	staging := a.collectionIn(db, name)
+
+	err := a.fillStaging(ctx, staging, lines)
+	if err == nil {
+		err = db.Client().Database("admin").RunCommand(ctx, bson.D{
+			{Key: "renameCollection", Value: db.Name() + "." + name},
+			{Key: "to", Value: a.collectionName()},
+			{Key: "dropTarget", Value: true},
+		}).Err()
+	}
+	if err == nil {
+		return nil
+	}
+	staging.Drop(context.Background())
+
+	var se mongo.ServerError
+	if !errors.As(err, &se) || !se.HasErrorCode(unauthorizedCode) {
+		return err
+	}
+	a.logger().Warn("mongodbadapter: cannot rename a staging collection; saving policy by dropping and inserting instead",
+		slog.String("collection", a.collectionName()), slog.Any("error", err))
+	a.stagingDenied = true
+	return a.dropInsert(ctx, lines)
+}
+
+// fillStaging creates in staging the indexes of the policy collection, or the
+// adapter's indexes if it has none yet, and inserts lines.
+func (a *Adapter) fillStaging(ctx context.Context, staging *mongo.Collection, lines []interface{}) error {
+	indexes, err := a.indexSpecs(ctx)
+	if err != nil {
+		return err
+	}
+
+	if a.cfg.ValidateDocuments {
+		// Renaming the staging collection keeps its validator.
+		if _, err := a.ensureCollection(ctx, staging, a.validatorOptions()); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(indexes) > 0:
+		err = staging.Database().RunCommand(ctx, bson.D{
+			{Key: "createIndexes", Value: staging.Name()},
+			{Key: "indexes", Value: indexes},
+		}).Err()
+	case a.cfg.EnsureIndexes:
+		_, err = a.ensureIndexes(ctx, staging)
+	case !a.cfg.ValidateDocuments:
+		// Make sure the staging collection exists even without rules.
+		err = staging.Database().CreateCollection(ctx, staging.Name())
+	}
+	if err != nil {
+		return err
+	}
+	return a.insertInto(ctx, staging, lines)
+}
+
+// indexSpecs returns the specifications of the indexes of the policy
+// collection but _id, as accepted by the createIndexes command.
+func (a *Adapter) indexSpecs(ctx context.Context) (bson.A, error) {
+	cur, err := a.collection.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var specs []bson.D
+	if err := cur.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	var indexes bson.A
+	for _, spec := range specs {
+		index := make(bson.D, 0, len(spec))
+		skip := false
+		for _, e := range spec {
+			switch e.Key {
+			case "v", "ns":
+				continue
+			case "name":
+				skip = e.Value == "_id_"
+			}
+			index = append(index, e)
+		}
+		if !skip {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// PolicyStats returns the number of stored rules per ptype, without loading
+// them. An empty collection yields an empty map.
+func (a *Adapter) PolicyStats(ctx context.Context) (map[string]int64, error) {
+	if err := a.ensureOpen(); err != nil {
+		return nil, a.wrapErr("PolicyStats", err)
+	}
+
+	stats, err := a.groupByPType(ctx)
+	if err != nil {
+		// Some MongoDB-compatible servers restrict aggregations, so fall
+		// back to counting the rules of each ptype separately.
+		stats, err = a.countByPType(ctx)
+	}
+	return stats, a.wrapErr("PolicyStats", err)
+}
+
+// groupByPType counts the rules per ptype with a $group aggregation.
+func (a *Adapter) groupByPType(ctx context.Context) (map[string]int64, error) {
+	pipeline := a.livePipeline(mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$ptype"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	})
+
+	var cursor *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) error {
+		var err error
+		cursor, err = a.collection.Aggregate(ctx, pipeline)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	stats := make(map[string]int64)
+	for cursor.Next(ctx) {
+		var group struct {
+			PType string `bson:"_id"`
+			Count int64  `bson:"count"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		stats[group.PType] = group.Count
+	}
+	return stats, cursor.Err()
+}
+
+// countByPType counts the rules of each distinct ptype with CountDocuments.
+func (a *Adapter) countByPType(ctx context.Context) (map[string]int64, error) {
+	var ptypes []string
+	err := a.retryThrottled(ctx, func(ctx context.Context) error {
+		return a.collection.Distinct(ctx, "ptype", a.liveFilter(bson.D{})).Decode(&ptypes)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]int64, len(ptypes))
+	for _, ptype := range ptypes {
+		var n int64
+		err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+			n, err = a.collection.CountDocuments(ctx, a.liveFilter(bson.D{{Key: "ptype", Value: ptype}}))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		stats[ptype] = n
+	}
+	return stats, nil
+}
+
+// CountPolicies returns the number of stored rules of the given ptype whose
+// values start with fieldValues. As with RemoveFilteredPolicy, empty values
+// match any value.
+func (a *Adapter) CountPolicies(ctx context.Context, ptype string, fieldValues ...string) (int64, error) {
+	if err := a.ensureOpen(); err != nil {
+		return 0, a.wrapErr("CountPolicies", err)
+	}
+
+	opts := options.Count()
+	if collation := a.collation(); collation != nil {
+		opts.SetCollation(collation)
+	}
+
+	var n int64
+	err := a.retryThrottled(ctx, func(ctx context.Context) error {
+		var err error
+		n, err = a.collection.CountDocuments(ctx, a.liveFilter(a.fieldSelector(ptype, 0, fieldValues...)), opts)
+		return err
+	})
+	return n, a.wrapErr("CountPolicies", err)
+}
+
+// DistinctValues returns the distinct values of the field fieldIndex, 0 to 5
+// for v0 to v5, among the stored rules of the given ptype, in ascending
+// order, e.g. the subjects of the p rules for fieldIndex 0. Rules leaving the
+// field empty are ignored. When the values exceed the 16MB limit of the
+// distinct command, they are collected with a $group aggregation instead.
+func (a *Adapter) DistinctValues(ctx context.Context, ptype string, fieldIndex int) ([]string, error) {
+	values, err := a.distinctValues(ctx, ptype, fieldIndex)
+	return values, a.wrapErr("DistinctValues", err)
+}
+
+// GetAllSubjects returns the distinct subjects of the stored p rules, as
+// casbin's GetAllSubjects does for the loaded policy of the standard model.
+func (a *Adapter) GetAllSubjects(ctx context.Context) ([]string, error) {
+	values, err := a.distinctValues(ctx, "p", 0)
+	return values, a.wrapErr("GetAllSubjects", err)
+}
+
+// GetAllObjects returns the distinct objects of the stored p rules.
+func (a *Adapter) GetAllObjects(ctx context.Context) ([]string, error) {
+	values, err := a.distinctValues(ctx, "p", 1)
+	return values, a.wrapErr("GetAllObjects", err)
+}
+
+// GetAllActions returns the distinct actions of the stored p rules.
+func (a *Adapter) GetAllActions(ctx context.Context) ([]string, error) {
+	values, err := a.distinctValues(ctx, "p", 2)
+	return values, a.wrapErr("GetAllActions", err)
+}
+
+// Error codes of a distinct command whose result exceeds the maximum
+// document size, depending on the server version.
+const (
+	distinctTooBig     = 17217
+	bsonObjectTooLarge = 10334
+)
+
+func (a *Adapter) distinctValues(ctx context.Context, ptype string, fieldIndex int) ([]string, error) {
+	if fieldIndex < 0 || fieldIndex > 5 {
+		return nil, fmt.Errorf("invalid field index %d", fieldIndex)
+	}
+	if err := a.flush(ctx); err != nil {
+		return nil, err
+	}
+	if err := a.ensureOpen(); err != nil {
+		return nil, err
+	}
+
+	field := fmt.Sprintf("v%d", fieldIndex)
+	filter := a.liveFilter(bson.D{
+		{Key: "ptype", Value: ptype},
+		{Key: field, Value: bson.D{{Key: "$nin", Value: bson.A{"", nil}}}},
+	})
+	opts := options.Distinct()
+	if collation := a.collation(); collation != nil {
+		opts.SetCollation(collation)
+	}
+
+	if a.cfg.ArraySchema {
+		// The distinct command cannot select a position of an array.
+		return a.groupValues(ctx, bson.D{{Key: "$arrayElemAt", Value: bson.A{"$" + valsField, fieldIndex}}}, filter)
+	}
+
+	var values []string
+	err := a.retryThrottled(ctx, func(ctx context.Context) error {
+		values = nil
+		return a.collection.Distinct(ctx, field, filter, opts).Decode(&values)
+	})
+	var se mongo.ServerError
+	if errors.As(err, &se) && (se.HasErrorCode(distinctTooBig) || se.HasErrorCode(bsonObjectTooLarge)) {
+		return a.groupValues(ctx, "$"+field, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// groupValues returns the distinct values of the expression value among the
+// rules matching filter with a $group aggregation, which is not bound by the
+// maximum document size, in ascending order.
+func (a *Adapter) groupValues(ctx context.Context, value interface{}, filter interface{}) ([]string, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.D{{Key: "_id", Value: value}}}},
+	}
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	if collation := a.collation(); collation != nil {
+		opts.SetCollation(collation)
+	}
+
+	var cursor *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cursor, err = a.collection.Aggregate(ctx, pipeline, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var values []string
+	for cursor.Next(ctx) {
+		var group struct {
+			Value string `bson:"_id"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		values = append(values, group.Value)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+	sort.Strings(values)
+	return values, nil
+}
@@ -0,0 +1,306 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// store holds the rules of an adapter without a policy collection, see
+// NewMemoryAdapter. It is given the filters and documents the adapter would
+// send to the collection, and supports the operations of loads, saves,
+// insertions and removals only.
+type store interface {
+	// find returns a cursor over the documents matching filter, ordered by
+	// sort.
+	find(ctx context.Context, filter interface{}, sort interface{}) (*mongo.Cursor, error)
+	// insertOne inserts doc and returns its _id.
+	insertOne(ctx context.Context, doc interface{}) (interface{}, error)
+	// insertMany inserts docs.
+	insertMany(ctx context.Context, docs []interface{}) error
+	// deleteOne deletes the first document matching filter and returns the
+	// number of documents deleted.
+	deleteOne(ctx context.Context, filter interface{}) (int64, error)
+	// deleteMany deletes the documents matching filter and returns their
+	// number.
+	deleteMany(ctx context.Context, filter interface{}) (int64, error)
+	// drop deletes all the documents.
+	drop(ctx context.Context) error
+}
+
+// NewMemoryAdapter creates an adapter holding its rules in memory instead of
+// a MongoDB collection, e.g. to test code using the adapter without a
+// server. It supports loads, including filtered loads with a selector,
+// SavePolicy, ClearPolicies, and the AddPolicy and RemovePolicy methods and
+// their variants, with the same filters and semantics as against MongoDB;
+// other methods fail with ErrUnsupportedInMemory. The options needing a
+// server, such as SoftDelete, BufferWrites or CollectionRouter, are refused.
+func NewMemoryAdapter(opts ...func(*Adapter)) (*Adapter, error) {
+	a := &Adapter{cfg: defaultConfig(), store: newMemoryStore()}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.filtered = a.cfg.IsFiltered
+
+	if a.optErr != nil {
+		return nil, a.wrapErr("NewAdapter", a.optErr)
+	}
+	if err := a.cfg.validate(); err != nil {
+		return nil, a.wrapErr("NewAdapter", err)
+	}
+	if err := a.cfg.validateMemory(); err != nil {
+		return nil, a.wrapErr("NewAdapter", err)
+	}
+	return a, nil
+}
+
+// validateMemory reports the first setting of c the in-memory store cannot
+// honor.
+func (c *Config) validateMemory() error {
+	unsupported := []struct {
+		set  bool
+		name string
+	}{
+		{c.BufferSize > 0, "BufferWrites"},
+		{c.SoftDelete, "SoftDelete"},
+		{c.ExpireRules, "ExpireRules"},
+		{c.TrackUpdates, "TrackUpdates"},
+		{c.CollectionRouter != nil, "CollectionRouter"},
+		{len(c.ReadCollections) > 0, "ReadCollections"},
+		{len(c.Projection) > 0, "Projection"},
+		{c.CaseInsensitive || c.IndexCollation != nil, "CaseInsensitive and IndexCollation"},
+		{c.AutoEncryption != nil || len(c.EncryptedFields) > 0, "AutoEncryption"},
+		{c.OptimisticConcurrency, "OptimisticConcurrency"},
+		{c.ValidateDocuments, "ValidateDocuments"},
+		{c.SaveMode != SaveDropInsert, "SaveStrategy"},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%s is not supported by the in-memory adapter", u.name)
+		}
+	}
+	return nil
+}
+
+// ensureStorage is ensureOpen for the operations supported by a store,
+// which need no collection.
+func (a *Adapter) ensureStorage() error {
+	if a.store != nil {
+		return nil
+	}
+	return a.ensureOpen()
+}
+
+// removeEach runs the removals of models, built by removeOneModel, against
+// s one after the other, as an unordered bulk write would.
+func removeEach(ctx context.Context, s store, models []mongo.WriteModel) (*mongo.BulkWriteResult, error) {
+	res := &mongo.BulkWriteResult{}
+	for _, m := range models {
+		remove, ok := m.(*mongo.DeleteOneModel)
+		if !ok {
+			return res, fmt.Errorf("%T is not supported by the in-memory adapter", m)
+		}
+		n, err := s.deleteOne(ctx, remove.Filter)
+		res.DeletedCount += n
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// memoryStore is the store of NewMemoryAdapter. Documents are kept in
+// insertion order, as their BSON form decoded into a bson.D, so that they
+// are matched as the server would match them.
+type memoryStore struct {
+	mu   sync.Mutex
+	docs []bson.D
+	// epoch and seq make up the _id of the inserted documents, which
+	// increase as on a single client.
+	epoch uint32
+	seq   uint64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{epoch: uint32(time.Now().Unix())}
+}
+
+// canonical returns v, a document or a filter, as a bson.D.
+func canonical(v interface{}) (bson.D, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (s *memoryStore) find(ctx context.Context, filter interface{}, sort interface{}) (*mongo.Cursor, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := canonical(filter)
+	if err != nil {
+		return nil, err
+	}
+	var order bson.D
+	if sort != nil {
+		if order, err = canonical(sort); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	var found []bson.D
+	for _, doc := range s.docs {
+		ok, err := matchDocument(doc, f)
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if ok {
+			found = append(found, doc)
+		}
+	}
+	s.mu.Unlock()
+
+	if err := sortDocuments(found, order); err != nil {
+		return nil, err
+	}
+	docs := make([]interface{}, len(found))
+	for i, doc := range found {
+		docs[i] = doc
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (s *memoryStore) insertOne(ctx context.Context, doc interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, err := canonical(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.insert(d), nil
+}
+
+func (s *memoryStore) insertMany(ctx context.Context, docs []interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ds := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		d, err := canonical(doc)
+		if err != nil {
+			return err
+		}
+		ds[i] = d
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range ds {
+		s.insert(d)
+	}
+	return nil
+}
+
+// insert appends doc, with an _id unless it has one, and returns its _id.
+// s.mu must be held.
+func (s *memoryStore) insert(doc bson.D) interface{} {
+	for _, e := range doc {
+		if e.Key == "_id" {
+			s.docs = append(s.docs, doc)
+			return e.Value
+		}
+	}
+
+	s.seq++
+	var id bson.ObjectID
+	binary.BigEndian.PutUint32(id[:4], s.epoch)
+	binary.BigEndian.PutUint64(id[4:], s.seq)
+	s.docs = append(s.docs, append(bson.D{{Key: "_id", Value: id}}, doc...))
+	return id
+}
+
+func (s *memoryStore) deleteOne(ctx context.Context, filter interface{}) (int64, error) {
+	return s.delete(ctx, filter, 1)
+}
+
+func (s *memoryStore) deleteMany(ctx context.Context, filter interface{}) (int64, error) {
+	return s.delete(ctx, filter, -1)
+}
+
+// delete deletes the first limit documents matching filter, or all of them
+// if limit is negative.
+func (s *memoryStore) delete(ctx context.Context, filter interface{}, limit int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	f, err := canonical(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	kept := s.docs[:0]
+	for i, doc := range s.docs {
+		if n == limit {
+			kept = append(kept, s.docs[i:]...)
+			break
+		}
+		ok, err := matchDocument(doc, f)
+		if err != nil {
+			// Keep the documents not examined yet.
+			s.docs = append(kept, s.docs[i:]...)
+			return n, err
+		}
+		if ok {
+			n++
+			continue
+		}
+		kept = append(kept, doc)
+	}
+	s.docs = kept
+	return n, nil
+}
+
+func (s *memoryStore) drop(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.docs = nil
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func newMemoryTestAdapter(t *testing.T, opts ...func(*Adapter)) *Adapter {
+	t.Helper()
+	a, err := NewMemoryAdapter(opts...)
+	if err != nil {
+		t.Fatalf("Expected NewMemoryAdapter() to be successful; got %v", err)
+	}
+	return a
+}
+
+func TestMemoryAdapter(t *testing.T) {
+	for _, array := range []bool{false, true} {
+		a := newMemoryTestAdapter(t, ArraySchema(array))
+		e := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv")
+		if err := a.SavePolicy(e.GetModel()); err != nil {
+			t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+		}
+
+		e = newTestEnforcer(t, "examples/rbac_model.conf", a)
+		testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}})
+		if ok, _ := e.Enforce("alice", "data2", "read"); !ok {
+			t.Error("Expected alice to read data2 through the data2_admin role")
+		}
+
+		e.AddPolicy("alice", "data1", "write")
+		e.AddPolicies([][]string{{"carol", "data3", "read"}, {"carol", "data3", "write"}})
+		if err := e.LoadPolicy(); err != nil {
+			t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+		}
+		testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}, {"data2_admin", "data2", "read"}, {"data2_admin", "data2", "write"}, {"alice", "data1", "write"}, {"carol", "data3", "read"}, {"carol", "data3", "write"}})
+
+		if err := e.LoadFilteredPolicy(bson.M{"v0": "carol"}); err != nil {
+			t.Errorf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+		}
+		testGetPolicy(t, e, [][]string{{"carol", "data3", "read"}, {"carol", "data3", "write"}})
+		if err := a.SavePolicy(e.GetModel()); !errors.Is(err, ErrFilteredSave) {
+			t.Errorf("Expected SavePolicy() to fail with ErrFilteredSave; got %v", err)
+		}
+		if err := e.LoadPolicy(); err != nil {
+			t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+		}
+
+		e.RemovePolicy("alice", "data1", "write")
+		e.RemovePolicies([][]string{{"carol", "data3", "read"}, {"carol", "data3", "write"}})
+		e.RemoveFilteredPolicy(0, "data2_admin")
+		if err := e.LoadPolicy(); err != nil {
+			t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+		}
+		testGetPolicy(t, e, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}})
+
+		if err := a.RemovePolicy("p", "p", []string{"alice", "data1", "write"}); err != nil {
+			t.Errorf("Expected RemovePolicy() of a missing rule to be successful; got %v", err)
+		}
+		if err := a.ClearPolicies(context.Background()); err != nil {
+			t.Errorf("Expected ClearPolicies() to be successful; got %v", err)
+		}
+		if err := e.LoadPolicy(); err != nil {
+			t.Errorf("Expected LoadPolicy() to be successful; got %v", err)
+		}
+		testGetPolicy(t, e, [][]string{})
+	}
+}
+
+func TestMemoryAdapterOptions(t *testing.T) {
+	a := newMemoryTestAdapter(t, StrictRemove(true), Tenant("acme"))
+	if err := a.AddPolicy("p", "p", []string{"alice", "data1", "read"}); err != nil {
+		t.Fatalf("Expected AddPolicy() to be successful; got %v", err)
+	}
+	if err := a.RemovePolicy("p", "p", []string{"bob", "data1", "read"}); !errors.Is(err, ErrPolicyNotFound) {
+		t.Errorf("Expected RemovePolicy() of a missing rule to fail with ErrPolicyNotFound; got %v", err)
+	}
+	if _, err := a.PolicyStats(context.Background()); !errors.Is(err, ErrUnsupportedInMemory) {
+		t.Errorf("Expected PolicyStats() to fail with ErrUnsupportedInMemory; got %v", err)
+	}
+	if a.Collection() != nil {
+		t.Error("Expected the in-memory adapter to have no collection")
+	}
+
+	// Rules are loaded in the order of their priority, then of insertion.
+	a = newMemoryTestAdapter(t)
+	e := newTestEnforcer(t, "examples/priority_model_explicit.conf", "examples/priority_policy_explicit.csv")
+	if err := a.SavePolicy(e.GetModel()); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+	want, _ := e.GetPolicy()
+	e = newTestEnforcer(t, "examples/priority_model_explicit.conf", a)
+	testGetPolicy(t, e, want)
+
+	if _, err := NewMemoryAdapter(SoftDelete(true)); err == nil {
+		t.Error("Expected SoftDelete to be refused by the in-memory adapter")
+	}
+	if _, err := NewMemoryAdapter(BufferWrites(10)); err == nil {
+		t.Error("Expected BufferWrites to be refused by the in-memory adapter")
+	}
+}
+
+func TestMatchDocument(t *testing.T) {
+	doc, err := canonical(bson.D{
+		{Key: "ptype", Value: "p"},
+		{Key: "v0", Value: "alice"},
+		{Key: "v1", Value: ""},
+		{Key: "vals", Value: bson.A{"alice", "data1"}},
+		{Key: "priority", Value: 10},
+	})
+	if err != nil {
+		t.Fatalf("Expected canonical() to be successful; got %v", err)
+	}
+
+	tests := []struct {
+		filter interface{}
+		want   bool
+	}{
+		{bson.D{}, true},
+		{bson.M{"v0": "alice"}, true},
+		{bson.M{"v0": "bob"}, false},
+		{bson.M{"v1": bson.M{"$in": bson.A{"", nil}}}, true},
+		{bson.M{"v2": bson.M{"$in": bson.A{"", nil}}}, true},
+		{bson.M{"v2": nil}, true},
+		{bson.M{"v2": bson.M{"$exists": true}}, false},
+		{bson.M{"vals": "data1"}, true},
+		{bson.M{"vals.1": "data1"}, true},
+		{bson.M{"vals.0": "data1"}, false},
+		{bson.M{"vals": bson.M{"$in": bson.A{bson.A{"alice", "data1"}}}}, true},
+		{bson.M{"vals": bson.A{"alice"}}, false},
+		{bson.M{"v0": bson.M{"$regex": "^AL", "$options": "i"}}, true},
+		{bson.M{"v0": bson.Regex{Pattern: "^b"}}, false},
+		{bson.M{"priority": bson.M{"$gt": 5, "$lte": int64(10)}}, true},
+		{bson.M{"v0": bson.M{"$ne": "alice"}}, false},
+		{bson.M{"v0": bson.M{"$not": bson.M{"$eq": "bob"}}}, true},
+		{bson.D{{Key: "$or", Value: bson.A{bson.M{"v0": "bob"}, bson.M{"ptype": "p"}}}}, true},
+		{bson.D{{Key: "$and", Value: bson.A{bson.M{"v0": "alice"}, bson.M{"ptype": "g"}}}}, false},
+		{bson.D{{Key: "$nor", Value: bson.A{bson.M{"v0": "bob"}}}}, true},
+	}
+	for _, tt := range tests {
+		filter, err := canonical(tt.filter)
+		if err != nil {
+			t.Fatalf("Expected canonical() to be successful; got %v", err)
+		}
+		if ok, err := matchDocument(doc, filter); err != nil || ok != tt.want {
+			t.Errorf("matchDocument(%v) = %v (%v), supposed to be %v", tt.filter, ok, err, tt.want)
+		}
+	}
+
+	filter, _ := canonical(bson.M{"v0": bson.M{"$where": "true"}})
+	if _, err := matchDocument(doc, filter); !errors.Is(err, errUnsupportedOperator) {
+		t.Errorf("Expected $where to fail with errUnsupportedOperator; got %v", err)
+	}
+}
+
+func TestFilteredLoadCustomSection(t *testing.T) {
+	a := newMemoryTestAdapter(t)
+	m := newTestEnforcer(t, "examples/rbac_model.conf", "examples/rbac_policy.csv").GetModel()
+	m.AddDef("x", "x", "sub, obj")
+	if err := m.AddPolicy("x", "x", []string{"alice", "data1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SavePolicy(m); err != nil {
+		t.Fatalf("Expected SavePolicy() to be successful; got %v", err)
+	}
+
+	// The rules of the custom section are replaced too.
+	if err := a.LoadFilteredPolicy(m, bson.M{"v0": "bob"}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	if rules := m["x"]["x"].Policy; len(rules) != 0 {
+		t.Errorf("Custom section: %q, supposed to be cleared by the filtered load", rules)
+	}
+	if err := a.LoadFilteredPolicy(m, bson.M{"ptype": "x"}); err != nil {
+		t.Fatalf("Expected LoadFilteredPolicy() to be successful; got %v", err)
+	}
+	if rules := m["x"]["x"].Policy; len(rules) != 1 || len(m["p"]["p"].Policy) != 0 {
+		t.Errorf("Custom section: %q, p: %q, supposed to hold the x rule only", rules, m["p"]["p"].Policy)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// tenantField is the field holding the tenant of a rule.
+const tenantField = "tenant"
+
+// Tenant scopes the adapter to the rules of the given tenant, so that several
+// tenants can share one collection. The tenant is stored in the tenant field
+// of the rules the adapter writes, and every load, removal and query only
+// sees the rules of the tenant. SavePolicy then deletes the tenant's rules
+// rather than dropping the collection.
+func Tenant(id string) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.Tenant = id
+	}
+}
+
+// tenantFilter restricts filter to the rules of the adapter's tenant.
+func (a *Adapter) tenantFilter(filter interface{}) interface{} {
+	if a.cfg.Tenant == "" {
+		return filter
+	}
+	return bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: tenantField, Value: a.cfg.Tenant}}}}}
+}
+
+// policyLine returns the document storing a rule of the given section, empty
+// if unknown, for the adapter's tenant, with its priority for priority
+// models.
+func (a *Adapter) policyLine(sec string, ptype string, rule []string) CasbinRule {
+	rule = a.normalizeRule(rule)
+	line := savePolicyLine(ptype, rule)
+	line.Section = ruleSection(sec, ptype)
+	line.Tenant = a.cfg.Tenant
+	line.Priority = a.rulePriority(ptype, rule)
+	if a.cfg.TrackUpdates {
+		now := time.Now()
+		line.UpdatedAt = &now
+	}
+	return line
+}
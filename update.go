@@ -0,0 +1,264 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// UpdatePolicy replaces a stored rule with newRule, matching oldRule as
+// RemovePolicy does. The priority of a rule of a priority model is updated
+// along with its token. With StrictRemove, it returns ErrPolicyNotFound when
+// no stored rule matches oldRule.
+func (a *Adapter) UpdatePolicy(sec string, ptype string, oldRule, newRule []string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(context.TODO(), "UpdatePolicy", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	return a.wrapErr("UpdatePolicy", a.updatePolicies(ctx, sec, ptype, [][]string{oldRule}, [][]string{newRule}))
+}
+
+// UpdatePolicies replaces each of the stored rules oldRules with the rule of
+// newRules at the same position, in a single ordered bulk write.
+func (a *Adapter) UpdatePolicies(sec string, ptype string, oldRules, newRules [][]string) error {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(context.TODO(), "UpdatePolicies", bson.D{{Key: "ptype", Value: ptype}})
+	defer done()
+
+	return a.wrapErr("UpdatePolicies", a.updatePolicies(ctx, sec, ptype, oldRules, newRules))
+}
+
+func (a *Adapter) updatePolicies(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	if a.cfg.CollectionRouter != nil {
+		return errRouted
+	}
+	if len(oldRules) != len(newRules) {
+		return fmt.Errorf("%d rules to update but %d new rules", len(oldRules), len(newRules))
+	}
+	if len(oldRules) == 0 {
+		return nil
+	}
+	if a.cfg.TrackUpdates {
+		return a.updateByTombstones(ctx, sec, ptype, oldRules, newRules)
+	}
+
+	models := make([]mongo.WriteModel, len(oldRules))
+	for i := range oldRules {
+		models[i] = mongo.NewReplaceOneModel().
+			SetFilter(a.liveFilter(a.ruleSelector(ptype, a.normalizeRule(oldRules[i])))).
+			SetReplacement(a.document(a.policyLine(sec, ptype, newRules[i])))
+	}
+
+	if a.buffered() {
+		for _, m := range models {
+			if err := a.bufferWrite(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+	if err := a.flush(ctx); err != nil {
+		return err
+	}
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return err
+	}
+
+	defer a.InvalidateCache()
+	res, err := a.retryThrottledBulk(ctx, len(models), true, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+		return a.collection.BulkWrite(ctx, atPositions(models, pos), options.BulkWrite().SetOrdered(true))
+	})
+	if err != nil {
+		return err
+	}
+	countDocs(ctx, res.ModifiedCount)
+	if a.cfg.StrictRemove && res.MatchedCount < int64(len(models)) {
+		return ErrPolicyNotFound
+	}
+	return a.noteWrite(ctx)
+}
+
+// updateByTombstones updates rules as updatePolicies does, but soft-deletes
+// each old rule and inserts the new one rather than replacing it, so that
+// LoadIncrementalPolicy sees both changes. A new rule is only inserted if its
+// old rule was found.
+func (a *Adapter) updateByTombstones(ctx context.Context, sec string, ptype string, oldRules, newRules [][]string) error {
+	if err := a.ensureOpen(); err != nil {
+		return err
+	}
+
+	defer a.InvalidateCache()
+	missing := false
+	for i := range oldRules {
+		n, err := a.removeOne(ctx, a.ruleSelector(ptype, a.normalizeRule(oldRules[i])))
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			missing = true
+			continue
+		}
+		if _, err := a.addPolicy(ctx, a.policyLine(sec, ptype, newRules[i])); err != nil {
+			return err
+		}
+	}
+	if a.cfg.StrictRemove && missing {
+		return ErrPolicyNotFound
+	}
+	return nil
+}
+
+// UpdateFilteredPolicies replaces the stored rules matching the filter, as
+// RemoveFilteredPolicy matches them, with newRules, and returns the rules
+// replaced.
+func (a *Adapter) UpdateFilteredPolicies(sec string, ptype string, newRules [][]string, fieldIndex int, fieldValues ...string) ([][]string, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	if a.cfg.CollectionRouter != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", errRouted)
+	}
+	if err := a.ensureOpen(); err != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", err)
+	}
+	selector := a.fieldSelector(ptype, fieldIndex, fieldValues...)
+	ctx, done := a.startOp(context.TODO(), "UpdateFilteredPolicies", selector)
+	defer done()
+
+	if err := a.flush(ctx); err != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", err)
+	}
+
+	var cur *mongo.Cursor
+	err := a.retryThrottled(ctx, func(ctx context.Context) (err error) {
+		cur, err = a.collection.Find(ctx, a.liveFilter(selector), options.Find().SetSort(a.loadSort()))
+		return err
+	})
+	if err != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", err)
+	}
+	var oldRules [][]string
+	err = a.loadCursor(ctx, cur, func(line CasbinRule) error {
+		oldRules = append(oldRules, line.tokens())
+		return nil
+	})
+	if err != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", err)
+	}
+
+	if _, err := a.removeMany(ctx, selector); err != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", err)
+	}
+	lines := make([]interface{}, len(newRules))
+	for i, rule := range newRules {
+		line := a.policyLine(sec, ptype, rule)
+		lines[i] = &line
+	}
+	if err := a.insertMany(ctx, lines); err != nil {
+		return nil, a.wrapErr("UpdateFilteredPolicies", err)
+	}
+	return oldRules, a.wrapErr("UpdateFilteredPolicies", a.noteWrite(ctx))
+}
+
+// ReplaceValue replaces oldValue with newValue in the given fields, indexes
+// 0 to 5 of v0 to v5, of all stored rules, whatever their ptype, e.g. to
+// rename a user, and returns the number of values replaced, a rule holding
+// oldValue in two of the fields counting twice. All fields are scanned if
+// none is given. The rules are updated in place by the server, one
+// UpdateMany per field, without loading them; the model must be reloaded
+// afterwards. Soft-deleted and expired rules are left unchanged. It is not
+// supported with TrackUpdates, whose incremental loads would not see the
+// rules changed, nor with CollectionRouter.
+func (a *Adapter) ReplaceValue(ctx context.Context, oldValue, newValue string, fields ...int) (int64, error) {
+	a.policyMu.RLock()
+	defer a.policyMu.RUnlock()
+
+	ctx, done := a.startOp(ctx, "ReplaceValue", nil)
+	defer done()
+
+	n, err := a.replaceValue(ctx, oldValue, newValue, fields)
+	return n, a.wrapErr("ReplaceValue", err)
+}
+
+func (a *Adapter) replaceValue(ctx context.Context, oldValue, newValue string, fields []int) (int64, error) {
+	if a.cfg.TrackUpdates {
+		return 0, errors.New("values cannot be replaced in place with TrackUpdates")
+	}
+	if a.cfg.CollectionRouter != nil {
+		return 0, errRouted
+	}
+	if a.cfg.NormalizeValues {
+		oldValue, newValue = normalizeValue(oldValue), normalizeValue(newValue)
+	}
+	if oldValue == "" {
+		return 0, errors.New("empty value to replace")
+	}
+	if len(fields) == 0 {
+		fields = []int{0, 1, 2, 3, 4, 5}
+	}
+
+	collation := a.collation()
+	models := make([]mongo.WriteModel, len(fields))
+	for i, index := range fields {
+		if index < 0 || index > 5 {
+			return 0, fmt.Errorf("invalid field index %d", index)
+		}
+		field := fmt.Sprintf("v%d", index)
+		if a.cfg.ArraySchema {
+			field = arrayField(field)
+		}
+		m := mongo.NewUpdateManyModel().
+			SetFilter(a.liveFilter(bson.D{{Key: field, Value: oldValue}})).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: newValue}}}})
+		if collation != nil {
+			m.SetCollation(collation)
+		}
+		models[i] = m
+	}
+
+	if err := a.ensureOpen(); err != nil {
+		return 0, err
+	}
+	if err := a.flush(ctx); err != nil {
+		return 0, err
+	}
+	if err := a.ensureWriteIndexes(ctx); err != nil {
+		return 0, err
+	}
+
+	defer a.InvalidateCache()
+	res, err := a.retryThrottledBulk(ctx, len(models), true, func(ctx context.Context, pos []int) (*mongo.BulkWriteResult, error) {
+		return a.collection.BulkWrite(ctx, atPositions(models, pos), options.BulkWrite().SetOrdered(true))
+	})
+	if err != nil {
+		return 0, err
+	}
+	countDocs(ctx, res.ModifiedCount)
+	return res.ModifiedCount, a.noteWrite(ctx)
+}
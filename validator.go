@@ -0,0 +1,94 @@
+// Copyright 2018 The casbin Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongodbadapter
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// ValidateDocuments makes the adapter set a $jsonSchema validator on the
+// policy collection when opening it, so that the server refuses documents
+// that the adapter could not load, whoever writes them: ptype must be a
+// non-empty string, and sec, v0 to v5 and the values of vals, when present,
+// strings, or binary data for the fields encrypted with AutoEncryption. The
+// collection is created with the validator if it does not exist, or modified
+// with collMod otherwise, which requires the collMod privilege, e.g. of the
+// dbAdmin role. Documents already stored are not checked, and can still be
+// removed even if invalid. SavePolicy then deletes the rules instead of
+// dropping the collection, which would drop its validator. Writes refused by
+// the validator fail with an error matching ErrInvalidDocument. It is
+// disabled by default.
+func ValidateDocuments(validate bool) func(*Adapter) {
+	return func(a *Adapter) {
+		a.cfg.ValidateDocuments = validate
+	}
+}
+
+// policyValidator returns the validator of ValidateDocuments, which accepts
+// the rules of both schemas, see ArraySchema. The encrypted fields reach the
+// server as binary data.
+func (a *Adapter) policyValidator() bson.D {
+	properties := bson.D{{Key: "ptype", Value: bson.D{
+		{Key: "bsonType", Value: "string"},
+		{Key: "minLength", Value: 1},
+	}}}
+	for _, field := range []string{sectionField, "v0", "v1", "v2", "v3", "v4", "v5"} {
+		var bsonType interface{} = "string"
+		if a.encrypted(field) {
+			bsonType = bson.A{"string", "binData"}
+		}
+		properties = append(properties, bson.E{Key: field, Value: bson.D{{Key: "bsonType", Value: bsonType}}})
+	}
+	properties = append(properties, bson.E{Key: valsField, Value: bson.D{
+		{Key: "bsonType", Value: "array"},
+		{Key: "maxItems", Value: 6},
+		{Key: "items", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+	}})
+
+	return bson.D{{Key: "$jsonSchema", Value: bson.D{
+		{Key: "bsonType", Value: "object"},
+		{Key: "required", Value: bson.A{"ptype"}},
+		{Key: "properties", Value: properties},
+	}}}
+}
+
+// validatorOptions returns the options creating a collection with the
+// validator of ValidateDocuments.
+func (a *Adapter) validatorOptions() *options.CreateCollectionOptionsBuilder {
+	return options.CreateCollection().SetValidator(a.policyValidator())
+}
+
+// ensureValidator sets the validator of ValidateDocuments on collection,
+// creating it if needed.
+func (a *Adapter) ensureValidator(ctx context.Context, collection *mongo.Collection) error {
+	created, err := a.ensureCollection(ctx, collection, a.validatorOptions())
+	if err != nil || created {
+		return err
+	}
+
+	// A moderate validation level leaves updates and removals of the
+	// documents stored before the validator unchecked.
+	return a.retryThrottled(ctx, func(ctx context.Context) error {
+		return collection.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: collection.Name()},
+			{Key: "validator", Value: a.policyValidator()},
+			{Key: "validationLevel", Value: "moderate"},
+		}).Err()
+	})
+}